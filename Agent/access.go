@@ -0,0 +1,293 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+	"P2PAgent/utils"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+访问控制：被连接方(rosAgent)只接受被授权的对端，授权通过一次性的配对码建立。
+
+1. 被授权的对端的uuid保存在authorized_peers.txt中，每行一个，#之后为注释。
+   设置了Access的Agent在注册时将其作为访问策略告知中继服务器，中继服务器不向其他节点透露本机的地址。
+2. 配对：本机调用StartPairing生成配对码并显示给用户，同时告知中继服务器正在配对。
+   操作者通过RequestForPairing请求连接，中继服务器放行该请求。配对码只在p2p连接上发送，不经过中继服务器。
+3. 选出的连接完成TLS握手后，控制方发送TypeAuth帧，包体为配对码。被控制方检查对端的uuid是否已被授权，
+   未被授权时检查配对码，正确则将对端加入列表并结束配对，否则回复TypeClose帧拒绝。
+   对端的uuid由TLS握手中的证书保证，无法冒充。
+4. 配对码只能使用一次，超过有效期或错误pairingAttempts次后失效。
+*/
+
+// 被授权的对端列表文件
+const authorizedFile = "authorized_peers.txt"
+
+// 配对码的位数
+const pairingCodeDigits = 8
+
+// 配对码允许的错误次数，超过后失效，防止暴力猜测
+const pairingAttempts = 5
+
+var ErrUnauthorized = errors.New("对端未被授权")
+
+// AccessList 允许连接本机的对端列表，以及进行中的配对
+type AccessList struct {
+	path string
+
+	mu    sync.Mutex
+	peers []string
+
+	// 进行中的配对码，为空表示未在配对
+	code     string
+	expires  time.Time
+	failures int
+}
+
+// LoadAccessList 读取被授权的对端列表，path为空时使用程序所在目录下的authorized_peers.txt。
+// 文件不存在时为空列表，配对成功时创建
+func LoadAccessList(path string) (*AccessList, error) {
+	if path == "" {
+		path = utils.GetAppPath() + "/" + authorizedFile
+	}
+	l := &AccessList{path: path}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if id := strings.TrimSpace(line); id != "" {
+			l.peers = append(l.peers, id)
+		}
+	}
+	return l, scanner.Err()
+}
+
+// Allowed uuid为id的对端是否已被授权
+func (l *AccessList) Allowed(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.allowed(id)
+}
+
+func (l *AccessList) allowed(id string) bool {
+	for _, p := range l.peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers 全部被授权的对端
+func (l *AccessList) Peers() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.peers...)
+}
+
+// Pairing 是否正在配对
+func (l *AccessList) Pairing() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pairing()
+}
+
+func (l *AccessList) pairing() bool {
+	return l.code != "" && time.Now().Before(l.expires)
+}
+
+// 告知中继服务器的访问策略
+func (l *AccessList) policy() *protocol.AccessPolicy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &protocol.AccessPolicy{Authorized: append([]string{}, l.peers...), Pairing: l.pairing()}
+}
+
+// 是否接受对端的连接请求：已被授权，或请求配对且本机正在配对
+func (l *AccessList) admits(peer *protocol.PeerInfo) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.allowed(peer.UUID) || (peer.Pairing && l.pairing())
+}
+
+// 生成新的配对码，之前的配对码随之失效
+func (l *AccessList) startPairing(ttl time.Duration) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < pairingCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", pairingCodeDigits, n)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.code = code
+	l.expires = time.Now().Add(ttl)
+	l.failures = 0
+	return code, nil
+}
+
+// 校验对端的配对码，正确时将对端加入列表并结束配对。changed为配对状态是否发生了变化
+func (l *AccessList) pair(id, code string) (changed bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.allowed(id) {
+		return false, nil
+	}
+	if !l.pairing() {
+		return false, ErrUnauthorized
+	}
+	if code == "" || subtle.ConstantTimeCompare([]byte(code), []byte(l.code)) != 1 {
+		l.failures++
+		if l.failures < pairingAttempts {
+			return false, errors.New("配对码错误")
+		}
+		l.code = ""
+		return true, errors.New("配对码错误次数过多，配对码已失效")
+	}
+	l.code = ""
+	if err := l.add(id); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// 将对端加入列表并保存到文件
+func (l *AccessList) add(id string) error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("保存被授权的对端失败: %w", err)
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s # paired at %s\n", id, time.Now().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("保存被授权的对端失败: %w", err)
+	}
+	l.peers = append(l.peers, id)
+	return nil
+}
+
+// StartPairing 生成一次性的配对码，有效期为ttl，需要将其显示给操作者。到期后自动结束配对
+func (s *Agent) StartPairing(ttl time.Duration) (string, error) {
+	if s.Access == nil {
+		return "", errors.New("未设置访问控制，不需要配对")
+	}
+	code, err := s.Access.startPairing(ttl)
+	if err != nil {
+		return "", err
+	}
+	s.publishAccess()
+	s.mu.Lock()
+	if s.pairingTimer != nil {
+		s.pairingTimer.Stop()
+	}
+	s.pairingTimer = time.AfterFunc(ttl, func() { s.goBackground(s.publishAccess) })
+	s.mu.Unlock()
+	return code, nil
+}
+
+// 将当前的访问策略告知中继服务器
+func (s *Agent) publishAccess() {
+	r := s.currentRelay()
+	if s.Access == nil || r == nil || s.ctx == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, checkTimeout)
+	defer cancel()
+	if err := r.call(ctx, protocol.MethodSetAccess, s.Access.policy(), nil); err != nil && ctx.Err() == nil {
+		fmt.Println("更新访问策略失败:", err.Error())
+	}
+}
+
+// RequestForPairing 携带配对码请求与目标节点配对，其余与RequestForAddr相同，同样只有控制方可以请求。
+// 配对码在之后的DailP2P中发送给对端，配对成功后对端记住本机，之后直接使用RequestForAddr即可
+func (s *Agent) RequestForPairing(ctx context.Context, uuid string, code string) (*protocol.PeerInfo, error) {
+	if !s.Controlling {
+		return nil, ErrNotControlling
+	}
+	s.mu.Lock()
+	if s.pairingCodes == nil {
+		s.pairingCodes = make(map[string]string)
+	}
+	s.pairingCodes[uuid] = code
+	s.mu.Unlock()
+	return s.requestForAddr(ctx, uuid, true)
+}
+
+// 在选出的连接上完成授权，控制方发送配对码，被控制方决定是否接受对端
+func (s *Agent) authorize(ctx context.Context, c *checkedConn, peerUUID string) error {
+	stop := interruptOnDone(ctx, c.conn)
+	defer stop()
+	c.conn.SetDeadline(time.Now().Add(checkTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if s.Controlling {
+		s.mu.Lock()
+		code := s.pairingCodes[peerUUID]
+		s.mu.Unlock()
+		if err := c.writer.WriteFrame(&frame.Frame{Type: frame.TypeAuth, Payload: []byte(code)}); err != nil {
+			return err
+		}
+		f, err := c.reader.ReadFrame()
+		if err != nil {
+			return err
+		}
+		switch f.Type {
+		case frame.TypeAuth:
+			s.mu.Lock()
+			delete(s.pairingCodes, peerUUID)
+			s.mu.Unlock()
+			return nil
+		case frame.TypeClose:
+			_, reason, _ := frame.ParseClose(f)
+			return fmt.Errorf("%w: %s", ErrUnauthorized, reason)
+		}
+		return fmt.Errorf("预期收到%s帧，实际收到%s帧", frame.TypeAuth, f.Type)
+	}
+
+	f, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if f.Type != frame.TypeAuth {
+		return fmt.Errorf("预期收到%s帧，实际收到%s帧", frame.TypeAuth, f.Type)
+	}
+	if s.Access != nil {
+		changed, err := s.Access.pair(peerUUID, string(f.Payload))
+		if changed {
+			s.goBackground(s.publishAccess)
+		}
+		if err != nil {
+			fmt.Println("拒绝对端的连接:", peerUUID, err.Error())
+			c.writer.WriteFrame(frame.NewClose(frame.CloseUnauthorized, err.Error()))
+			return fmt.Errorf("%w: %s", ErrUnauthorized, err.Error())
+		}
+		if changed {
+			fmt.Println("配对成功，已授权对端:", peerUUID)
+		}
+	}
+	return c.writer.WriteFrame(&frame.Frame{Type: frame.TypeAuth})
+}
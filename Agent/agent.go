@@ -1,25 +1,66 @@
 package agent
 
 import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
 	"P2PAgent/utils"
-	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Agent struct {
 	// 与中继服务器的连接
 	ServerConn net.Conn
-	// p2p 连接
+
+	// 与中继服务器之间的控制协议，重连后被替换。由mu保护
+	relay *relayConn
+
+	// 保证只启动一个reconnectLoop
+	relayOnce sync.Once
+
+	// 中继服务器的地址，转发数据时连接该地址
+	relayAddr string
+
+	// 连接中继服务器时使用的TLS配置，为nil表示不使用TLS，见LoadRelayTLS
+	RelayTLS *tls.Config
+
+	// 与中继服务器约定的部署令牌，为空表示不需要
+	RelayToken string
+
+	// 中继服务器推送的通知
+	notifyCh chan *protocol.Message
+	// 最近建立的p2p连接
 	P2PConn net.Conn
 
-	// 本机的uuid
+	// 本机的uuid，由身份公钥派生
 	UUID string
-	// 本地的局域网地址
+
+	// 身份密钥文件的路径，为空时使用程序所在目录下的identity.key
+	KeyFile string
+
+	// 同一身份同时运行多个Agent时，各个Agent的实例名，在ConnectToRelay之前设置。
+	// 为空表示主实例；设置了实例名的Agent在中继服务器上不会替换同一身份的其他Agent，但只能主动连接对端
+	Instance string
+
+	// 本机的身份密钥，用于注册时的签名和p2p连接上的TLS握手
+	identity *identity
+
+	// 允许连接本机的对端，为nil表示不限制，见access.go。被连接方(rosAgent)应当设置
+	Access *AccessList
+
+	// RequestForPairing设置的配对码，key为对端的uuid，授权成功后删除。由mu保护
+	pairingCodes map[string]string
+
+	// StartPairing启动的定时器，配对码到期时重新发布访问策略，Close时停止。由mu保护
+	pairingTimer *time.Timer
+	// 默认路由所在网卡的局域网地址
 	PrivAddr string
 
 	// 本机的公网地址
@@ -28,27 +69,190 @@ type Agent struct {
 	// 本机的ipv6地址
 	Ipv6Addr string
 
+	// 本机的全部候选地址，注册后包含中继服务器添加的srflx候选地址。由mu保护
+	Candidates []protocol.Candidate
+
+	// 本机NAT的探测结果，为nil表示尚未探测完成。由mu保护
+	nat *protocol.NATInfo
+
+	// UDP端口，为nil表示UDP不可用
+	udp *udpSocket
+
+	// p2p连接的传输方式的选择策略
+	Transport TransportPolicy
+
+	// 选中UDP路径时使用QUIC代替kcp，以QUIC流承载Mux上的各个流。由控制方决定，被控制方跟随
+	QUIC bool
+
+	// 直连失败时不通过中继服务器转发数据
+	DisableRelay bool
+
 	// 本地使用的端口
 	LocalPort int
 
-	// 需要读取的报文长度
-	Remain_cnt int
+	// 最近建立的p2p连接，P2PConn为其底层连接。WriteFrame、Mux等不指定对端的方法作用于该连接
+	link *p2pLink
 
-	// P2PRead读取到的数据存入到通道中
-	ChannelData chan string
+	// 与各个对端之间的p2p连接，键为对端的uuid。被控制方(rosAgent)可以同时与多个对端建立连接
+	links map[string]*p2pLink
+
+	// 本地端口上的tcp监听，被同时进行的连通性检查共用
+	acceptor tcpAcceptor
+
+	// 取消进行中的重连，见resume.go。由mu保护
+	redialCancel context.CancelFunc
+
+	// 保护link、links、P2PConn、redialCancel、Candidates、nat、pairingCodes、pairingTimer，以及relay、ServerConn和PubAddr
+	mu sync.Mutex
+
+	// 是否为控制方，即主动请求与对端建立连接的一方。需要在InitAgent之前设置，之后不再改变
+	Controlling bool
+
+	// 事件的订阅者
+	events eventHub
+
+	// Agent的生命周期，Close时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Agent启动的所有goroutine
+	wg sync.WaitGroup
+}
+
+// 一条p2p连接，以及连接上的帧读写器和流多路复用器。
+// 连接可以迁移到新的路径上，conn、writer和pair随之替换，mux和其上的流保持不变
+type p2pLink struct {
+	conn   net.Conn
+	reader *frame.Reader
+	writer *frame.Writer
+	mux    *Mux
+
+	// 保护conn、pair、old，以及会话的状态
+	mu sync.Mutex
+
+	// 写入帧时持有，保证迁移通知之前的帧都写入旧连接，之后的帧都写入新连接。同时保护writer
+	wmu sync.Mutex
+
+	// 迁移中的旧连接，双方的迁移通知都经过后关闭
+	old net.Conn
+
+	// 旧连接上尚未经过的迁移通知的数量，包括本端发出的和对端发来的
+	draining int32
+
+	// 迁移到的新连接，p2pRead读到对端的迁移通知后从这里取出，改为读取新连接
+	next chan *checkedConn
+
+	// 使用QUIC时Mux的流与QUIC流之间的对应关系，为nil表示所有的流都复用在conn上
+	streams *quicStreams
+
+	// 连接所使用的候选路径
+	pair *CandidatePair
+
+	// 最近一次收到对端数据的时间，UnixNano
+	lastRecv int64
+
+	// 会话id和对端的uuid，用于在新连接上恢复会话，见resume.go
+	session []byte
+	peer    string
+
+	// 会话的状态，由mu保护
+	state sessionState
+
+	// 会话暂停时关闭，恢复后替换为新的通道。由mu保护
+	lost chan struct{}
+
+	// 意外断开的原因，如心跳超时，为nil时以读取错误为准。由mu保护
+	lostCause *CloseReason
+
+	// 恢复会话时交给p2pRead的新连接
+	resumed chan *checkedConn
+
+	// 本端主动关闭时关闭，之后不再恢复会话
+	stop       chan struct{}
+	stopOnce   sync.Once
+	stopReason CloseReason
+
+	// 已发送的可靠帧数量、已被对端确认的数量，以及尚未被确认的可靠帧，由mu保护。sent和replay只在持有wmu时增加
+	sent        uint64
+	peerAcked   uint64
+	replay      []*frame.Frame
+	replayBytes int
+
+	// 重放缓冲区超过了replayLimit，对端确认收到已发送的全部可靠帧之前会话无法恢复。由mu保护
+	overflow bool
+
+	// 已收到的可靠帧数量，只由p2pRead修改
+	received uint64
+
+	// p2pRead要回复对端的帧，由controlLoop写入，见keepalive.go。确认和心跳响应只保留最新的一个，由cmu保护
+	cmu          sync.Mutex
+	pendingAck   *frame.Frame
+	pendingPong  *frame.Frame
+	pendingReply []*frame.Frame
+
+	// 有新的回复排队时写入，容量为1
+	replyReady chan struct{}
+
+	// 连接断开后关闭
+	done chan struct{}
+}
+
+// 在通过了连通性检查的连接上创建p2p连接，沿用检查时的帧读写器，以免丢失已读入缓冲区的帧。
+// 使用QUIC时，ctx被取消或会话结束后不再接受新的QUIC流
+func newP2PLink(ctx context.Context, c *checkedConn, controlling bool, wg *sync.WaitGroup) *p2pLink {
+	l := &p2pLink{
+		conn:    c.conn,
+		reader:  c.reader,
+		writer:  c.writer,
+		pair:    c.pair,
+		next:    make(chan *checkedConn, 1),
+		lost:    make(chan struct{}),
+		resumed: make(chan *checkedConn, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+
+		replyReady: make(chan struct{}, 1),
+	}
+	if c.quic != nil {
+		l.streams = newQUICStreams(ctx, c.quic, wg)
+		l.mux = newMux(l.streams.write, controlling)
+		l.mux.release = l.streams.release
+		l.streams.mux = l.mux
+	} else {
+		l.mux = newMux(l.writeFrame, controlling)
+		l.mux.reply = l.queueReply
+	}
+	l.touch()
+	return l
+}
+
+// 记录收到对端数据的时间
+func (l *p2pLink) touch() {
+	atomic.StoreInt64(&l.lastRecv, time.Now().UnixNano())
+}
+
+// CloseReason p2p连接断开的原因
+type CloseReason struct {
+	// 关闭码
+	Code frame.CloseCode
+
+	// 关闭原因
+	Reason string
+
+	// 是否由对端主动关闭
+	Remote bool
 }
 
 // agent的初始化方法
-func (agent *Agent) InitAgent(port int) {
+func (agent *Agent) InitAgent(port int) error {
 	// 设置本地端口
 	agent.LocalPort = port
 
-	// 设置数据通道
-	ch := make(chan string)
-	agent.ChannelData = ch
+	// 设置生命周期
+	agent.ctx, agent.cancel = context.WithCancel(context.Background())
 
-	// 设置剩余读取的数据长度
-	agent.Remain_cnt = 0
+	// 设置通知通道
+	agent.notifyCh = make(chan *protocol.Message, notifyBuffer)
 
 	// 获取局域网地址
 	agent.PrivAddr, _ = utils.GetPrivAddr()
@@ -56,262 +260,349 @@ func (agent *Agent) InitAgent(port int) {
 	// 获取本机的ipv6地址
 	agent.Ipv6Addr, _ = utils.GetIPV6Addr()
 
-	//读取uuid文件
-	filePath := utils.GetAppPath() + "/uuid.txt"
-
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0666)
+	// 在同一端口上监听UDP，用于udp打洞
+	udp, err := newUDPSocket(port)
 	if err != nil {
-		panic("文件打开失败:" + err.Error())
+		fmt.Println("UDP端口监听失败，只使用tcp:", err.Error())
+	} else {
+		agent.udp = udp
+		agent.wg.Add(1)
+		go func() {
+			defer agent.wg.Done()
+			udp.readLoop()
+		}()
 	}
-	defer file.Close()
-
-	reader := bufio.NewReader(file)
 
-	// 设置uuid
-	agent.UUID, _ = reader.ReadString('\n')
-}
+	// 枚举所有网卡上的地址，作为host候选地址
+	agent.Candidates = agent.gatherCandidates()
 
-func (agent *Agent) Close() {
-	agent.P2PConn.Close()
-	agent.ServerConn.Close()
+	// 读取或生成身份密钥，uuid由其公钥派生
+	keyFile := agent.KeyFile
+	if keyFile == "" {
+		keyFile = utils.GetAppPath() + "/" + identityFile
+	}
+	agent.identity, err = loadIdentity(keyFile)
+	if err != nil {
+		return fmt.Errorf("读取身份密钥失败: %w", err)
+	}
+	agent.UUID = protocol.PeerID(agent.identity.public())
+	fmt.Println("本机的id:", agent.UUID)
+	return nil
 }
 
-// 连接到中继服务器
-/*
-relayAddr:中继服务器的地址
-*/
-func (agent *Agent) ConnectToRelay(relayAddr string) (err error) {
-	var serverConn net.Conn
-	d := net.Dialer{
-		Timeout: 10 * time.Second,
-		LocalAddr: &net.TCPAddr{
-			IP:   net.ParseIP("0.0.0.0"),
-			Port: agent.LocalPort,
-		},
-		Control: Control,
+// Close 断开所有连接，并等待Agent启动的goroutine全部退出
+func (agent *Agent) Close() error {
+	if agent.cancel != nil {
+		agent.cancel()
 	}
-	serverConn, err = d.Dial("tcp", relayAddr)
-	if err != nil {
-		fmt.Println("连接失败:" + err.Error())
-		return err
+	// 持有mu之后，goBackground不会再启动新的goroutine，之后可以安全地等待wg
+	agent.mu.Lock()
+	if agent.pairingTimer != nil {
+		agent.pairingTimer.Stop()
+	}
+	agent.mu.Unlock()
+	agent.CloseP2P(frame.CloseGoingAway, "程序退出")
+	for _, peer := range agent.Peers() {
+		agent.ClosePeer(peer, frame.CloseGoingAway, "程序退出")
+	}
+	var err error
+	agent.mu.Lock()
+	serverConn := agent.ServerConn
+	agent.mu.Unlock()
+	if serverConn != nil {
+		err = serverConn.Close()
+	}
+	if agent.udp != nil {
+		agent.udp.Close()
 	}
-	fmt.Println("请求远程服务器成功...")
-	agent.ServerConn = serverConn
+	agent.wg.Wait()
+	return err
+}
 
-	// 发送ipv6地址、局域网地址和本机的uuid给中继服务器
-	err = agent.SendPrivAddrAndUUID(agent.Ipv6Addr, agent.PrivAddr, agent.UUID)
-	if err != nil {
-		fmt.Println("发送本机信息给中继服务器失败" + err.Error())
-		return err
+// 在wg中启动一个后台任务，Agent未初始化或已关闭时不启动并返回false
+func (agent *Agent) goBackground(f func()) bool {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.ctx == nil || agent.ctx.Err() != nil {
+		return false
 	}
+	agent.wg.Add(1)
+	go func() {
+		defer agent.wg.Done()
+		f()
+	}()
+	return true
+}
 
-	// 获取uuid和本机的公网地址
-	id, localPubAddr := agent.GetUidAndPubAddr()
-	fmt.Println("uuid:", id, " pubAddr:", localPubAddr)
-	// 将uuid保存到本地
-	if agent.UUID == "" {
-		agent.UUID = id
-		utils.SaveUUID(id)
+// Agent关闭后该通道被关闭
+func (agent *Agent) closing() <-chan struct{} {
+	if agent.ctx == nil {
+		return nil
 	}
-	return nil
+	return agent.ctx.Done()
 }
 
-// 等待服务器回传我们的uuid和公网地址
-func (s *Agent) GetUidAndPubAddr() (uuid string, pubAddr string) {
-	buffer := make([]byte, 1024)
-	n, err := s.ServerConn.Read(buffer)
-	if err != nil {
-		panic("读取失败" + err.Error())
+// 单次连接的超时时间
+const dialTimeout = 10 * time.Second
+
+// 使用新的连接作为当前的p2p连接，开始与对端peer的会话session，并启动读取和心跳
+func (s *Agent) startLink(c *checkedConn, peer string, session []byte) *p2pLink {
+	l := newP2PLink(s.ctx, c, s.Controlling, &s.wg)
+	l.peer = peer
+	l.session = session
+	conn := c.conn
+	s.mu.Lock()
+	s.link = l
+	if s.links == nil {
+		s.links = make(map[string]*p2pLink)
 	}
-	data := make(map[string]string)
-	if err := json.Unmarshal(buffer[:n], &data); err != nil {
-		panic("获取uuid失败" + err.Error())
+	s.links[peer] = l
+	s.P2PConn = conn
+	s.mu.Unlock()
+
+	if l.streams != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			l.streams.acceptLoop()
+		}()
 	}
-	return data["uuid"], data["pubAddr"]
+	s.wg.Add(3)
+	go func() {
+		defer s.wg.Done()
+		s.p2pRead(l)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.keepAlive(l)
+	}()
+	go func() {
+		defer s.wg.Done()
+		l.replyLoop()
+	}()
+	s.publish(Event{Type: EventPeerConnected, Peer: peer, RemoteAddr: conn.RemoteAddr().String(), Mux: l.mux, Pair: l.pair})
+	return l
 }
 
-// 将ipv6地址、局域网地址和uuid发送给中继服务器
-func (s *Agent) SendPrivAddrAndUUID(ipv6Addr string, privAddr string, uuid string) error {
-	var data = make(map[string]string)
-	data["method"] = "recvUUIDAndPrivAddr"
-	data["privAddr"] = privAddr + fmt.Sprintf(":%d", s.LocalPort)
-	data["ipv6Addr"] = fmt.Sprintf("[%s]:%d", ipv6Addr, s.LocalPort)
-	data["uuid"] = uuid
-	body, _ := json.Marshal(data)
-	_, err := s.ServerConn.Write(body)
-	if err != nil {
-		return err
-	}
-	return nil
+// 当前的p2p连接，尚未建立时返回nil
+func (s *Agent) currentLink() *p2pLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.link
 }
 
-// 向中继服务器请求目标uuid对应的公网地址
-func (s *Agent) RequestForAddr(uuid string) error {
-	var data = make(map[string]string)
-	data["method"] = "exchangeInfo"
-	data["targetUUID"] = uuid // 目标uuid
-	body, _ := json.Marshal(data)
-	_, err := s.ServerConn.Write(body)
-	if err != nil {
-		return err
-	}
-	return nil
+// 与对端peer之间的p2p连接，没有时返回nil
+func (s *Agent) linkTo(peer string) *p2pLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.links[peer]
 }
 
-// WaitNotify 等待远程服务器发送通知告知我们另一个用户的ipv6地址，公网IP和局域网IP
-func (s *Agent) WaitNotify() (pubAddr string, privAddr string, ipv6Addr string, error string) {
-	buffer := make([]byte, 1024)
-	n, err := s.ServerConn.Read(buffer)
-	if err != nil {
-		panic("从服务器获取用户地址失败" + err.Error())
+// 会话结束后，将p2p连接从links中移除。它是当前连接时，一并清除link和P2PConn
+func (s *Agent) removeLink(l *p2pLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.links[l.peer] == l {
+		delete(s.links, l.peer)
 	}
-	data := make(map[string]string)
-	if err := json.Unmarshal(buffer[:n], &data); err != nil {
-		panic("获取用户信息失败" + err.Error())
+	// 当前连接断开后，WriteFrame、Mux等不指定对端的方法不再作用于它
+	if s.link == l {
+		s.link = nil
+		s.P2PConn = nil
 	}
+}
 
-	return data["address"], data["privAddr"], data["ipv6Addr"], data["error"]
+// Peers 当前与本机建立了p2p连接的对端的uuid，包括会话暂停、等待恢复的对端
+func (s *Agent) Peers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]string, 0, len(s.links))
+	for peer := range s.links {
+		peers = append(peers, peer)
+	}
+	return peers
 }
 
-// DailP2P 连接对方临时的公网地址,并且不停的发送数据
-func (s *Agent) DailP2P(address string) bool {
-	if address == "" {
-		return false
+// WriteFrame 向对端节点发送一个帧
+func (s *Agent) WriteFrame(f *frame.Frame) error {
+	l := s.currentLink()
+	if l == nil {
+		return errors.New("p2p连接尚未建立")
 	}
-	var errCount = 1
-	var conn net.Conn
-	var err error
-	// 获取address的类型，是ipv4的还是ipv6
-	lastIndex := strings.LastIndex(address, ":")
-	var ipType = utils.IsIpv4OrIpv6(address[:lastIndex])
-	var localAddr string
-	if ipType == utils.IPV4 {
-		localAddr = "0.0.0.0"
-	} else {
-		localAddr = s.Ipv6Addr // 因为前面发送给中继服务器记录的就是这个地址，所以通信时也要用这个，用[::]无法保证一样
+	return l.writeFrame(f)
+}
+
+// ReadFrame 从对端节点读取一个帧。
+// p2p连接建立后，帧由Agent内部的goroutine读取并分发，该方法仅适用于尚未启动读取的连接
+func (s *Agent) ReadFrame() (*frame.Frame, error) {
+	l := s.currentLink()
+	if l == nil {
+		return nil, errors.New("p2p连接尚未建立")
 	}
+	return l.reader.ReadFrame()
+}
 
-	for {
-		// 重试四次
-		if errCount > 4 {
-			break
-		}
+// CloseP2P 通知对端关闭原因后，断开p2p连接，并停止进行中的重连
+func (s *Agent) CloseP2P(code frame.CloseCode, reason string) {
+	s.stopRedial()
+	l := s.currentLink()
+	if l == nil {
+		return
+	}
+	l.close(code, reason)
+}
 
-		d := net.Dialer{
-			Timeout: 10 * time.Second,
-			LocalAddr: &net.TCPAddr{
-				IP:   net.ParseIP(localAddr),
-				Port: s.LocalPort,
-			},
-			Control: Control,
-		}
+// ClosePeer 通知对端peer关闭原因后，断开与其之间的p2p连接，不影响与其他对端的连接
+func (s *Agent) ClosePeer(peer string, code frame.CloseCode, reason string) {
+	l := s.linkTo(peer)
+	if l == nil {
+		return
+	}
+	l.close(code, reason)
+}
 
-		// 如果是ipv6地址
-		if ipType == utils.IPV6 {
-			conn, err = d.Dial("tcp6", address)
-		} else if ipType == utils.IPV4 {
-			// 如果是ipv4地址
-			conn, err = d.Dial("tcp", address)
-		} else {
-			fmt.Println("地址无效")
-			return false
-		}
-		if err != nil {
-			fmt.Println("请求第", errCount, "次地址失败,用户地址:", address, "error:", err.Error())
-			errCount++
-			continue
-		}
-		break
+// 通知对端关闭原因后，断开连接
+func (l *p2pLink) close(code frame.CloseCode, reason string) {
+	select {
+	case <-l.done:
+		return
+	default:
 	}
-	if errCount > 3 {
-		fmt.Println("客户端连接失败")
-		return false
+	l.stopWith(CloseReason{Code: code, Reason: reason})
+	if l.isSuspended() {
+		// 会话暂停时没有可用的连接，直接结束会话
+		l.currentConn().Close()
+		return
 	}
-	s.P2PConn = conn
-	go s.P2PRead()
-	return true
+	if err := l.writeFrame(frame.NewClose(code, reason)); err != nil {
+		fmt.Println("发送关闭帧失败", err.Error())
+	}
+	l.currentConn().Close()
 }
 
-// P2PRead 读取 P2P 节点的数据
-func (s *Agent) P2PRead() {
-	// 用于拼接分片，组成完整的报文
-	var content string
+// Mux 当前p2p连接上的流多路复用器
+func (s *Agent) Mux() *Mux {
+	l := s.currentLink()
+	if l == nil {
+		return nil
+	}
+	return l.mux
+}
 
-	// 用于存储读到的流数据
-	var buffer []byte
+// OpenStream 在当前的p2p连接上打开一个流
+func (s *Agent) OpenStream(ctx context.Context, label string) (*Stream, error) {
+	mux := s.Mux()
+	if mux == nil {
+		return nil, errors.New("p2p连接尚未建立")
+	}
+	return mux.Open(ctx, label)
+}
 
-	// 判断是否需要读更多数据
-	var needReadMore bool
+// 读取 P2P 节点的数据，直到连接断开
+func (s *Agent) p2pRead(l *p2pLink) {
+	reader := l.reader
+	mux := l.mux
+	remoteAddr := l.conn.RemoteAddr().String()
+	closeReason := CloseReason{Code: frame.CloseConnLost}
+	defer func() {
+		l.closeConns()
+		if l.streams != nil {
+			// 此后不再启动读取QUIC流的goroutine，wg可以安全地等待
+			l.streams.close()
+		}
+		s.removeLink(l)
+		mux.closeAll(ErrMuxClosed)
+		// 将连接中断的信息发布出去。先于done发布，等待done的一方之后发布的事件不会排在它之前
+		s.publish(Event{Type: EventPeerDisconnected, Peer: l.peer, RemoteAddr: remoteAddr, Cause: closeReason})
+		close(l.done)
+	}()
 
 	for {
-		// 如果buffer等于空，说明没有待处理的数据，则先获取到流数据；否则，就先处理buffer中的数据，不再额外获取
-		if len(buffer) == 0 || needReadMore {
-			temp_buffer := make([]byte, 1024*1024)
-			cnt, err := s.P2PConn.Read(temp_buffer)
-			if err != nil {
-				if err.Error() == "EOF" {
-					fmt.Println("连接中断")
-					s.P2PConn.Close()
-
-					// 通过隧道，将连接中断的信息发送出去
-					s.ChannelData <- err.Error()
-					break
-				}
+		f, err := reader.ReadFrame()
+		if err != nil {
+			// 无论是连接中断还是包头解析失败，字节流都已无法继续使用，直接断开
+			if err == io.EOF {
+				fmt.Println("连接中断")
+			} else {
 				fmt.Println("读取失败", err.Error())
-				continue
 			}
-			buffer = append(buffer, temp_buffer[:cnt]...)
-			needReadMore = false
+			closeReason.Reason = err.Error()
+			if errors.Is(err, frame.ErrFrameTooLarge) || errors.Is(err, frame.ErrUnsupportedVersion) {
+				closeReason.Code = frame.CloseProtocolError
+				s.publish(Event{Type: EventError, Peer: l.peer, RemoteAddr: remoteAddr, Err: err})
+				return
+			}
+			// 连接意外断开时暂停会话，在新连接上恢复后继续读取
+			next := s.suspend(l, remoteAddr, &closeReason)
+			if next == nil {
+				return
+			}
+			reader = next.reader
+			remoteAddr = next.conn.RemoteAddr().String()
+			continue
 		}
+		l.touch()
 
-		// 如果没读到数据，就不往下执行，直到read到数据为止
-		if len(buffer) == 0 {
-			continue
+		// 可靠帧按收到的顺序计数，每收到ackEvery个确认一次
+		if f.Type.IsReliable() && l.streams == nil {
+			if n := atomic.AddUint64(&l.received, 1); n%ackEvery == 0 {
+				l.queueReply(frame.NewAck(n))
+			}
 		}
 
-		// 根据remain_cnt,判断目前将要读到的内容是包头，还是包的内容
-		//等于0，说明之前的包已经读完，将要读的是一个新的包
-		if s.Remain_cnt == 0 {
-			// 读取前18个字节，获取包头
+		if f.Type.IsStream() {
+			mux.handleFrame(f)
+			continue
+		}
 
-			// 可能存在的情况是包头也不完整，也就是buffer不够18个字节，则暂不往下处理，继续read数据
-			if len(buffer) < 18 {
-				needReadMore = true
+		switch f.Type {
+		case frame.TypeData:
+			utils.LogRecv(len(f.Payload), "对端节点")
+
+			// 将读取到的内容发布出去
+			s.publish(Event{Type: EventMessage, Peer: l.peer, RemoteAddr: remoteAddr, Payload: f.Payload, Flags: f.Flags})
+		case frame.TypePing:
+			// 原样回复心跳
+			l.queueReply(&frame.Frame{Type: frame.TypePong, Payload: f.Payload})
+		case frame.TypePong:
+			// 收到心跳响应，lastRecv已更新，无需额外处理
+		case frame.TypeAck:
+			n, err := frame.ParseAck(f)
+			if err != nil {
+				fmt.Println("确认帧解析失败", err.Error())
 				continue
 			}
-
-			data_head := string(buffer[:18])
-
-			// 解析出长度
-			s.Remain_cnt = utils.ResolveDataHead(data_head)
-
-			// drop掉buffer的前18个字节，因为已读
-			buffer = buffer[18:]
-		} else {
-			// 大于0.说明接下来要读的都是包的分片
-
-			// 获取当前缓冲区的长度
-			buffer_len := len(buffer)
-
-			// 如果缓冲区长度小于需要读的.那就不读，继续接受流数据
-			if buffer_len < s.Remain_cnt {
-				needReadMore = true
+			l.onAck(n)
+		case frame.TypeClose:
+			code, reason, err := frame.ParseClose(f)
+			if err != nil {
+				code, reason = frame.CloseProtocolError, err.Error()
+			}
+			fmt.Println("对端关闭了连接:", code, reason)
+			closeReason = CloseReason{Code: code, Reason: reason, Remote: true}
+			return
+		case frame.TypeMigrate:
+			// 对端在旧连接上发出的帧已全部读完，之后改为读取新连接
+			next, err := s.awaitMigration(l)
+			if err != nil {
+				fmt.Println("迁移p2p连接失败:", err.Error())
+				closeReason.Reason = err.Error()
+				return
+			}
+			reader = next.reader
+			remoteAddr = next.conn.RemoteAddr().String()
+			l.drained()
+		case frame.TypeError:
+			code, message, err := frame.ParseError(f)
+			if err != nil {
+				fmt.Println("错误帧解析失败", err.Error())
 				continue
-			} else {
-				// 如果缓冲区长度大于等于需要读的,按需读取
-				content = string(buffer[:s.Remain_cnt])
-
-				// 将已读的部分清除掉
-				buffer = buffer[s.Remain_cnt:]
-
-				fmt.Printf(">读取到%d个字节,对端节点发来内容:%s\n", s.Remain_cnt, content)
-
-				// 将读取到的内容，存入管道中
-				s.ChannelData <- content
-
-				// 将remain_cnt 归零
-				s.Remain_cnt = 0
 			}
+			fmt.Println("对端报告错误:", code, message)
+			s.publish(Event{Type: EventError, Peer: l.peer, RemoteAddr: remoteAddr, Err: &PeerError{Code: code, Message: message}})
+		default:
+			fmt.Println("忽略未知类型的帧:", f.Type)
+			l.queueReply(frame.NewError(frame.ErrorUnknownType, f.Type.String()))
 		}
 	}
 }
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGoBackground(t *testing.T) {
+	var uninit Agent
+	if uninit.goBackground(func() {}) {
+		t.Fatal("未初始化的Agent不应启动后台任务")
+	}
+
+	s := &Agent{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	if !s.goBackground(func() {
+		<-s.ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		close(exited)
+	}) {
+		t.Fatal("后台任务没有启动")
+	}
+
+	// 配对码到期前关闭，定时器不再触发
+	s.mu.Lock()
+	fired := make(chan struct{})
+	s.pairingTimer = time.AfterFunc(20*time.Millisecond, func() { close(fired) })
+	s.mu.Unlock()
+
+	s.Close()
+	select {
+	case <-exited:
+	default:
+		t.Fatal("Close没有等待后台任务退出")
+	}
+	if s.goBackground(func() {}) {
+		t.Fatal("Agent关闭后不应再启动后台任务")
+	}
+	select {
+	case <-fired:
+		t.Fatal("Agent关闭后配对定时器仍然触发")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRelayBeforeInit(t *testing.T) {
+	var s Agent
+	if err := s.ConnectToRelay(context.Background(), "127.0.0.1:1"); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("InitAgent之前连接中继服务器返回%v", err)
+	}
+	if _, err := s.RequestForAddr(context.Background(), "peer"); !errors.Is(err, ErrNotControlling) {
+		t.Fatalf("被控方请求对端的地址返回%v", err)
+	}
+	if _, err := s.RequestForPairing(context.Background(), "peer", "123456"); !errors.Is(err, ErrNotControlling) {
+		t.Fatalf("被控方请求配对返回%v", err)
+	}
+	s.Controlling = true
+	if _, err := s.RequestForAddr(context.Background(), "peer"); !errors.Is(err, ErrRelayClosed) {
+		t.Fatalf("尚未连接中继服务器时返回%v", err)
+	}
+}
+
+func TestRemoveLink(t *testing.T) {
+	a, _ := pipeLink(t)
+	a.peer = "a"
+	b, _ := pipeLink(t)
+	b.peer = "b"
+	s := &Agent{links: map[string]*p2pLink{"a": a, "b": b}, link: b, P2PConn: b.conn}
+
+	s.removeLink(a)
+	if s.currentLink() != b || s.linkTo("a") != nil {
+		t.Fatal("移除其他连接时不应影响当前连接")
+	}
+	s.removeLink(b)
+	if s.currentLink() != nil || s.P2PConn != nil || s.Mux() != nil {
+		t.Fatal("当前连接被移除后仍被引用")
+	}
+	if err := s.WriteFrame(dataFrame(0)); err == nil {
+		t.Fatal("当前连接被移除后WriteFrame应返回错误")
+	}
+}
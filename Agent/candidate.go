@@ -0,0 +1,195 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"P2PAgent/utils"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// 同类型候选地址之间的本地偏好，越大越优先
+const (
+	// 默认路由所在网卡的ipv4地址
+	prefDefaultV4 = 65535
+
+	// 其他网卡的ipv4地址
+	prefOtherV4 = 65000
+
+	// 默认路由所在网卡的ipv6地址
+	prefDefaultV6 = 50000
+
+	// 其他网卡的ipv6地址
+	prefOtherV6 = 45000
+
+	// 虚拟网卡(docker网桥、vpn等)上的地址，在上述偏好的基础上降低
+	prefVirtualPenalty = 30000
+)
+
+// 枚举本机所有可用的地址，作为host候选地址，tcp和udp的端口均为LocalPort
+func (s *Agent) gatherCandidates() []protocol.Candidate {
+	addrs, err := utils.GetHostAddrs()
+	if err != nil {
+		fmt.Println("枚举网卡地址失败:", err.Error())
+	}
+	var cands []protocol.Candidate
+	for _, addr := range addrs {
+		var pref int
+		switch {
+		case addr.IP.To4() != nil && addr.IP.String() == s.PrivAddr:
+			pref = prefDefaultV4
+		case addr.IP.To4() != nil:
+			pref = prefOtherV4
+		case addr.IP.String() == s.Ipv6Addr:
+			pref = prefDefaultV6
+		default:
+			pref = prefOtherV6
+		}
+		if addr.Virtual {
+			pref -= prefVirtualPenalty
+		}
+		cand := protocol.Candidate{
+			Type:     protocol.CandidateHost,
+			Network:  protocol.NetworkOf(addr.IP),
+			Address:  net.JoinHostPort(addr.IP.String(), strconv.Itoa(s.LocalPort)),
+			Priority: protocol.CandidatePriority(protocol.CandidateHost, uint16(pref)),
+		}
+		cands = append(cands, cand)
+
+		// UDP端口可用时，同一地址同时作为UDP候选地址
+		if s.udp != nil {
+			cand.Network = protocol.UDPNetworkOf(addr.IP)
+			cands = append(cands, cand)
+		}
+	}
+	protocol.SortCandidates(cands)
+	return cands
+}
+
+// 本机当前的全部候选地址
+func (s *Agent) localCandidates() []protocol.Candidate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.Candidate{}, s.Candidates...)
+}
+
+// 本机的host候选地址
+func (s *Agent) hostCandidates() []protocol.Candidate {
+	var hosts []protocol.Candidate
+	for _, c := range s.localCandidates() {
+		if c.Type == protocol.CandidateHost {
+			hosts = append(hosts, c)
+		}
+	}
+	return hosts
+}
+
+// CandidatePair 一对本机和对端的候选地址，对应一条可能的p2p路径
+type CandidatePair struct {
+	Local  protocol.Candidate
+	Remote protocol.Candidate
+
+	// 路径的优先级，越大越优先
+	Priority uint64
+}
+
+func (p *CandidatePair) String() string {
+	return fmt.Sprintf("%s %s %s -> %s %s", p.Remote.Network, p.Local.Type, p.Local.Address, p.Remote.Type, p.Remote.Address)
+}
+
+// 用于去除重复路径的键。所有UDP路径共用同一个UDP端口，只需按对端地址区分
+func (p *CandidatePair) key() (string, error) {
+	if p.Remote.IsUDP() {
+		return p.Remote.Network + "->" + p.Remote.Address, nil
+	}
+	bind, err := p.bindAddr()
+	if err != nil {
+		return "", err
+	}
+	return bind.String() + "->" + p.Remote.Address, nil
+}
+
+// 本机连接该路径时绑定的地址。srflx候选地址不在本机网卡上，绑定同一网络的任意地址，由系统按路由选择
+func (p *CandidatePair) bindAddr() (*net.TCPAddr, error) {
+	addr, err := net.ResolveTCPAddr(p.Local.Network, p.Local.Address)
+	if err != nil {
+		return nil, err
+	}
+	if p.Local.Type == protocol.CandidateHost {
+		return addr, nil
+	}
+	if p.Local.Network == "tcp6" {
+		return &net.TCPAddr{IP: net.IPv6unspecified, Port: addr.Port}, nil
+	}
+	return &net.TCPAddr{IP: net.IPv4zero, Port: addr.Port}, nil
+}
+
+// 计算路径的优先级，与ICE相同：2^32*MIN(G,D) + 2*MAX(G,D) + (G>D?1:0)，
+// 其中G为控制方候选地址的优先级，D为被控制方的。双方算出的优先级一致，因此会以相同的顺序尝试
+func pairPriority(local, remote uint32, controlling bool) uint64 {
+	g, d := uint64(local), uint64(remote)
+	if !controlling {
+		g, d = d, g
+	}
+	min, max := g, d
+	if min > max {
+		min, max = max, min
+	}
+	var tie uint64
+	if g > d {
+		tie = 1
+	}
+	return min<<32 + 2*max + tie
+}
+
+// 将本机和对端的候选地址按网络类型两两配对，按优先级从高到低排列。
+// 实际收发地址都相同的路径只保留优先级最高的一条
+func (s *Agent) candidatePairs(remotes []protocol.Candidate) []*CandidatePair {
+	var pairs []*CandidatePair
+	for _, local := range s.localCandidates() {
+		for _, remote := range remotes {
+			if local.Network != remote.Network {
+				continue
+			}
+			pairs = append(pairs, &CandidatePair{
+				Local:    local,
+				Remote:   remote,
+				Priority: pairPriority(local.Priority, remote.Priority, s.Controlling),
+			})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Priority > pairs[j].Priority
+	})
+
+	seen := make(map[string]bool)
+	pruned := pairs[:0]
+	for _, p := range pairs {
+		key, err := p.key()
+		if err != nil {
+			continue
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pruned = append(pruned, p)
+	}
+	return pruned
+}
+
+// 按照候选路径连接对端，只尝试一次
+func (s *Agent) dialPair(ctx context.Context, p *CandidatePair) (net.Conn, error) {
+	bind, err := p.bindAddr()
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{
+		Timeout:   dialTimeout,
+		LocalAddr: bind,
+		Control:   Control,
+	}
+	return d.DialContext(ctx, p.Remote.Network, p.Remote.Address)
+}
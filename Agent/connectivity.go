@@ -0,0 +1,626 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+/*
+连通性检查：同时尝试所有候选路径，选出最先连通的一条作为p2p连接。
+
+1. 在LocalPort上监听，对端的连接请求先到达时直接接受。
+2. 等待中继服务器指定的PunchDelay，使双方在同一时刻开始打洞。
+   候选路径按优先级排列，第一条在该时刻开始尝试，之后每隔checkInterval开始尝试下一条。
+   每条路径每隔retryInterval重新连接一次，直到成功或整体超时。双方的重试时刻都以打洞时刻为基准，
+   并带有少许随机抖动，使双方的SYN有更多机会在途中相遇，完成tcp同时打开。
+3. 连接建立后双方各发送一个TypeCheck帧，包体为自己的uuid，收到对端的uuid与预期一致即通过检查。
+4. 控制方选中第一条通过检查的连接，发送TypeNominate帧；被控制方以收到TypeNominate的连接为准。
+5. 选出连接后，取消其余所有的尝试，关闭其余的连接，然后在选出的连接上进行TLS握手，见secure.go，
+   再由被控制方决定是否授权对端，见access.go。最后双方协商恢复暂停中的会话或开始新的会话，见resume.go。
+6. 打洞时刻之后relayDelay仍未选出连接时，同时尝试通过中继服务器转发，见turn.go。
+7. 任意一方为对称型NAT时不尝试tcp打洞，见nat.go；对端为对称型NAT时，udp还会尝试预测的端口，见predict.go。
+*/
+
+// 相邻两条候选路径开始尝试的时间间隔
+const checkInterval = 200 * time.Millisecond
+
+// 同一条路径两次连接之间的时间间隔
+const retryInterval = 500 * time.Millisecond
+
+// 每次连接时刻的随机抖动范围
+const retryJitter = 100 * time.Millisecond
+
+// 连通性检查的超时时间，包括交换TypeCheck帧和被控制方等待TypeNominate帧
+const checkTimeout = 5 * time.Second
+
+// 与对端建立p2p连接的总超时时间
+const connectTimeout = 30 * time.Second
+
+var ErrNoPath = errors.New("所有候选路径均连接失败")
+
+// 一条通过了连通性检查的连接
+type checkedConn struct {
+	conn   net.Conn
+	reader *frame.Reader
+	writer *frame.Writer
+
+	// 连接所使用的候选路径
+	pair *CandidatePair
+
+	// 控制方选中该连接的方法，为nil时发送TypeNominate帧。UDP路径在选中时才建立kcp会话或QUIC连接
+	nominate func(c *checkedConn) error
+
+	// 使用QUIC时的QUIC连接，conn为其上的控制流
+	quic quic.Connection
+}
+
+// 控制方选中该连接
+func (c *checkedConn) nominateConn() error {
+	if c.nominate != nil {
+		return c.nominate(c)
+	}
+	return c.writer.WriteFrame(&frame.Frame{Type: frame.TypeNominate})
+}
+
+// 关闭未被选中的连接
+func (c *checkedConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// 从缓冲读取器继续读取的连接，用于连接上的协议切换时接着读取已读入缓冲区的数据
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// TransportPolicy p2p连接的传输方式的选择策略。
+// 双方应使用相同的策略，否则双方开始打洞的时刻会错开
+type TransportPolicy int
+
+const (
+	// 优先使用tcp，tcp的候选路径开始尝试fallbackDelay之后，udp的候选路径才开始尝试
+	TransportPreferTCP TransportPolicy = iota
+
+	// 优先使用udp，udp的候选路径开始尝试fallbackDelay之后，tcp的候选路径才开始尝试
+	TransportPreferUDP
+
+	// 只使用tcp
+	TransportTCPOnly
+
+	// 只使用udp
+	TransportUDPOnly
+)
+
+// 非优先的传输方式比优先的传输方式晚开始尝试的时间
+const fallbackDelay = 3 * time.Second
+
+// DailP2P 同时尝试与对端的所有候选地址建立连接，选出最先连通的一条作为p2p连接，返回其候选路径。
+// 直连都失败时通过中继服务器转发，此时返回的路径Relayed()为true，并在后台继续尝试直连，成功后迁移过去
+// 被控制方设置了Access时，拒绝未被授权、也不在配对的对端，返回ErrUnauthorized
+// 与对端之间有暂停中的会话时，在新连接上恢复该会话，见resume.go
+// 被控制方可以依次与多个对端建立连接，与其他对端之间的连接不受影响；与同一对端开始新的会话时，旧的连接被关闭
+func (s *Agent) DailP2P(ctx context.Context, peer *protocol.PeerInfo) (*CandidatePair, error) {
+	if !s.Controlling && s.Access != nil && !s.Access.admits(peer) {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, peer.UUID)
+	}
+	// 新的连接请求取代进行中的重连
+	s.stopRedial()
+	return s.dial(ctx, peer)
+}
+
+// 与对端建立连接，恢复暂停中的会话，或开始新的会话
+func (s *Agent) dial(ctx context.Context, peer *protocol.PeerInfo) (*CandidatePair, error) {
+	// 恢复的会话仍复用在同一条连接上，因此不使用QUIC
+	useQUIC := s.QUIC && s.suspendedLink(peer.UUID) == nil
+	winner, err := s.checkPaths(ctx, peer, useQUIC)
+	if err != nil {
+		return nil, err
+	}
+	l, peerReceived, session, err := s.negotiateSession(ctx, winner, peer.UUID)
+	if err != nil {
+		winner.close()
+		return nil, err
+	}
+	if l != nil {
+		if !l.resume(winner, peerReceived) {
+			winner.close()
+			return nil, errors.New("会话已结束，无法恢复")
+		}
+		s.mu.Lock()
+		if s.link == l {
+			s.P2PConn = winner.conn
+		}
+		s.mu.Unlock()
+	} else {
+		// 与同一对端之间的旧会话不会再恢复，先结束它，使其断开事件先于新连接的事件发布
+		if old := s.linkTo(peer.UUID); old != nil {
+			old.close(frame.CloseNormal, "开始新的会话")
+			<-old.done
+		}
+		fmt.Println("p2p连接成功:", winner.pair)
+		l = s.startLink(winner, peer.UUID, session)
+	}
+	if winner.pair.Relayed() {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.upgrade(l, peer)
+		}()
+	}
+	return winner.pair, nil
+}
+
+// 同时尝试所有候选路径，返回选出的连接。useQUIC决定控制方选中UDP路径时是否使用QUIC
+func (s *Agent) checkPaths(ctx context.Context, peer *protocol.PeerInfo, useQUIC bool) (*checkedConn, error) {
+	var tcpPairs, udpPairs []*CandidatePair
+	skipPunch := s.skipTCPPunch(peer)
+	if skipPunch && s.Transport != TransportUDPOnly {
+		fmt.Println("本机或对端为对称型NAT，跳过tcp打洞")
+	}
+	for _, p := range s.candidatePairs(peer.Candidates) {
+		if !p.Remote.IsUDP() {
+			if s.Transport != TransportUDPOnly && !(skipPunch && p.punched()) {
+				tcpPairs = append(tcpPairs, p)
+			}
+		} else if s.udp != nil && s.Transport != TransportTCPOnly {
+			udpPairs = append(udpPairs, p)
+		}
+	}
+	// 对端为对称型NAT时，udp还要尝试预测的端口
+	var predicted []*net.UDPAddr
+	if s.Transport != TransportTCPOnly {
+		predicted = s.predictedAddrs(peer)
+	}
+	useUDP := len(udpPairs) > 0 || len(predicted) > 0
+	useRelay := peer.Relay != nil && !s.DisableRelay && s.relayAddr != ""
+	if len(tcpPairs) == 0 && !useUDP && !useRelay {
+		return nil, errors.New("没有可用的候选地址")
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	results := make(chan *checkedConn)
+	var wg sync.WaitGroup
+
+	// 从打洞时刻起开始尝试，非优先的传输方式再晚fallbackDelay开始
+	punchAt := time.Now().Add(time.Duration(peer.PunchDelay) * time.Millisecond)
+	tcpAt, udpAt := punchAt, punchAt
+	if len(tcpPairs) > 0 && useUDP {
+		if s.Transport == TransportPreferUDP {
+			tcpAt = punchAt.Add(fallbackDelay)
+		} else {
+			udpAt = punchAt.Add(fallbackDelay)
+		}
+	}
+
+	if len(tcpPairs) > 0 {
+		// 接受对端的连接请求
+		if err := s.acceptChecks(checkCtx, peer, results, &wg); err != nil {
+			fmt.Println("监听本地端口失败，只进行主动连接:", err.Error())
+		}
+
+		// 错开时间，依次开始尝试每条候选路径
+		for i, p := range tcpPairs {
+			wg.Add(1)
+			go func(start time.Time, p *CandidatePair) {
+				defer wg.Done()
+				s.checkPair(checkCtx, start, p, peer, results)
+			}(tcpAt.Add(time.Duration(i)*checkInterval), p)
+		}
+	}
+
+	if useUDP {
+		checker := s.newUDPChecker(checkCtx, peer, udpPairs, results, &wg)
+		checker.quic = useQUIC
+		s.udp.setChecker(checker)
+		defer s.udp.clearChecker(checker)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checker.run()
+		}()
+		for i, p := range udpPairs {
+			wg.Add(1)
+			go func(start time.Time, p *CandidatePair) {
+				defer wg.Done()
+				checker.checkPair(start, p)
+			}(udpAt.Add(time.Duration(i)*checkInterval), p)
+		}
+		if len(predicted) > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				checker.spray(udpAt, predicted)
+			}()
+		}
+	}
+
+	if useRelay {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.checkRelay(checkCtx, punchAt.Add(relayDelay), peer, results)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// 选出第一条可用的连接，并关闭其余的连接
+	var winner *checkedConn
+	for c := range results {
+		if winner != nil {
+			c.close()
+			continue
+		}
+		if s.Controlling {
+			if err := c.nominateConn(); err != nil {
+				fmt.Println("选中连接失败:", c.pair, "error:", err.Error())
+				c.close()
+				continue
+			}
+		}
+		winner = c
+		cancel()
+	}
+	if winner == nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		fmt.Println("客户端连接失败")
+		return nil, ErrNoPath
+	}
+	if err := s.secure(ctx, winner, peer.UUID); err != nil {
+		winner.close()
+		return nil, err
+	}
+	if err := s.authorize(ctx, winner, peer.UUID); err != nil {
+		winner.close()
+		return nil, err
+	}
+	return winner, nil
+}
+
+// 从start开始反复尝试一条候选路径，直到通过连通性检查或ctx被取消
+func (s *Agent) checkPair(ctx context.Context, start time.Time, p *CandidatePair, peer *protocol.PeerInfo, results chan<- *checkedConn) {
+	next := start
+	for i := 1; ; i++ {
+		if !sleepUntil(ctx, next.Add(jitter(retryJitter))) {
+			return
+		}
+		next = next.Add(retryInterval)
+
+		conn, err := s.dialPair(ctx, p)
+		if err == nil {
+			var c *checkedConn
+			c, err = s.handshake(ctx, conn, peer.UUID)
+			if err == nil {
+				c.pair = p
+				deliver(ctx, results, c)
+				return
+			}
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("第", i, "次连接失败:", p, "error:", err.Error())
+
+		// 连接耗时超过了重试间隔时，从下一个尚未错过的时刻继续
+		for now := time.Now(); next.Before(now); {
+			next = next.Add(retryInterval)
+		}
+	}
+}
+
+// 等待到t时刻，ctx被取消时返回false
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// 产生随机抖动的随机数发生器。以当前时间为种子，避免双方产生相同的抖动序列
+var (
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+// [-d, d)之间的随机时长
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(2*d))) - d
+}
+
+// 本地端口上的tcp监听，被同时进行的多个连通性检查(与不同对端的DailP2P、后台的升级)共用。
+// 接受的连接先读取对端的TypeCheck帧，再按其中的uuid交给与该对端的检查
+type tcpAcceptor struct {
+	mu sync.Mutex
+	ln net.Listener
+
+	// 正在等待对端连接的检查，键为对端的uuid。没有检查时关闭监听
+	checks map[string]*tcpCheck
+}
+
+// 一次DailP2P中等待对端连接的tcp连通性检查
+type tcpCheck struct {
+	ctx     context.Context
+	peer    *protocol.PeerInfo
+	results chan<- *checkedConn
+	wg      *sync.WaitGroup
+}
+
+// 接受对端的连接请求，并进行连通性检查，直到ctx被取消。与同一对端的新的检查取代之前的检查
+func (s *Agent) acceptChecks(ctx context.Context, peer *protocol.PeerInfo, results chan<- *checkedConn, wg *sync.WaitGroup) error {
+	a := &s.acceptor
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ln == nil {
+		lc := net.ListenConfig{Control: Control}
+		ln, err := lc.Listen(s.ctx, "tcp", fmt.Sprintf(":%d", s.LocalPort))
+		if err != nil {
+			return err
+		}
+		a.ln = ln
+		a.checks = make(map[string]*tcpCheck)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.acceptLoop(ln)
+		}()
+	}
+	check := &tcpCheck{ctx: ctx, peer: peer, results: results, wg: wg}
+	a.checks[peer.UUID] = check
+
+	// 检查结束前wg不会归零，分发给该检查的连接可以安全地加入wg
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.checks[peer.UUID] == check {
+			delete(a.checks, peer.UUID)
+		}
+		if len(a.checks) == 0 && a.ln != nil {
+			a.ln.Close()
+			a.ln = nil
+		}
+	}()
+	return nil
+}
+
+// 接受连接并分发，直到监听被关闭或Agent关闭
+func (s *Agent) acceptLoop(ln net.Listener) {
+	stop := context.AfterFunc(s.ctx, func() { ln.Close() })
+	defer stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Println("接受对端连接失败:", err.Error())
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.dispatchCheck(conn)
+		}()
+	}
+}
+
+// 读取对端的TypeCheck帧，将连接交给与该对端的连通性检查
+func (s *Agent) dispatchCheck(conn net.Conn) {
+	c := &checkedConn{conn: conn, reader: frame.NewReader(conn), writer: frame.NewWriter(conn)}
+	stop := interruptOnDone(s.ctx, conn)
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+	peerUUID, err := c.readCheck()
+	stop()
+	if err != nil {
+		fmt.Println("对端连接未通过检查:", conn.RemoteAddr().String(), "error:", err.Error())
+		conn.Close()
+		return
+	}
+
+	a := &s.acceptor
+	a.mu.Lock()
+	check := a.checks[peerUUID]
+	if check != nil {
+		check.wg.Add(1)
+	}
+	a.mu.Unlock()
+	if check == nil {
+		fmt.Println("没有与该对端进行中的连通性检查:", peerUUID, conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	defer check.wg.Done()
+
+	stop = interruptOnDone(check.ctx, conn)
+	err = c.answerCheck(s.UUID, s.Controlling)
+	stop()
+	if err != nil {
+		if check.ctx.Err() == nil {
+			fmt.Println("对端连接未通过检查:", conn.RemoteAddr().String(), "error:", err.Error())
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c.pair = s.inboundPair(conn.LocalAddr(), conn.RemoteAddr(), check.peer.Candidates)
+	deliver(check.ctx, check.results, c)
+}
+
+// 将通过检查的连接交给DailP2P，ctx被取消时关闭连接
+func deliver(ctx context.Context, results chan<- *checkedConn, c *checkedConn) {
+	select {
+	case results <- c:
+	case <-ctx.Done():
+		c.close()
+	}
+}
+
+// 与对端交换TypeCheck帧，确认连接的另一端是预期的节点。被控制方还需等待控制方选中该连接
+func (s *Agent) handshake(ctx context.Context, conn net.Conn, peerUUID string) (*checkedConn, error) {
+	stop := interruptOnDone(ctx, conn)
+	conn.SetDeadline(time.Now().Add(checkTimeout))
+	c := &checkedConn{conn: conn, reader: frame.NewReader(conn), writer: frame.NewWriter(conn)}
+	err := c.check(s.UUID, peerUUID, s.Controlling)
+	stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// 主动发起的连接：发送本机的uuid，确认对端的uuid为peerUUID，被控制方再等待控制方选中
+func (c *checkedConn) check(uuid, peerUUID string, controlling bool) error {
+	if err := c.writer.WriteFrame(&frame.Frame{Type: frame.TypeCheck, Payload: []byte(uuid)}); err != nil {
+		return err
+	}
+	id, err := c.readCheck()
+	if err != nil {
+		return err
+	}
+	if id != peerUUID {
+		return fmt.Errorf("对端的uuid不一致:%s", id)
+	}
+	if controlling {
+		return nil
+	}
+	return c.waitNominate()
+}
+
+// 接受的连接：对端的uuid已由readCheck读出，回复本机的uuid，被控制方再等待控制方选中
+func (c *checkedConn) answerCheck(uuid string, controlling bool) error {
+	if err := c.writer.WriteFrame(&frame.Frame{Type: frame.TypeCheck, Payload: []byte(uuid)}); err != nil {
+		return err
+	}
+	if controlling {
+		return nil
+	}
+	return c.waitNominate()
+}
+
+// 读取对端的TypeCheck帧，返回其中的uuid
+func (c *checkedConn) readCheck() (string, error) {
+	f, err := c.reader.ReadFrame()
+	if err != nil {
+		return "", err
+	}
+	if f.Type != frame.TypeCheck {
+		return "", fmt.Errorf("预期收到%s帧，实际收到%s帧", frame.TypeCheck, f.Type)
+	}
+	return string(f.Payload), nil
+}
+
+// 等待控制方选中该连接，控制方选中其他连接时会关闭该连接
+func (c *checkedConn) waitNominate() error {
+	f, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if f.Type != frame.TypeNominate {
+		return fmt.Errorf("预期收到%s帧，实际收到%s帧", frame.TypeNominate, f.Type)
+	}
+	return nil
+}
+
+// ctx被取消时中断conn上阻塞的读写。返回的函数用于停止监视，返回后不会再修改conn的超时时间
+func interruptOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// 对端连接进来时所使用的候选路径。对端的地址不在候选地址列表中时，作为prflx候选地址
+func (s *Agent) inboundPair(localAddr, remoteAddr net.Addr, remotes []protocol.Candidate) *CandidatePair {
+	var localIP net.IP
+	var network string
+	switch addr := remoteAddr.(type) {
+	case *net.TCPAddr:
+		network = protocol.NetworkOf(addr.IP)
+		localIP = localAddr.(*net.TCPAddr).IP
+	case *net.UDPAddr:
+		network = protocol.UDPNetworkOf(addr.IP)
+		localIP = localAddr.(*net.UDPAddr).IP
+	}
+
+	local := protocol.Candidate{
+		Type:     protocol.CandidateHost,
+		Network:  network,
+		Address:  localAddr.String(),
+		Priority: protocol.CandidatePriority(protocol.CandidateHost, 0),
+	}
+	for _, c := range s.localCandidates() {
+		if c.Type != protocol.CandidateHost || c.Network != network {
+			continue
+		}
+		// UDP端口监听在任意地址上，此时取同一网络类型中优先级最高的host候选地址
+		if c.Address == localAddr.String() || localIP.IsUnspecified() {
+			local = c
+			break
+		}
+	}
+
+	remote := protocol.Candidate{
+		Type:     protocol.CandidatePrflx,
+		Network:  network,
+		Address:  remoteAddr.String(),
+		Priority: protocol.CandidatePriority(protocol.CandidatePrflx, 65535),
+	}
+	for _, c := range remotes {
+		if c.Network == network && c.Address == remoteAddr.String() {
+			remote = c
+			break
+		}
+	}
+	return &CandidatePair{
+		Local:    local,
+		Remote:   remote,
+		Priority: pairPriority(local.Priority, remote.Priority, s.Controlling),
+	}
+}
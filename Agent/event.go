@@ -0,0 +1,181 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 事件类型枚举
+type EventType int
+
+const (
+	// 收到对端通过数据帧发来的消息
+	EventMessage EventType = iota + 1
+
+	// 与对端建立了p2p连接
+	EventPeerConnected
+
+	// 与对端的p2p连接断开
+	EventPeerDisconnected
+
+	// 出现了不影响连接的错误，如对端发来的错误帧
+	EventError
+
+	// p2p连接迁移到了新的路径，流和数据不受影响
+	EventPathChanged
+
+	// p2p连接意外断开，会话暂停，等待在新连接上恢复。流保持不变，见resume.go
+	EventPeerSuspended
+
+	// 暂停的会话在新连接上恢复，流和未送达的数据不受影响
+	EventPeerResumed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMessage:
+		return "message"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventError:
+		return "error"
+	case EventPathChanged:
+		return "path changed"
+	case EventPeerSuspended:
+		return "peer suspended"
+	case EventPeerResumed:
+		return "peer resumed"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// Event Agent对外发布的事件
+type Event struct {
+	Type EventType
+
+	// 事件发生的时间
+	Time time.Time
+
+	// 对端的uuid，同时与多个对端建立连接时用于区分事件来自哪个对端
+	Peer string
+
+	// 对端的地址
+	RemoteAddr string
+
+	// EventMessage: 消息内容
+	Payload []byte
+
+	// EventMessage: 数据帧的标志位
+	Flags frame.Flags
+
+	// EventPeerConnected、EventPeerResumed: 连接上的流多路复用器
+	Mux *Mux
+
+	// EventPeerConnected、EventPathChanged、EventPeerResumed: 连接所使用的候选路径
+	Pair *CandidatePair
+
+	// EventPeerDisconnected、EventPeerSuspended: 连接断开的原因
+	Cause CloseReason
+
+	// EventError: 错误信息
+	Err error
+}
+
+// PeerError 对端通过错误帧报告的错误
+type PeerError struct {
+	Code    frame.ErrorCode
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("对端报告错误(%d): %s", e.Code, e.Message)
+}
+
+// 事件订阅者的通道缓冲大小
+const subscriberBuffer = 64
+
+type subscriber struct {
+	ch   chan Event
+	done chan struct{}
+
+	// 向ch发送事件时持有，保证取消订阅时没有正在进行的发送，之后才能关闭ch
+	mu     sync.Mutex
+	closed bool
+}
+
+// 事件的订阅者列表
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]bool
+}
+
+// Subscribe 订阅Agent的事件，返回事件通道和取消订阅的函数。取消订阅后事件通道被关闭。
+// 订阅者处理过慢时会阻塞p2p连接的读取，因此需要及时从通道中读取事件
+func (s *Agent) Subscribe() (<-chan Event, func()) {
+	sub := &subscriber{
+		ch:   make(chan Event, subscriberBuffer),
+		done: make(chan struct{}),
+	}
+	s.events.mu.Lock()
+	if s.events.subs == nil {
+		s.events.subs = make(map[*subscriber]bool)
+	}
+	s.events.subs[sub] = true
+	s.events.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			// 先关闭done，使正在阻塞的发送返回，再关闭事件通道
+			close(sub.done)
+			s.events.mu.Lock()
+			delete(s.events.subs, sub)
+			s.events.mu.Unlock()
+			sub.mu.Lock()
+			sub.closed = true
+			close(sub.ch)
+			sub.mu.Unlock()
+		})
+	}
+	return sub.ch, cancel
+}
+
+// 将事件发布给所有的订阅者
+func (s *Agent) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	s.events.mu.Lock()
+	subs := make([]*subscriber, 0, len(s.events.subs))
+	for sub := range s.events.subs {
+		subs = append(subs, sub)
+	}
+	s.events.mu.Unlock()
+
+	for _, sub := range subs {
+		if !sub.send(ev, s.closing()) {
+			// Agent已关闭，不再等待订阅者
+			return
+		}
+	}
+}
+
+// 将事件发送给订阅者，订阅已取消时直接返回。closing被关闭时返回false
+func (sub *subscriber) send(ev Event, closing <-chan struct{}) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return true
+	}
+	select {
+	case sub.ch <- ev:
+	case <-sub.done:
+	case <-closing:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	s := &Agent{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	events, unsubscribe := s.Subscribe()
+
+	s.publish(Event{Type: EventPeerConnected, Peer: "a"})
+	if ev := <-events; ev.Type != EventPeerConnected || ev.Peer != "a" || ev.Time.IsZero() {
+		t.Fatalf("收到的事件不正确: %+v", ev)
+	}
+
+	// 订阅者不再读取时，取消订阅使阻塞的发布返回
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2*subscriberBuffer; i++ {
+			s.publish(Event{Type: EventMessage})
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	unsubscribe()
+	unsubscribe()
+	wg.Wait()
+
+	n := 0
+	for range events {
+		n++
+	}
+	if n > subscriberBuffer {
+		t.Fatalf("取消订阅后读到%d个事件", n)
+	}
+	s.publish(Event{Type: EventMessage})
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+/*
+身份密钥：每个Agent在程序所在目录下生成并保存一个ed25519密钥对(identity.key)，作为持久的身份。
+本机的uuid由公钥派生(见protocol.PeerID)，删除该文件即更换了uuid。
+
+1. 注册时对中继服务器下发的挑战签名，中继服务器据此确认本机持有该uuid对应的私钥。
+2. p2p连接上的TLS握手使用由该密钥签名的证书，双方据此确认对端的身份，见secure.go。
+*/
+
+// 身份密钥文件
+const identityFile = "identity.key"
+
+// Agent的持久身份
+type identity struct {
+	key ed25519.PrivateKey
+
+	// 由key签名的自签名证书，在TLS握手中出示
+	cert tls.Certificate
+}
+
+// 读取身份密钥，文件不存在时生成新的密钥并保存
+func loadIdentity(path string) (*identity, error) {
+	var key ed25519.PrivateKey
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("保存身份密钥失败: %w", err)
+		}
+		fmt.Println("生成了新的身份密钥:", path)
+	case err != nil:
+		return nil, err
+	default:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("身份密钥文件格式错误")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(ed25519.PrivateKey); !ok {
+			return nil, errors.New("身份密钥不是ed25519密钥")
+		}
+	}
+
+	cert, err := selfSignedCert(key)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{key: key, cert: cert}, nil
+}
+
+// 由key签名的自签名证书。证书不经过CA校验，只用于在TLS握手中出示公钥
+func selfSignedCert(key ed25519.PrivateKey) (tls.Certificate, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (id *identity) public() ed25519.PublicKey {
+	return id.key.Public().(ed25519.PublicKey)
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 对端长时间不读取、排队的回复过多时返回该错误
+var errReplyBacklog = errors.New("等待写入的回复过多")
+
+// 发送心跳的间隔
+const PingInterval = 10 * time.Second
+
+// 超过该时长没有收到对端的任何数据，则认为连接已失效
+const PingTimeout = 3 * PingInterval
+
+// 定时向对端发送心跳和可靠帧的确认，在心跳超时后断开连接，会话随之暂停
+func (s *Agent) keepAlive(l *p2pLink) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	var acked uint64
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-s.closing():
+			return
+		case <-ticker.C:
+		}
+		// 会话暂停期间没有可用的连接，恢复后lastRecv被重置
+		if l.isSuspended() {
+			continue
+		}
+		last := time.Unix(0, atomic.LoadInt64(&l.lastRecv))
+		if time.Since(last) > PingTimeout {
+			fmt.Println("心跳超时，断开p2p连接")
+			l.drop(CloseReason{Code: frame.CloseTimeout, Reason: "心跳超时"})
+			continue
+		}
+		if n := atomic.LoadUint64(&l.received); n != acked {
+			if l.writeFrame(frame.NewAck(n)) == nil {
+				acked = n
+			}
+		}
+		// 写入失败说明连接已断开，由p2pRead处理
+		l.writeFrame(&frame.Frame{Type: frame.TypePing})
+	}
+}
+
+// 排队等待写入的回复的最大数量，不包括确认和心跳响应。对端一直不读取时，超出的回复被丢弃
+const replyBacklog = 1024
+
+// 将p2pRead要发给对端的帧交给replyLoop写入，不会阻塞。
+// 读取帧的goroutine直接写入时，双方都阻塞在写入上就谁也不会再读取，连接随之卡死
+func (l *p2pLink) queueReply(f *frame.Frame) error {
+	l.cmu.Lock()
+	switch {
+	case f.Type == frame.TypeAck:
+		l.pendingAck = f
+	case f.Type == frame.TypePong:
+		l.pendingPong = f
+	case len(l.pendingReply) < replyBacklog:
+		l.pendingReply = append(l.pendingReply, f)
+	default:
+		l.cmu.Unlock()
+		fmt.Println("对端长时间不读取，丢弃回复:", f.Type)
+		return errReplyBacklog
+	}
+	l.cmu.Unlock()
+	select {
+	case l.replyReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 依次写入排队的回复，直到连接断开
+func (l *p2pLink) replyLoop() {
+	for {
+		select {
+		case <-l.replyReady:
+		case <-l.done:
+			return
+		}
+		l.cmu.Lock()
+		var frames []*frame.Frame
+		for _, f := range []*frame.Frame{l.pendingAck, l.pendingPong} {
+			if f != nil {
+				frames = append(frames, f)
+			}
+		}
+		frames = append(frames, l.pendingReply...)
+		l.pendingAck, l.pendingPong, l.pendingReply = nil, nil, nil
+		l.cmu.Unlock()
+
+		for _, f := range frames {
+			// 写入失败说明连接已断开，由p2pRead处理
+			if err := l.writeFrame(f); err != nil {
+				fmt.Println("回复对端失败:", f.Type, err.Error())
+			}
+		}
+	}
+}
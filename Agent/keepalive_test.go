@@ -0,0 +1,72 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 对端只发送不读取时，p2pRead不会阻塞在回复上。对端开始读取后收到排队的回复
+func TestRepliesDoNotBlockRead(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	l := newP2PLink(context.Background(), &checkedConn{conn: a, reader: frame.NewReader(a), writer: frame.NewWriter(a)}, false, &sync.WaitGroup{})
+	s := &Agent{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.p2pRead(l)
+	go l.replyLoop()
+
+	// 心跳、ackEvery个以上的可靠帧，以及编号属于本端、需要拒绝的流
+	const rounds = 100
+	sent := make(chan error, 1)
+	go func() {
+		w := frame.NewWriter(b)
+		for i := 0; i < rounds; i++ {
+			for _, f := range []*frame.Frame{
+				{Type: frame.TypePing},
+				frame.NewStream(frame.TypeStreamData, 1001, []byte("x")),
+				frame.NewStream(frame.TypeStreamOpen, uint32(2*i+2), nil),
+			} {
+				if err := w.WriteFrame(f); err != nil {
+					sent <- err
+					return
+				}
+			}
+		}
+		sent <- nil
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("对端不读取时p2pRead阻塞在回复上")
+	}
+
+	var pong, ack bool
+	closed := 0
+	r := frame.NewReader(b)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !pong || !ack || closed < rounds {
+		f, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("收到心跳响应%v、确认%v、%d个流的拒绝后读取失败: %v", pong, ack, closed, err)
+		}
+		switch f.Type {
+		case frame.TypePong:
+			pong = true
+		case frame.TypeAck:
+			ack = true
+		case frame.TypeStreamClose:
+			closed++
+		}
+	}
+
+	s.cancel()
+	b.Close()
+	<-l.done
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+连接迁移：经过中继服务器转发的p2p连接建立后，双方在后台继续尝试直连，成功后将p2p连接迁移到直连路径上。
+
+1. 双方按照与DailP2P相同的过程进行连通性检查，只是不再尝试中继转发，选出的连接即为新连接。
+2. 每一方各自在旧连接上发送一个TypeMigrate帧作为旧连接上的最后一个帧，之后的帧都写入新连接。
+3. 每一方读到对端的TypeMigrate帧后，说明对端在旧连接上发出的帧已全部读完，之后改为读取新连接。
+   新连接上先到达的帧留在新连接的缓冲区中，因此两个方向上帧的顺序都与发送顺序一致。
+4. 两个方向上的TypeMigrate帧都经过后关闭旧连接。
+
+Mux和其上的流在迁移过程中保持不变，浏览器和rosbridge不会感知到迁移。
+迁移过程中连接意外断开时，会话无法恢复，直接结束，见resume.go。
+*/
+
+// 后台直连失败后，再次尝试的间隔
+const upgradeInterval = 30 * time.Second
+
+// 向当前连接写入一个帧，可靠帧同时保存到重放缓冲区，见resume.go
+func (l *p2pLink) writeFrame(f *frame.Frame) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if f.Type.IsReliable() {
+		return l.writeReliable(f)
+	}
+	return l.writer.WriteFrame(f)
+}
+
+// 当前的底层连接
+func (l *p2pLink) currentConn() net.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn
+}
+
+// 当前所使用的候选路径
+func (l *p2pLink) path() *CandidatePair {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pair
+}
+
+// 结束会话，关闭当前连接，以及迁移中的旧连接
+func (l *p2pLink) closeConns() {
+	l.mu.Lock()
+	conn, old := l.conn, l.old
+	l.old = nil
+	l.state = sessionEnded
+	l.mu.Unlock()
+	conn.Close()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// 将p2p连接迁移到新连接上：在旧连接上发出迁移通知，之后的帧都写入新连接。会话已暂停时返回false
+func (l *p2pLink) migrate(c *checkedConn) bool {
+	l.mu.Lock()
+	if l.state != sessionActive {
+		l.mu.Unlock()
+		return false
+	}
+	l.old = l.conn
+	l.conn = c.conn
+	l.pair = c.pair
+	l.mu.Unlock()
+	atomic.StoreInt32(&l.draining, 2)
+
+	l.wmu.Lock()
+	if err := l.writer.WriteFrame(&frame.Frame{Type: frame.TypeMigrate}); err != nil {
+		fmt.Println("发送迁移通知失败:", err.Error())
+	}
+	l.writer = c.writer
+	l.wmu.Unlock()
+
+	l.next <- c
+	l.drained()
+	return true
+}
+
+// 一个方向上的迁移通知已经过旧连接，两个方向都经过后关闭旧连接
+func (l *p2pLink) drained() {
+	if atomic.AddInt32(&l.draining, -1) != 0 {
+		return
+	}
+	l.mu.Lock()
+	old := l.old
+	l.old = nil
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// 读到对端的迁移通知后，等待本端也选出同一条新连接
+func (s *Agent) awaitMigration(l *p2pLink) (*checkedConn, error) {
+	timer := time.NewTimer(checkTimeout)
+	defer timer.Stop()
+	select {
+	case c := <-l.next:
+		return c, nil
+	case <-timer.C:
+		return nil, errors.New("对端已迁移到新连接，本端没有选出新连接")
+	case <-s.closing():
+		return nil, s.ctx.Err()
+	}
+}
+
+// 在后台尝试与对端直连，成功后将p2p连接l迁移过去，直到迁移成功、l断开或会话暂停
+func (s *Agent) upgrade(l *p2pLink, peer *protocol.PeerInfo) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	lost := l.lostCh()
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-lost:
+			// 会话恢复后，如果仍经过转发，会重新开始尝试直连
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// 双方在中继转发建立后几乎同时开始，无需再等待打洞时刻；也不再尝试中继转发
+	direct := *peer
+	direct.PunchDelay = 0
+	direct.Relay = nil
+	for {
+		// 迁移只替换字节流，新连接上的流仍复用在同一条连接上，因此不使用QUIC
+		c, err := s.checkPaths(ctx, &direct, false)
+		if err == nil {
+			select {
+			case <-l.done:
+				c.close()
+				return
+			default:
+			}
+			if !l.migrate(c) {
+				c.close()
+				return
+			}
+			fmt.Println("直连成功，迁移p2p连接:", c.pair)
+			s.mu.Lock()
+			if s.link == l {
+				s.P2PConn = c.conn
+			}
+			s.mu.Unlock()
+			s.publish(Event{Type: EventPathChanged, Peer: l.peer, RemoteAddr: c.conn.RemoteAddr().String(), Mux: l.mux, Pair: c.pair})
+			return
+		}
+		if !sleepUntil(ctx, time.Now().Add(upgradeInterval)) {
+			return
+		}
+	}
+}
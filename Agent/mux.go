@@ -0,0 +1,536 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+在一条p2p连接上复用出多个相互独立的流，每个流有自己的编号、标签和流量控制窗口。
+
+打开流：发起方发送TypeStreamOpen(编号+标签)，接收方回复TypeStreamAccept表示同意，或回复TypeStreamClose表示拒绝
+关闭流：任意一方发送TypeStreamClose，另一方收到后也回复一个TypeStreamClose，双方都收到后流才被释放
+流量控制：每个流的发送方最多发送InitialWindow个未被确认的字节，接收方每消费掉一部分数据，就用TypeStreamWindow归还相应的窗口。
+	对端不遵守窗口、发来超过InitialWindow的未归还数据时，接收方丢弃缓冲区并关闭该流
+流编号：控制方打开的流使用奇数，被控方使用偶数。对端打开的流的编号与本端奇偶相同时直接拒绝
+*/
+
+// 流的初始窗口大小
+const InitialWindow = 256 * 1024
+
+// 单个流数据帧的最大长度，超过的消息会被拆分为多个帧
+const MaxChunkSize = 32 * 1024
+
+// 等待对端同意打开流的超时时间
+const StreamOpenTimeout = 10 * time.Second
+
+// 尚未被Accept的流的最大数量，超过后新的流会被拒绝
+const acceptBacklog = 16
+
+var (
+	ErrStreamClosed = errors.New("流已关闭")
+	ErrMuxClosed    = errors.New("p2p连接已断开")
+)
+
+// Mux 流的多路复用器，与一条p2p连接绑定
+type Mux struct {
+	// 向p2p连接写入帧
+	write func(*frame.Frame) error
+
+	// 处理对端的帧时回复对端，不能阻塞读取帧的goroutine。为nil时使用write
+	reply func(*frame.Frame) error
+
+	// 流被释放后调用，为nil表示无需额外处理。QUIC连接上用于关闭流对应的QUIC流
+	release func(id uint32)
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+
+	// 下一个由本端打开的流的编号。控制方使用奇数，被控方使用偶数，避免双方同时打开流时编号冲突
+	nextID uint32
+
+	// 对端打开的、等待Accept的流
+	acceptCh chan *Stream
+
+	// p2p连接断开后关闭
+	done chan struct{}
+	err  error
+}
+
+func newMux(write func(*frame.Frame) error, controlling bool) *Mux {
+	m := &Mux{
+		write:    write,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, acceptBacklog),
+		done:     make(chan struct{}),
+		nextID:   2,
+	}
+	if controlling {
+		m.nextID = 1
+	}
+	return m
+}
+
+// Open 打开一个流，阻塞直到对端同意或拒绝，最多等待StreamOpenTimeout
+func (m *Mux) Open(ctx context.Context, label string) (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	id := m.nextID
+	m.nextID += 2
+	st := newStream(m, id, label)
+	m.streams[id] = st
+	m.mu.Unlock()
+
+	if err := m.write(frame.NewStream(frame.TypeStreamOpen, id, []byte(label))); err != nil {
+		m.remove(id)
+		return nil, err
+	}
+
+	timer := time.NewTimer(StreamOpenTimeout)
+	defer timer.Stop()
+	select {
+	case <-st.acceptedCh:
+		return st, nil
+	case <-st.remoteClosedCh:
+		m.remove(id)
+		return nil, fmt.Errorf("对端拒绝打开流%s: %s", label, st.CloseReason())
+	case <-timer.C:
+		st.Close()
+		return nil, fmt.Errorf("打开流%s超时", label)
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Accept 等待对端打开一个流。返回的流需要调用Stream.Accept或Stream.Reject进行答复
+func (m *Mux) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-m.acceptCh:
+		return st, nil
+	case <-m.done:
+		return nil, m.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 处理p2p连接上收到的流控制帧
+func (m *Mux) handleFrame(f *frame.Frame) {
+	id, body, err := frame.ParseStream(f)
+	if err != nil {
+		fmt.Println("流控制帧解析失败", err.Error())
+		return
+	}
+	m.mu.Lock()
+	st := m.streams[id]
+	if f.Type == frame.TypeStreamOpen && st == nil && m.err == nil {
+		if id%2 == m.nextID%2 {
+			// 该编号属于本端，对端打开的流不能使用
+			m.mu.Unlock()
+			m.replyFrame(frame.NewStream(frame.TypeStreamClose, id, []byte("流编号无效")))
+			return
+		}
+		st = newStream(m, id, string(body))
+		m.streams[id] = st
+		m.mu.Unlock()
+		select {
+		case m.acceptCh <- st:
+		default:
+			st.sendClose("等待处理的流过多", m.replyFrame)
+		}
+		return
+	}
+	m.mu.Unlock()
+	if st == nil {
+		return
+	}
+
+	switch f.Type {
+	case frame.TypeStreamAccept:
+		st.onAccept()
+	case frame.TypeStreamData:
+		st.onData(body, f.Flags&frame.FlagMore == 0)
+	case frame.TypeStreamWindow:
+		if len(body) < 4 {
+			return
+		}
+		st.onWindow(int(binary.BigEndian.Uint32(body[:4])))
+	case frame.TypeStreamClose:
+		st.onRemoteClose(string(body))
+	}
+}
+
+// 在处理对端的帧时回复对端
+func (m *Mux) replyFrame(f *frame.Frame) error {
+	if m.reply != nil {
+		return m.reply(f)
+	}
+	return m.write(f)
+}
+
+// 释放流。流的最后一个帧必须在释放之前发出
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+	if m.release != nil {
+		m.release(id)
+	}
+}
+
+// p2p连接断开后，关闭所有的流
+func (m *Mux) closeAll(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	close(m.done)
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	m.mu.Unlock()
+
+	for _, st := range streams {
+		st.onRemoteClose(err.Error())
+	}
+}
+
+// 接收缓冲区中的一段数据
+type chunk struct {
+	data []byte
+
+	// 是否为一条消息的最后一段
+	last bool
+}
+
+// Stream 复用在p2p连接上的一个流。
+// 每次Write发送的数据在对端通过ReadMessage作为一条完整的消息读出，也可以通过Read当作字节流读取
+type Stream struct {
+	mux   *Mux
+	id    uint32
+	label string
+
+	// 保证同一条消息的各个分片连续发送
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// 接收缓冲区
+	recvBuf []chunk
+
+	// ReadMessage已取出、但还未凑成完整消息的数据
+	partial []byte
+
+	// 已被消费、但尚未归还给对端的窗口大小
+	consumed int
+
+	// 已收到、但尚未归还给对端的字节数，包括缓冲区中未被消费的数据。超过InitialWindow说明对端没有遵守流量控制
+	unreturned int
+
+	// 剩余的发送窗口
+	sendWindow int
+
+	accepted   bool
+	acceptedCh chan struct{}
+
+	// 本端已调用Close
+	userClosed bool
+
+	// 本端已发送TypeStreamClose
+	sentClose bool
+
+	// 对端已关闭该流
+	remoteClosed   bool
+	remoteClosedCh chan struct{}
+	closeReason    string
+}
+
+func newStream(m *Mux, id uint32, label string) *Stream {
+	st := &Stream{
+		mux:            m,
+		id:             id,
+		label:          label,
+		sendWindow:     InitialWindow,
+		acceptedCh:     make(chan struct{}),
+		remoteClosedCh: make(chan struct{}),
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID 流的编号
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Label 打开流时指定的标签，用于对端区分流的用途
+func (st *Stream) Label() string {
+	return st.label
+}
+
+// CloseReason 对端关闭流时给出的原因
+func (st *Stream) CloseReason() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.closeReason
+}
+
+// Accept 同意对端打开该流
+func (st *Stream) Accept() error {
+	st.mu.Lock()
+	if st.accepted {
+		st.mu.Unlock()
+		return nil
+	}
+	st.accepted = true
+	close(st.acceptedCh)
+	st.mu.Unlock()
+	return st.mux.write(frame.NewStream(frame.TypeStreamAccept, st.id, nil))
+}
+
+// Reject 拒绝对端打开该流
+func (st *Stream) Reject(reason string) error {
+	return st.close(reason)
+}
+
+// Write 将p作为一条完整的消息发送给对端，发送窗口耗尽时阻塞
+func (st *Stream) Write(p []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	sent := 0
+	for {
+		st.mu.Lock()
+		for st.sendWindow <= 0 && !st.sentClose && !st.remoteClosed {
+			st.cond.Wait()
+		}
+		if st.sentClose || st.remoteClosed {
+			st.mu.Unlock()
+			return sent, ErrStreamClosed
+		}
+		n := len(p) - sent
+		if n > MaxChunkSize {
+			n = MaxChunkSize
+		}
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		f := frame.NewStream(frame.TypeStreamData, st.id, p[sent:sent+n])
+		if sent+n < len(p) {
+			f.Flags |= frame.FlagMore
+		}
+		if err := st.mux.write(f); err != nil {
+			return sent, err
+		}
+		sent += n
+		if sent == len(p) {
+			return sent, nil
+		}
+	}
+}
+
+// ReadMessage 读取对端发来的下一条完整消息。对端关闭流后返回io.EOF
+func (st *Stream) ReadMessage() ([]byte, error) {
+	st.mu.Lock()
+	for {
+		// 将缓冲区中的分片拼接到partial中，并及时归还窗口，使得超过窗口大小的消息也能被完整接收
+		n := 0
+		last := false
+		for len(st.recvBuf) > 0 && !last {
+			c := st.recvBuf[0]
+			st.recvBuf = st.recvBuf[1:]
+			st.partial = append(st.partial, c.data...)
+			n += len(c.data)
+			last = c.last
+		}
+		inc := st.consume(n)
+		if last {
+			msg := st.partial
+			st.partial = nil
+			st.mu.Unlock()
+			st.sendWindowUpdate(inc)
+			if msg == nil {
+				msg = []byte{}
+			}
+			return msg, nil
+		}
+		if inc > 0 {
+			st.mu.Unlock()
+			st.sendWindowUpdate(inc)
+			st.mu.Lock()
+			continue
+		}
+		if err := st.readErr(); err != nil {
+			st.mu.Unlock()
+			return nil, err
+		}
+		st.cond.Wait()
+	}
+}
+
+// Read 以字节流的方式读取对端发来的数据，不保留消息边界
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for {
+		// partial中的数据在取出时已经归还过窗口
+		fromPartial := copy(p, st.partial)
+		st.partial = st.partial[fromPartial:]
+		n := fromPartial
+		for n < len(p) && len(st.recvBuf) > 0 {
+			c := &st.recvBuf[0]
+			cnt := copy(p[n:], c.data)
+			c.data = c.data[cnt:]
+			n += cnt
+			if len(c.data) == 0 {
+				st.recvBuf = st.recvBuf[1:]
+			}
+		}
+		if n > 0 {
+			inc := st.consume(n - fromPartial)
+			st.mu.Unlock()
+			st.sendWindowUpdate(inc)
+			return n, nil
+		}
+		if err := st.readErr(); err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+		st.cond.Wait()
+	}
+}
+
+// Close 关闭流，之后的读写都会失败
+func (st *Stream) Close() error {
+	return st.close("")
+}
+
+func (st *Stream) close(reason string) error {
+	return st.sendClose(reason, st.mux.write)
+}
+
+// 关闭流并通过write通知对端
+func (st *Stream) sendClose(reason string, write func(*frame.Frame) error) error {
+	st.mu.Lock()
+	st.userClosed = true
+	st.cond.Broadcast()
+	if st.sentClose {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sentClose = true
+	release := st.remoteClosed
+	st.mu.Unlock()
+
+	err := write(frame.NewStream(frame.TypeStreamClose, st.id, []byte(reason)))
+	if release {
+		st.mux.remove(st.id)
+	}
+	return err
+}
+
+// 接收缓冲区为空时，读取应返回的错误；返回nil表示需要继续等待
+func (st *Stream) readErr() error {
+	if st.userClosed {
+		return ErrStreamClosed
+	}
+	if st.remoteClosed {
+		return io.EOF
+	}
+	return nil
+}
+
+// 记录已消费的字节数，累计超过半个窗口时返回需要归还给对端的窗口大小
+func (st *Stream) consume(n int) int {
+	st.consumed += n
+	if st.consumed < InitialWindow/2 || st.remoteClosed {
+		return 0
+	}
+	inc := st.consumed
+	st.consumed = 0
+	st.unreturned -= inc
+	return inc
+}
+
+func (st *Stream) sendWindowUpdate(inc int) {
+	if inc == 0 {
+		return
+	}
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, uint32(inc))
+	if err := st.mux.write(frame.NewStream(frame.TypeStreamWindow, st.id, body)); err != nil {
+		fmt.Println("发送流量控制帧失败", err.Error())
+	}
+}
+
+func (st *Stream) onAccept() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.accepted {
+		return
+	}
+	st.accepted = true
+	close(st.acceptedCh)
+}
+
+func (st *Stream) onData(data []byte, last bool) {
+	st.mu.Lock()
+	if st.userClosed {
+		st.mu.Unlock()
+		return
+	}
+	st.unreturned += len(data)
+	if st.unreturned > InitialWindow {
+		// 对端超出了发送窗口，丢弃已缓冲的数据并关闭流，避免接收缓冲区无限增长
+		st.recvBuf = nil
+		st.partial = nil
+		st.mu.Unlock()
+		fmt.Printf("流%d超出流量控制窗口，已关闭\n", st.id)
+		st.sendClose("超出流量控制窗口", st.mux.replyFrame)
+		return
+	}
+	st.recvBuf = append(st.recvBuf, chunk{data: data, last: last})
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) onWindow(inc int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += inc
+	st.cond.Broadcast()
+}
+
+func (st *Stream) onRemoteClose(reason string) {
+	st.mu.Lock()
+	if st.remoteClosed {
+		st.mu.Unlock()
+		return
+	}
+	st.remoteClosed = true
+	st.closeReason = reason
+	close(st.remoteClosedCh)
+	st.cond.Broadcast()
+	needReply := !st.sentClose
+	st.sentClose = true
+	st.mu.Unlock()
+
+	if needReply {
+		st.mux.replyFrame(frame.NewStream(frame.TypeStreamClose, st.id, nil))
+	}
+	st.mux.remove(st.id)
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 通过通道相连的两个Mux，分别作为控制方和被控方。每个方向上的帧按顺序交给对端处理
+func muxPair(t *testing.T) (*Mux, *Mux) {
+	t.Helper()
+	var a, b *Mux
+	pump := func(dst **Mux) func(*frame.Frame) error {
+		ch := make(chan *frame.Frame, 1024)
+		done := make(chan struct{})
+		t.Cleanup(func() { close(done) })
+		go func() {
+			for {
+				select {
+				case f := <-ch:
+					(*dst).handleFrame(f)
+				case <-done:
+					return
+				}
+			}
+		}()
+		return func(f *frame.Frame) error {
+			select {
+			case ch <- f:
+				return nil
+			case <-done:
+				return ErrMuxClosed
+			}
+		}
+	}
+	a = newMux(pump(&b), true)
+	b = newMux(pump(&a), false)
+	return a, b
+}
+
+// 记录写入的帧，用于模拟不守规矩的对端
+type frameLog struct {
+	mu     sync.Mutex
+	frames []*frame.Frame
+}
+
+func (l *frameLog) write(f *frame.Frame) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.frames = append(l.frames, f)
+	return nil
+}
+
+// 返回写入的类型为t的帧的流编号和body
+func (l *frameLog) find(t frame.Type) (uint32, []byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range l.frames {
+		if f.Type == t {
+			id, body, _ := frame.ParseStream(f)
+			return id, body, true
+		}
+	}
+	return 0, nil, false
+}
+
+func openPair(t *testing.T, a, b *Mux) (*Stream, *Stream) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan *Stream, 1)
+	go func() {
+		st, err := b.Accept(ctx)
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		st.Accept()
+		accepted <- st
+	}()
+	st, err := a.Open(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil || peer.Label() != "test" || peer.ID() != st.ID() {
+		t.Fatal("对端收到的流不正确")
+	}
+	return st, peer
+}
+
+func TestMuxMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "空消息", size: 0},
+		{name: "单个分片", size: 100},
+		{name: "多个分片", size: 3*MaxChunkSize + 1},
+		{name: "超过窗口大小", size: 4*InitialWindow + 7},
+	}
+	a, b := muxPair(t)
+	st, peer := openPair(t, a, b)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := bytes.Repeat([]byte{byte(tt.size)}, tt.size)
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := st.Write(msg)
+				errCh <- err
+			}()
+			got, err := peer.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("收到%d字节，预期%d字节", len(got), len(msg))
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// 关闭后对端读到io.EOF
+	st.Close()
+	if _, err := peer.ReadMessage(); err != io.EOF {
+		t.Fatalf("对端关闭后读取返回%v，预期io.EOF", err)
+	}
+}
+
+func TestMuxStreamIDs(t *testing.T) {
+	a, b := muxPair(t)
+	for i := 0; i < 3; i++ {
+		st, _ := openPair(t, a, b)
+		if st.ID()%2 != 1 {
+			t.Fatalf("控制方打开的流编号为%d", st.ID())
+		}
+		st, _ = openPair(t, b, a)
+		if st.ID()%2 != 0 {
+			t.Fatalf("被控方打开的流编号为%d", st.ID())
+		}
+	}
+}
+
+func TestMuxRejectsLocalParity(t *testing.T) {
+	tests := []struct {
+		name        string
+		controlling bool
+		id          uint32
+		wantAccept  bool
+	}{
+		{name: "控制方收到偶数编号", controlling: true, id: 2, wantAccept: true},
+		{name: "控制方收到奇数编号", controlling: true, id: 1, wantAccept: false},
+		{name: "被控方收到奇数编号", controlling: false, id: 3, wantAccept: true},
+		{name: "被控方收到偶数编号", controlling: false, id: 4, wantAccept: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log frameLog
+			m := newMux(log.write, tt.controlling)
+			m.handleFrame(frame.NewStream(frame.TypeStreamOpen, tt.id, []byte("x")))
+
+			_, _, rejected := log.find(frame.TypeStreamClose)
+			queued := len(m.acceptCh) == 1
+			if queued != tt.wantAccept || rejected == tt.wantAccept {
+				t.Fatalf("等待Accept=%v 已拒绝=%v，预期接受=%v", queued, rejected, tt.wantAccept)
+			}
+			if !tt.wantAccept && m.streams[tt.id] != nil {
+				t.Fatal("被拒绝的流不应被记录")
+			}
+		})
+	}
+}
+
+func TestMuxWindowViolation(t *testing.T) {
+	var log frameLog
+	m := newMux(log.write, false)
+	m.handleFrame(frame.NewStream(frame.TypeStreamOpen, 1, []byte("x")))
+	st := <-m.acceptCh
+	st.Accept()
+
+	// 对端在窗口内发送的数据正常接收
+	chunk := make([]byte, MaxChunkSize)
+	for sent := 0; sent+len(chunk) <= InitialWindow; sent += len(chunk) {
+		f := frame.NewStream(frame.TypeStreamData, 1, chunk)
+		f.Flags |= frame.FlagMore
+		m.handleFrame(f)
+	}
+	if _, _, ok := log.find(frame.TypeStreamClose); ok {
+		t.Fatal("对端没有超出窗口时流被关闭")
+	}
+
+	// 继续发送，超出窗口后流被关闭，缓冲区被丢弃
+	m.handleFrame(frame.NewStream(frame.TypeStreamData, 1, []byte{0}))
+	id, reason, ok := log.find(frame.TypeStreamClose)
+	if !ok || id != 1 || len(reason) == 0 {
+		t.Fatal("对端超出窗口后流没有被关闭")
+	}
+	if _, err := st.ReadMessage(); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("流被关闭后读取返回%v", err)
+	}
+	st.mu.Lock()
+	buffered := len(st.recvBuf)
+	st.mu.Unlock()
+	if buffered != 0 {
+		t.Fatalf("流被关闭后缓冲区仍有%d段数据", buffered)
+	}
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+/*
+NAT类型探测：连接中继服务器后，在后台通过UDP绑定请求探测本机所在NAT的行为，结果上报给中继服务器，
+交换信息时由中继服务器告知对端。判断方法见Protocol/nat.go。
+
+1. 向中继服务器的主地址发送绑定请求，得到映射地址，同时得到中继服务器的备用地址。
+2. 请求中继服务器从备用地址回复，判断过滤行为。此时本机还没有向备用地址发送过报文，
+   因此必须在第3步之前进行，否则NAT会因为第3步的报文而放行备用地址。
+3. 向备用地址发送绑定请求，与第1步的映射地址比较，判断映射行为。
+
+任意一方为对称型NAT时，连通性检查不再尝试tcp打洞，只尝试host之间的tcp路径，udp路径随之提前开始。
+*/
+
+// NAT 本机NAT的探测结果，尚未探测完成时返回nil
+func (s *Agent) NAT() *protocol.NATInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nat
+}
+
+// 在后台探测本机NAT的行为，完成后上报给中继服务器。与中继服务器的连接断开时返回
+func (s *Agent) detectNAT(r *relayConn, relayAddr string) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	info := s.probeNAT(ctx, relayAddr)
+	if ctx.Err() != nil {
+		return
+	}
+	fmt.Println("本机的NAT类型:", info)
+	s.mu.Lock()
+	s.nat = info
+	s.mu.Unlock()
+
+	// 对称型NAT：预测端口后一并上报，之后定期重新预测，见predict.go
+	if info.Symmetric() {
+		if err := s.updatePrediction(ctx, r); err != nil && ctx.Err() == nil {
+			fmt.Println("上报NAT类型失败:", err.Error())
+		}
+		s.predictLoop(ctx, r)
+		return
+	}
+	if err := r.call(ctx, protocol.MethodReportNAT, info, nil); err != nil && ctx.Err() == nil {
+		fmt.Println("上报NAT类型失败:", err.Error())
+	}
+}
+
+// 按照上面的步骤探测NAT的行为，无法判断的项为unknown
+func (s *Agent) probeNAT(ctx context.Context, relayAddr string) *protocol.NATInfo {
+	info := &protocol.NATInfo{Mapping: protocol.NATUnknown, Filtering: protocol.NATUnknown}
+	s.mu.Lock()
+	pubAddr := s.PubAddr
+	s.mu.Unlock()
+	if _, port, err := net.SplitHostPort(pubAddr); err == nil {
+		info.TCPPortPreserved = port == strconv.Itoa(s.LocalPort)
+	}
+	if s.udp == nil {
+		return info
+	}
+	primary, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		return info
+	}
+
+	first, err := s.udp.bind(ctx, primary, &protocol.BindingRequest{})
+	if err != nil {
+		fmt.Println("探测NAT类型失败:", err.Error())
+		return info
+	}
+	info.PortPreserved = first.mapped.Port == s.LocalPort
+	if s.isHostIP(first.mapped.IP) {
+		info.Mapping = protocol.NATNone
+	}
+	if first.other == "" {
+		fmt.Println("中继服务器没有备用地址，无法探测NAT的映射和过滤行为")
+		return info
+	}
+	other, err := otherAddr(primary, first.other)
+	if err != nil {
+		fmt.Println("中继服务器的备用地址无效:", err.Error())
+		return info
+	}
+	sameIP := other.IP.Equal(primary.IP)
+
+	// 过滤行为：能否收到备用地址的回复
+	b, err := s.udp.bind(ctx, primary, &protocol.BindingRequest{Change: true})
+	switch {
+	case err == nil && sameUDPAddr(b.from, other) && sameIP:
+		info.Filtering = protocol.NATAddressDependent
+	case err == nil && sameUDPAddr(b.from, other):
+		info.Filtering = protocol.NATEndpointIndependent
+	case !errors.Is(err, errBindingTimeout):
+		// 探测失败，或收到的是其他请求的响应
+	case sameIP:
+		info.Filtering = protocol.NATAddressAndPortDependent
+	default:
+		info.Filtering = protocol.NATAddressDependent
+	}
+
+	// 映射行为：发往备用地址的报文的映射地址是否相同
+	if info.Mapping == protocol.NATNone {
+		return info
+	}
+	b, err = s.udp.bind(ctx, other, &protocol.BindingRequest{})
+	switch {
+	case err != nil || !sameUDPAddr(b.from, other):
+	case sameUDPAddr(b.mapped, first.mapped):
+		info.Mapping = protocol.NATEndpointIndependent
+	case sameIP:
+		info.Mapping = protocol.NATAddressAndPortDependent
+	default:
+		info.Mapping = protocol.NATAddressDependent
+	}
+	return info
+}
+
+// 中继服务器的备用地址，ip未指定时使用主地址的ip
+func otherAddr(primary *net.UDPAddr, other string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", other)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = primary.IP
+	}
+	return addr, nil
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// ip是否为本机网卡上的地址
+func (s *Agent) isHostIP(ip net.IP) bool {
+	for _, c := range s.hostCandidates() {
+		host, _, err := net.SplitHostPort(c.Address)
+		if err == nil && net.ParseIP(host).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否跳过tcp打洞：任意一方为对称型NAT时，tcp打洞基本不可能成功
+func (s *Agent) skipTCPPunch(peer *protocol.PeerInfo) bool {
+	return s.NAT().Symmetric() || peer.NAT.Symmetric()
+}
+
+// 是否为需要打洞的路径，即至少一方使用公网映射地址
+func (p *CandidatePair) punched() bool {
+	return p.Local.Type != protocol.CandidateHost || p.Remote.Type != protocol.CandidateHost
+}
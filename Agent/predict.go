@@ -0,0 +1,204 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+端口预测：对称型NAT为每个新的目标地址分配新的映射端口，中继服务器观察到的srflx候选地址对对端没有用处。
+许多对称型NAT按固定的步长依次分配端口，因此可以预测本机发往对端时将被分配的端口。
+
+1. 本机为对称型NAT时，依次从predictProbes个临时UDP端口向中继服务器发送绑定请求，
+   每个临时端口都会被分配一个新的映射端口，由相邻两次的差得到分配的步长。
+2. 预测结果随NAT探测结果一起上报给中继服务器，由中继服务器在交换信息时告知对端。
+   之后每隔predictInterval重新预测一次，控制方在请求对端的地址之前也重新预测一次，使预测尽量新。
+3. 对端为对称型NAT且带有预测时，连通性检查从udp的打洞时刻起，每隔retryInterval向预测的所有端口
+   各发送一个check报文。命中的端口回复的check response来自对端的实际地址，之后与prflx候选地址的检查相同。
+
+本机的NAT为每个预测的端口也会分配新的映射，因此双方都是对称型NAT时成功率较低。
+tcp打洞在对称型NAT下已被跳过，端口预测只用于udp。
+*/
+
+// 探测分配步长时使用的临时端口的个数
+const predictProbes = 5
+
+// 预测的端口个数
+const predictRange = 32
+
+// 重新预测的间隔
+const predictInterval = 20 * time.Second
+
+// 从一个新的临时UDP端口向中继服务器发送绑定请求，返回该端口的映射地址
+func probeMapping(ctx context.Context, relay *net.UDPAddr) (*net.UDPAddr, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	// 不携带uuid，以免中继服务器将临时端口记录为本机的UDP地址
+	req, err := protocol.EncodePacket(protocol.PacketBindingRequest, &protocol.BindingRequest{})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpBufferSize)
+	for i := 0; i < bindingRetries; i++ {
+		if _, err := conn.WriteToUDP(req, relay); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(bindingTimeout))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				break
+			}
+			t, body, ok := protocol.ParsePacket(buf[:n])
+			if !ok || t != protocol.PacketBindingResponse {
+				continue
+			}
+			var resp protocol.BindingResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				continue
+			}
+			return net.ResolveUDPAddr("udp", resp.Address)
+		}
+	}
+	return nil, errBindingTimeout
+}
+
+// 探测NAT分配端口的步长，得到下一个新的映射端口的预测。NAT不按固定步长分配时返回错误
+func predictPorts(ctx context.Context, relay *net.UDPAddr) (*protocol.PortPrediction, error) {
+	var ports []int
+	var ip net.IP
+	for i := 0; i < predictProbes; i++ {
+		mapped, err := probeMapping(ctx, relay)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, mapped.Port)
+		ip = mapped.IP
+	}
+	delta, ok := allocationDelta(ports)
+	if !ok {
+		return nil, fmt.Errorf("NAT没有按固定步长分配端口:%v", ports)
+	}
+	return &protocol.PortPrediction{IP: ip.String(), Base: ports[len(ports)-1], Delta: delta, Range: predictRange}, nil
+}
+
+// 相邻端口之差中出现次数最多的值，超过半数时认为是NAT分配端口的步长
+func allocationDelta(ports []int) (int, bool) {
+	counts := make(map[int]int)
+	best, most := 0, 0
+	for i := 1; i < len(ports); i++ {
+		d := ports[i] - ports[i-1]
+		counts[d]++
+		if counts[d] > most {
+			best, most = d, counts[d]
+		}
+	}
+	return best, best != 0 && most*2 > len(ports)-1
+}
+
+// 本机为对称型NAT时重新预测端口，并将结果上报给中继服务器
+func (s *Agent) updatePrediction(ctx context.Context, r *relayConn) error {
+	info := s.NAT()
+	if !info.Symmetric() {
+		return nil
+	}
+	relay, err := net.ResolveUDPAddr("udp", s.relayAddr)
+	if err != nil {
+		return err
+	}
+	updated := *info
+	updated.Prediction, err = predictPorts(ctx, relay)
+	if err != nil {
+		// 无法预测时清除之前的预测，对端不再尝试
+		fmt.Println("端口预测失败:", err.Error())
+	}
+	s.mu.Lock()
+	s.nat = &updated
+	s.mu.Unlock()
+	return r.call(ctx, protocol.MethodReportNAT, &updated, nil)
+}
+
+// 每隔predictInterval重新预测一次，直到与中继服务器的连接断开
+func (s *Agent) predictLoop(ctx context.Context, r *relayConn) {
+	ticker := time.NewTicker(predictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := s.updatePrediction(ctx, r); err != nil && ctx.Err() == nil {
+			fmt.Println("上报端口预测失败:", err.Error())
+		}
+	}
+}
+
+// 对端为对称型NAT时，按照对端的端口预测得到的UDP地址
+func (s *Agent) predictedAddrs(peer *protocol.PeerInfo) []*net.UDPAddr {
+	if s.udp == nil || !peer.NAT.Symmetric() || peer.NAT.Prediction == nil {
+		return nil
+	}
+	p := peer.NAT.Prediction
+	ip := net.ParseIP(p.IP)
+	if ip == nil {
+		return nil
+	}
+	var addrs []*net.UDPAddr
+	for _, port := range p.Ports() {
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: port})
+	}
+	return addrs
+}
+
+// 从start开始，每隔retryInterval向预测的所有地址各发送一个check报文，直到ctx被取消。
+// 控制方在任一地址连通后即停止发送
+func (c *udpChecker) spray(start time.Time, addrs []*net.UDPAddr) {
+	fmt.Println("对端为对称型NAT，向预测的", len(addrs), "个端口发送检查报文")
+	next := start
+	for {
+		if !sleepUntil(c.ctx, next.Add(jitter(retryJitter))) {
+			return
+		}
+		next = next.Add(retryInterval)
+
+		if c.s.Controlling && c.anyValid(addrs) {
+			return
+		}
+		for _, addr := range addrs {
+			err := c.s.udp.sendPacket(protocol.PacketCheck, &protocol.CheckPacket{UUID: c.s.UUID}, addr)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					fmt.Println("发送UDP检查报文失败:", addr, "error:", err.Error())
+				}
+				return
+			}
+		}
+	}
+}
+
+// addrs中是否有已连通的地址
+func (c *udpChecker) anyValid(addrs []*net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, addr := range addrs {
+		if c.valid[addr.String()] {
+			return true
+		}
+	}
+	return false
+}
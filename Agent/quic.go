@@ -0,0 +1,351 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+/*
+QUIC传输：可选地在UDP路径上使用QUIC代替kcp，由控制方的Agent.QUIC决定。
+
+1. 打洞和连通性检查与kcp完全相同，控制方在nominate报文中指定使用QUIC。
+2. 被控制方在该路径上开始监听QUIC后回复nominate ack，控制方收到后发起QUIC连接。
+3. QUIC握手中双方出示并校验身份证书，与tcp和kcp上的TLS握手相同，见secure.go。
+   控制方打开的第一个QUIC流作为控制流，先发送一个TypeNominate帧使对端感知到该流。
+   控制流承载心跳、关闭、数据等连接级的帧，与tcp连接上的字节流相同。
+4. Mux上的每个流各自对应一个QUIC流，流的控制帧和数据帧只在对应的QUIC流上收发。
+   一个流上的丢包重传不会阻塞其他的流，例如遥控指令和传感器数据可以使用不同的流。
+*/
+
+// QUIC握手时协商的应用层协议
+const quicALPN = "p2pagent"
+
+// QUIC连接的空闲超时时间，心跳由控制流上的TypePing帧负责
+const quicIdleTimeout = PingTimeout + PingInterval
+
+// 对端最多可以同时打开的QUIC流的数量
+const quicMaxStreams = 1024
+
+// 关闭QUIC连接前，等待对端收到控制流上最后的帧的最长时间
+const quicCloseTimeout = time.Second
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: checkTimeout,
+		MaxIdleTimeout:       quicIdleTimeout,
+		MaxIncomingStreams:   quicMaxStreams,
+	}
+}
+
+// QUIC握手使用的TLS配置：在p2p连接的TLS配置的基础上指定应用层协议
+func quicTLS(conf *tls.Config) *tls.Config {
+	conf = conf.Clone()
+	conf.NextProtos = []string{quicALPN}
+	return conf
+}
+
+// 被控制方：在与remote之间的报文通道上监听QUIC，已有的会话会被替换。conf为p2p连接的TLS配置
+func (u *udpSocket) listenQUIC(remote *net.UDPAddr, conf *tls.Config) (*quicEndpoint, *quic.Listener, error) {
+	ep := u.quicEndpoint(remote)
+	ln, err := ep.tr.Listen(quicTLS(conf), quicConfig())
+	if err != nil {
+		ep.close()
+		return nil, nil, err
+	}
+	return ep, ln, nil
+}
+
+// 被控制方：接受控制方的QUIC连接及其控制流
+func acceptQUIC(ctx context.Context, ep *quicEndpoint, ln *quic.Listener) (*checkedConn, error) {
+	defer ln.Close()
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	conn, err := ln.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	qc := &quicConn{Stream: stream, conn: conn, ep: ep}
+	c := &checkedConn{conn: qc, reader: frame.NewReader(qc), writer: frame.NewWriter(qc), quic: conn}
+
+	// 控制流上的第一个帧
+	stop := interruptOnDone(ctx, qc)
+	qc.SetReadDeadline(time.Now().Add(checkTimeout))
+	f, err := c.reader.ReadFrame()
+	stop()
+	if err == nil && f.Type != frame.TypeNominate {
+		err = fmt.Errorf("控制流上的第一个帧应为%s，实际为%s", frame.TypeNominate, f.Type)
+	}
+	if err != nil {
+		qc.Close()
+		return nil, err
+	}
+	qc.SetReadDeadline(time.Time{})
+	return c, nil
+}
+
+// 控制方：向remote发起QUIC连接，并打开控制流。conf为p2p连接的TLS配置
+func (u *udpSocket) dialQUIC(ctx context.Context, remote *net.UDPAddr, conf *tls.Config) (*checkedConn, error) {
+	ep := u.quicEndpoint(remote)
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	conn, err := ep.tr.Dial(ctx, remote, quicTLS(conf), quicConfig())
+	if err != nil {
+		ep.close()
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		ep.close()
+		return nil, err
+	}
+	qc := &quicConn{Stream: stream, conn: conn, ep: ep}
+	c := &checkedConn{conn: qc, reader: frame.NewReader(qc), writer: frame.NewWriter(qc), quic: conn}
+	if err := c.writer.WriteFrame(&frame.Frame{Type: frame.TypeNominate}); err != nil {
+		qc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 与一个对端地址之间的QUIC端点
+type quicEndpoint struct {
+	pc *udpPeerConn
+	tr *quic.Transport
+}
+
+// quic-go以LocalAddr区分不同的底层连接，同一地址不能重复使用，因此为每个报文通道分配一个序号
+var quicEndpointSeq uint64
+
+// 创建与remote之间的QUIC端点，已有的kcp会话或QUIC连接会被替换
+func (u *udpSocket) quicEndpoint(remote *net.UDPAddr) *quicEndpoint {
+	pc := u.peerConn(remote)
+	addr := &quicLocalAddr{UDPAddr: u.conn.LocalAddr().(*net.UDPAddr), seq: atomic.AddUint64(&quicEndpointSeq, 1)}
+	return &quicEndpoint{pc: pc, tr: &quic.Transport{Conn: &quicPacketConn{udpPeerConn: pc, addr: addr}}}
+}
+
+// 先关闭报文通道以中断quic-go的读取，再关闭Transport
+func (ep *quicEndpoint) close() {
+	ep.pc.Close()
+	ep.tr.Close()
+}
+
+type quicLocalAddr struct {
+	*net.UDPAddr
+	seq uint64
+}
+
+func (a *quicLocalAddr) String() string {
+	return fmt.Sprintf("%s#%d", a.UDPAddr, a.seq)
+}
+
+type quicPacketConn struct {
+	*udpPeerConn
+	addr *quicLocalAddr
+}
+
+func (c *quicPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// quic-go会尝试增大接收和发送缓冲区，作用于所有对端共用的UDP端口
+func (c *quicPacketConn) SetReadBuffer(bytes int) error {
+	return c.sock.conn.SetReadBuffer(bytes)
+}
+
+func (c *quicPacketConn) SetWriteBuffer(bytes int) error {
+	return c.sock.conn.SetWriteBuffer(bytes)
+}
+
+// QUIC连接上的控制流，作为p2p连接的底层连接
+type quicConn struct {
+	quic.Stream
+	conn quic.Connection
+	ep   *quicEndpoint
+
+	once sync.Once
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.ep.pc.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// 关闭控制流的发送方向，等待对端也关闭控制流或断开连接后再断开QUIC连接，
+// 以免还在途中的关闭帧随连接一起被丢弃
+func (c *quicConn) Close() error {
+	c.once.Do(func() {
+		c.Stream.Close()
+		c.Stream.SetReadDeadline(time.Now().Add(quicCloseTimeout))
+		io.Copy(io.Discard, c.Stream)
+		c.conn.CloseWithError(0, "")
+		c.ep.close()
+	})
+	return nil
+}
+
+// QUIC连接上Mux的流与QUIC流之间的对应关系
+type quicStreams struct {
+	conn quic.Connection
+	mux  *Mux
+	wg   *sync.WaitGroup
+
+	// p2p连接的生命周期，close时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	streams map[uint32]*quicStream
+
+	// 已调用close，不再启动新的goroutine。由mu保护
+	closed bool
+}
+
+// Mux的一个流对应的QUIC流
+type quicStream struct {
+	stream quic.Stream
+	writer *frame.Writer
+}
+
+func newQUICStreams(ctx context.Context, conn quic.Connection, wg *sync.WaitGroup) *quicStreams {
+	ctx, cancel := context.WithCancel(ctx)
+	return &quicStreams{
+		conn:    conn,
+		wg:      wg,
+		ctx:     ctx,
+		cancel:  cancel,
+		streams: make(map[uint32]*quicStream),
+	}
+}
+
+// p2p连接的会话结束后调用，停止接受QUIC流，之后不再向wg中添加goroutine
+func (q *quicStreams) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cancel()
+}
+
+// 在wg中启动读取stream的goroutine，已调用close时返回false
+func (q *quicStreams) startRead(stream quic.Stream, accepted bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.read(stream, accepted)
+	}()
+	return true
+}
+
+// 将流控制帧写入对应的QUIC流，打开流时新建一个QUIC流
+func (q *quicStreams) write(f *frame.Frame) error {
+	id, _, err := frame.ParseStream(f)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	qs := q.streams[id]
+	q.mu.Unlock()
+	if qs == nil {
+		if f.Type != frame.TypeStreamOpen {
+			return ErrStreamClosed
+		}
+		ctx, cancel := context.WithTimeout(q.ctx, StreamOpenTimeout)
+		stream, err := q.conn.OpenStreamSync(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if !q.startRead(stream, false) {
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			return ErrMuxClosed
+		}
+		qs = q.add(id, stream)
+	}
+	return qs.writer.WriteFrame(f)
+}
+
+func (q *quicStreams) add(id uint32, stream quic.Stream) *quicStream {
+	qs := &quicStream{stream: stream, writer: frame.NewWriter(stream)}
+	q.mu.Lock()
+	q.streams[id] = qs
+	q.mu.Unlock()
+	return qs
+}
+
+// 流被释放后关闭对应的QUIC流的发送方向，对端同样关闭后QUIC流即被释放
+func (q *quicStreams) release(id uint32) {
+	q.mu.Lock()
+	qs := q.streams[id]
+	delete(q.streams, id)
+	q.mu.Unlock()
+	if qs != nil {
+		qs.stream.Close()
+	}
+}
+
+// 接受对端打开的QUIC流，直到连接断开或会话结束
+func (q *quicStreams) acceptLoop() {
+	for {
+		stream, err := q.conn.AcceptStream(q.ctx)
+		if err != nil {
+			return
+		}
+		if !q.startRead(stream, true) {
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			return
+		}
+	}
+}
+
+// 读取一个QUIC流上的帧交给Mux处理。对端打开的QUIC流上第一个帧为TypeStreamOpen，据此登记对应关系
+func (q *quicStreams) read(stream quic.Stream, accepted bool) {
+	reader := frame.NewReader(stream)
+	for {
+		f, err := reader.ReadFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				stream.CancelRead(0)
+			}
+			return
+		}
+		if !f.Type.IsStream() {
+			continue
+		}
+		if accepted {
+			accepted = false
+			id, _, err := frame.ParseStream(f)
+			if err != nil || f.Type != frame.TypeStreamOpen {
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+				return
+			}
+			q.add(id, stream)
+		}
+		q.mux.handleFrame(f)
+	}
+}
@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestQUICStreamsClose(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	q := newQUICStreams(parent, nil, &wg)
+	cancel()
+	if q.ctx.Err() == nil {
+		t.Fatal("Agent关闭后应停止接受QUIC流")
+	}
+
+	q = newQUICStreams(context.Background(), nil, &wg)
+	q.close()
+	if q.ctx.Err() == nil {
+		t.Fatal("会话结束后应停止接受QUIC流")
+	}
+	if q.startRead(nil, true) {
+		t.Fatal("会话结束后不应再启动读取QUIC流的goroutine")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+与中继服务器的连接保活和自动重连：中继服务器重启、NAT映射过期时，控制连接可能无声无息地断开，
+机器人随之无法被连接。
+
+1. 心跳：Agent每隔relayHeartbeatInterval向中继服务器发送一个ping请求，中继服务器同样定期向Agent发送ping。
+   超过relayIdleTimeout没有收到中继服务器的任何消息时，认为连接已断开，主动关闭连接。
+2. 重连：连接断开后，按照指数退避(relayBackoffMin到relayBackoffMax，带有随机抖动)反复重连，
+   重新完成hello、auth和register。uuid由身份密钥派生，重连后不变，对端仍可通过原来的uuid连接本机。
+3. 已建立的p2p连接不经过中继服务器，不受重连影响。WaitNotify在重连期间继续等待，不返回错误。
+*/
+
+// 向中继服务器发送心跳的间隔
+const relayHeartbeatInterval = 15 * time.Second
+
+// 超过该时间没有收到中继服务器的任何消息，即断开连接
+const relayIdleTimeout = 3 * relayHeartbeatInterval
+
+// 重连的退避时间范围
+const (
+	relayBackoffMin = time.Second
+	relayBackoffMax = 30 * time.Second
+)
+
+// 记录收到中继服务器消息的时间
+func (r *relayConn) touch() {
+	atomic.StoreInt64(&r.lastRecv, time.Now().UnixNano())
+}
+
+// 最近一次收到中继服务器消息距今的时间
+func (r *relayConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&r.lastRecv)))
+}
+
+// 每隔relayHeartbeatInterval发送一次心跳，中继服务器长时间无响应时关闭连接，直到连接断开或ctx被取消。
+// 发送心跳的goroutine记录在wg中，调用方需要保证heartbeatLoop本身也在wg中运行
+func (r *relayConn) heartbeatLoop(ctx context.Context, wg *sync.WaitGroup) {
+	ticker := time.NewTicker(relayHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if r.idle() > relayIdleTimeout {
+			fmt.Println("中继服务器心跳超时，断开连接")
+			r.conn.Close()
+			return
+		}
+		// 响应只用于更新lastRecv，不必等待。连接断开时call随之返回
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, relayIdleTimeout)
+			defer cancel()
+			r.call(ctx, protocol.MethodPing, struct{}{}, nil)
+		}()
+	}
+}
+
+// 当前与中继服务器的控制连接，尚未连接过时返回nil
+func (s *Agent) currentRelay() *relayConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.relay
+}
+
+// 控制连接r断开后自动重连，重连成功后继续监视新的连接，直到Agent关闭
+func (s *Agent) reconnectLoop(r *relayConn, relayAddr string) {
+	for {
+		select {
+		case <-r.done:
+		case <-s.closing():
+			return
+		}
+		fmt.Println("与中继服务器的连接已断开，开始重连:", r.err)
+
+		backoff := relayBackoffMin
+		for {
+			if !sleepUntil(s.ctx, time.Now().Add(backoff+jitter(backoff/4))) {
+				return
+			}
+			next, err := s.connectRelay(s.ctx, relayAddr)
+			if err == nil {
+				fmt.Println("重新连接中继服务器成功，uuid:", s.UUID)
+				r = next
+				break
+			}
+			if s.ctx.Err() != nil {
+				return
+			}
+			fmt.Println("重连中继服务器失败，", backoff, "后重试:", err.Error())
+			backoff *= 2
+			if backoff > relayBackoffMax {
+				backoff = relayBackoffMax
+			}
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// 中继服务器推送的、尚未被WaitNotify取走的通知的最大数量
+const notifyBuffer = 16
+
+var ErrRelayClosed = errors.New("与中继服务器的连接已断开")
+
+// 在InitAgent之前调用ConnectToRelay时返回该错误
+var ErrNotInitialized = errors.New("Agent尚未初始化，需要先调用InitAgent")
+
+// 未设置Controlling的Agent请求对端的地址时返回该错误
+var ErrNotControlling = errors.New("只有控制方可以请求对端的地址，需要在InitAgent之前设置Controlling")
+
+// 与中继服务器之间的一条控制连接
+type relayConn struct {
+	conn net.Conn
+	enc  *protocol.Encoder
+	dec  *protocol.Decoder
+
+	// 中继服务器确认的协议版本
+	version int
+
+	// hello响应中的随机挑战，register时对其签名
+	challenge []byte
+
+	// register响应中的绑定令牌，绑定请求携带它，中继服务器才会记录本机UDP端口的地址
+	bindingToken []byte
+
+	// 最近一次收到中继服务器消息的时间，UnixNano
+	lastRecv int64
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *protocol.Message
+
+	// 连接断开后关闭
+	done chan struct{}
+	err  error
+}
+
+func newRelayConn(conn net.Conn) *relayConn {
+	r := &relayConn{
+		conn:    conn,
+		enc:     protocol.NewEncoder(conn),
+		dec:     protocol.NewDecoder(conn),
+		pending: make(map[uint64]chan *protocol.Message),
+		done:    make(chan struct{}),
+	}
+	r.touch()
+	return r
+}
+
+// 发送请求并等待对应的响应，响应中的错误以*protocol.Error返回
+func (r *relayConn) call(ctx context.Context, method string, body interface{}, resp interface{}) error {
+	ch := make(chan *protocol.Message, 1)
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return r.err
+	}
+	r.nextID++
+	id := r.nextID
+	r.pending[id] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+
+	req, err := protocol.NewRequest(id, method, body)
+	if err != nil {
+		return err
+	}
+	if err := r.enc.Encode(req); err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if resp == nil {
+			return nil
+		}
+		return msg.DecodeBody(resp)
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 读取中继服务器发来的消息，将响应交给对应的请求，将通知放入notify，直到连接断开
+func (r *relayConn) readLoop(notify chan<- *protocol.Message) {
+	var err error
+	defer func() {
+		r.mu.Lock()
+		r.err = fmt.Errorf("%w: %v", ErrRelayClosed, err)
+		r.mu.Unlock()
+		close(r.done)
+		r.conn.Close()
+	}()
+
+	for {
+		msg := &protocol.Message{}
+		if err = r.dec.Decode(msg); err != nil {
+			fmt.Println("与中继服务器的连接断开:", err.Error())
+			return
+		}
+		r.touch()
+		switch msg.Kind {
+		case protocol.KindResponse:
+			r.mu.Lock()
+			ch := r.pending[msg.ID]
+			r.mu.Unlock()
+			if ch == nil {
+				fmt.Println("忽略没有对应请求的响应:", msg.Method, msg.ID)
+				continue
+			}
+			ch <- msg
+		case protocol.KindNotification:
+			select {
+			case notify <- msg:
+			default:
+				fmt.Println("通知过多，丢弃通知:", msg.Method)
+			}
+		case protocol.KindRequest:
+			if msg.Method == protocol.MethodPing {
+				// 中继服务器测量往返时延，回复空的响应
+				if resp, err := protocol.NewResponse(msg, struct{}{}); err == nil {
+					r.enc.Encode(resp)
+				}
+				continue
+			}
+			r.enc.Encode(protocol.NewErrorResponse(msg, protocol.ErrCodeUnknownMethod, msg.Method))
+		}
+	}
+}
+
+// 连接到中继服务器。成功后Agent在后台维持与中继服务器的连接，断开时自动重连并以同一uuid重新注册，见reconnect.go
+/*
+relayAddr:中继服务器的地址
+*/
+func (agent *Agent) ConnectToRelay(ctx context.Context, relayAddr string) error {
+	agent.relayAddr = relayAddr
+	r, err := agent.connectRelay(ctx, relayAddr)
+	if err != nil {
+		return err
+	}
+	agent.relayOnce.Do(func() {
+		agent.wg.Add(1)
+		go func() {
+			defer agent.wg.Done()
+			agent.reconnectLoop(r, relayAddr)
+		}()
+	})
+	return nil
+}
+
+// 与中继服务器建立一条控制连接，完成hello、auth和register，并启动该连接上的后台任务
+func (agent *Agent) connectRelay(ctx context.Context, relayAddr string) (r *relayConn, err error) {
+	if agent.ctx == nil {
+		return nil, ErrNotInitialized
+	}
+	// Agent关闭时中断连接过程
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(agent.ctx, cancel)
+	defer stop()
+
+	var serverConn net.Conn
+	d := &net.Dialer{
+		LocalAddr: &net.TCPAddr{
+			IP:   net.ParseIP("0.0.0.0"),
+			Port: agent.LocalPort,
+		},
+		Control: Control,
+	}
+	serverConn, err = agent.dialRelayConn(ctx, d, relayAddr)
+	if err != nil {
+		fmt.Println("连接失败:" + err.Error())
+		return nil, err
+	}
+	fmt.Println("请求远程服务器成功...")
+	r = newRelayConn(serverConn)
+	agent.wg.Add(1)
+	go func() {
+		defer agent.wg.Done()
+		r.readLoop(agent.notifyCh)
+	}()
+	defer func() {
+		if err != nil {
+			serverConn.Close()
+		}
+	}()
+
+	// 确认协议版本
+	var hello protocol.HelloResponse
+	err = r.call(ctx, protocol.MethodHello, &protocol.HelloRequest{Versions: []int{protocol.Version}}, &hello)
+	if err != nil {
+		fmt.Println("确认协议版本失败" + err.Error())
+		return nil, err
+	}
+	r.version = hello.Version
+	r.challenge = hello.Challenge
+
+	// 证明持有部署令牌
+	if agent.RelayToken != "" {
+		err = r.call(ctx, protocol.MethodAuth, &protocol.AuthRequest{Proof: protocol.TokenProof(agent.RelayToken, hello.Challenge)}, nil)
+		if err != nil {
+			fmt.Println("中继服务器认证失败" + err.Error())
+			return nil, err
+		}
+	}
+
+	// 发送host候选地址和对挑战的签名给中继服务器，获取uuid和本机的公网地址
+	id, localPubAddr, err := agent.register(ctx, r)
+	if err != nil {
+		fmt.Println("发送本机信息给中继服务器失败" + err.Error())
+		return nil, err
+	}
+	fmt.Println("uuid:", id, " pubAddr:", localPubAddr)
+	if id != agent.UUID {
+		return nil, fmt.Errorf("中继服务器回传的uuid与本机的id不一致: %s", id)
+	}
+	agent.mu.Lock()
+	agent.PubAddr = localPubAddr
+	agent.ServerConn = serverConn
+	agent.relay = r
+	agent.mu.Unlock()
+
+	// 定期发送心跳，中继服务器无响应时断开连接，由reconnectLoop重连
+	agent.wg.Add(1)
+	go func() {
+		defer agent.wg.Done()
+		r.heartbeatLoop(agent.ctx, &agent.wg)
+	}()
+
+	// 获取UDP端口的公网地址
+	if agent.udp != nil {
+		agent.bindUDP(ctx, r, relayAddr)
+	}
+
+	// 在后台探测本机的NAT类型
+	agent.wg.Add(1)
+	go func() {
+		defer agent.wg.Done()
+		agent.detectNAT(r, relayAddr)
+	}()
+	return r, nil
+}
+
+// 与中继服务器建立一条tcp连接，设置了RelayTLS时在其上完成TLS握手
+func (s *Agent) dialRelayConn(ctx context.Context, d *net.Dialer, relayAddr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", relayAddr)
+	if err != nil || s.RelayTLS == nil {
+		return conn, err
+	}
+	conf := s.RelayTLS
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName, _, _ = net.SplitHostPort(relayAddr)
+	}
+	tc := tls.Client(conn, conf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("与中继服务器的TLS握手失败: %w", err)
+	}
+	return tc, nil
+}
+
+// LoadRelayTLS 连接中继服务器时使用的TLS配置。caFile为校验中继服务器证书的CA，为空时使用系统的根证书；
+// certFile和keyFile为双向认证时本机出示的证书，为空表示不出示
+func LoadRelayTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("无法解析CA证书:" + caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// 将host候选地址、身份公钥和对挑战的签名发送给中继服务器，等待服务器回传我们的uuid和公网地址，并记录srflx候选地址
+func (s *Agent) register(ctx context.Context, r *relayConn) (uuid string, pubAddr string, err error) {
+	hosts := s.hostCandidates()
+	req := &protocol.RegisterRequest{
+		PublicKey:  s.identity.public(),
+		Signature:  ed25519.Sign(s.identity.key, protocol.RegisterSigningData(r.challenge)),
+		Candidates: hosts,
+		Instance:   s.Instance,
+	}
+	if s.Access != nil {
+		req.Access = s.Access.policy()
+	}
+	var resp protocol.RegisterResponse
+	if err := r.call(ctx, protocol.MethodRegister, req, &resp); err != nil {
+		return "", "", err
+	}
+	r.bindingToken = resp.BindingToken
+	cands := hosts
+	if resp.Srflx != nil {
+		cands = append(cands, *resp.Srflx)
+	}
+	protocol.SortCandidates(cands)
+	s.mu.Lock()
+	s.Candidates = cands
+	s.mu.Unlock()
+	return resp.UUID, resp.PubAddr, nil
+}
+
+// 向中继服务器请求目标uuid对应的地址，同时中继服务器会将本机的地址通知给目标节点。
+// 只有控制方可以请求，需要在InitAgent之前设置Controlling，否则返回ErrNotControlling；
+// 目标uuid不存在时，返回Code为protocol.ErrCodeUnknownPeer的*protocol.Error；
+// 目标uuid注册过但当前离线时，返回Code为protocol.ErrCodePeerOffline的*protocol.Error
+// 目标节点未授权本机时，返回Code为protocol.ErrCodeUnauthorized的*protocol.Error
+func (s *Agent) RequestForAddr(ctx context.Context, uuid string) (*protocol.PeerInfo, error) {
+	return s.requestForAddr(ctx, uuid, false)
+}
+
+func (s *Agent) requestForAddr(ctx context.Context, uuid string, pairing bool) (*protocol.PeerInfo, error) {
+	// 控制方在创建Agent时确定，这里只检查，不修改
+	if !s.Controlling {
+		return nil, ErrNotControlling
+	}
+	r := s.currentRelay()
+	if r == nil {
+		return nil, ErrRelayClosed
+	}
+	// 本机为对称型NAT时，重新预测端口，使对端拿到的预测尽量新
+	if err := s.updatePrediction(ctx, r); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		fmt.Println("上报端口预测失败:", err.Error())
+	}
+	var info protocol.PeerInfo
+	if err := r.call(ctx, protocol.MethodExchangeInfo, &protocol.ExchangeInfoRequest{TargetUUID: uuid, Pairing: pairing}, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// WaitNotify 等待远程服务器发送通知告知我们另一个用户的候选地址。
+// 与中继服务器的连接断开后继续等待重连后的通知，只在ctx被取消或Agent关闭时返回错误
+func (s *Agent) WaitNotify(ctx context.Context) (*protocol.PeerInfo, error) {
+	if s.currentRelay() == nil {
+		return nil, ErrRelayClosed
+	}
+	for {
+		select {
+		case msg := <-s.notifyCh:
+			if msg.Method != protocol.NotifyPeerInfo {
+				fmt.Println("忽略未知的通知:", msg.Method)
+				continue
+			}
+			var info protocol.PeerInfo
+			if err := msg.DecodeBody(&info); err != nil {
+				return nil, fmt.Errorf("获取用户信息失败: %w", err)
+			}
+			return &info, nil
+		case <-s.closing():
+			return nil, ErrRelayClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/*
+会话恢复：p2p连接意外断开(底层连接中断、心跳超时)时，不立即关闭Mux和其上的流，而是暂停会话，
+由控制方重新交换地址、建立连接，在新连接上恢复会话，短暂的网络中断不会丢失数据。
+
+1. 数据帧和流控制帧为可靠帧，在会话内按发送顺序隐式编号，双方各自记录已发送和已收到的可靠帧的数量。
+   发送方将已发送的可靠帧保存在重放缓冲区中，接收方每收到ackEvery个可靠帧、以及每次发送心跳时，
+   用TypeAck帧确认已收到的数量，发送方据此释放缓冲区。
+2. 连接意外断开后，双方暂停会话，发布EventPeerSuspended。控制方按指数退避反复请求对端的地址并建立连接，
+   被控制方照常在WaitNotify之后调用DailP2P。
+3. 新连接完成授权后，控制方发送TypeResume帧，包体为会话id和已收到的可靠帧数量，开始新的会话时为新生成的会话id。
+   被控制方找到同一对端的同一会话时，以带有FlagResume的TypeResume帧回复自己已收到的数量；
+   此时被控制方可能尚未发现旧连接已断开，会先断开旧连接。否则回复不带FlagResume的TypeResume帧，开始新的会话。
+4. 恢复时双方从重放缓冲区中重发对端尚未收到的可靠帧，之后继续读写新连接。
+   Mux和其上的流保持不变，发布EventPeerResumed。
+5. 暂停超过resumeTimeout，或因重放缓冲区超过replayLimit、使用QUIC、迁移过程中断开而无法恢复时，
+   会话结束，发布EventPeerDisconnected。控制方仍继续重连，成功后开始新的会话，发布EventPeerConnected。
+   连接正常时重放缓冲区超过replayLimit(例如对端读取缓慢时的大量传输)，缓冲区被清空，只继续计数，
+   对端确认收到已发送的全部可靠帧后恢复缓冲；会话暂停期间缓冲区将要超过replayLimit时，写入返回ErrReplayFull。
+6. 对端发送TypeClose帧、本端调用CloseP2P主动关闭，或对端拒绝授权时，不恢复也不重连。
+*/
+
+// 暂停的会话等待恢复的最长时间
+const resumeTimeout = 60 * time.Second
+
+// 重放缓冲区的上限，超过后会话无法再恢复
+const replayLimit = 16 * 1024 * 1024
+
+// 会话暂停期间重放缓冲区已满，无法再写入
+var ErrReplayFull = errors.New("p2p连接已断开，重放缓冲区已满")
+
+// 每收到该数量的可靠帧确认一次
+const ackEvery = 64
+
+// 控制方重连对端的退避时间范围
+const (
+	redialBackoffMin = time.Second
+	redialBackoffMax = 30 * time.Second
+)
+
+// 会话的状态
+type sessionState int
+
+const (
+	// 连接正常
+	sessionActive sessionState = iota
+
+	// 连接意外断开，等待恢复
+	sessionSuspended
+
+	// 已在新连接上协商恢复，等待重发完成
+	sessionResuming
+
+	// 会话已结束
+	sessionEnded
+)
+
+// 写入一个可靠帧：编号并保存到重放缓冲区后写入当前连接，调用方持有wmu。
+// 连接已断开、但会话可以恢复时不返回错误，该帧在恢复后重发；会话暂停期间缓冲区已满时返回ErrReplayFull
+func (l *p2pLink) writeReliable(f *frame.Frame) error {
+	// QUIC连接上的流由QUIC保证可靠，不参与会话恢复
+	if l.streams != nil {
+		return l.writer.WriteFrame(f)
+	}
+	if max := l.writer.MaxSize; max > 0 && len(f.Payload) > max {
+		return &frame.SizeError{Size: len(f.Payload), Max: max}
+	}
+
+	l.mu.Lock()
+	if l.state == sessionEnded {
+		l.mu.Unlock()
+		return ErrMuxClosed
+	}
+	size := frame.HeaderSize + len(f.Payload)
+	if (l.state == sessionSuspended || l.state == sessionResuming) && l.replayBytes+size > replayLimit {
+		// 继续缓冲会使会话无法恢复，不如让调用方知道连接已断开
+		l.mu.Unlock()
+		return ErrReplayFull
+	}
+	if !l.overflow {
+		if f.Type == frame.TypeData {
+			// 调用方可能复用包体
+			f = &frame.Frame{Type: f.Type, Flags: f.Flags, Payload: append([]byte(nil), f.Payload...)}
+		}
+		l.replay = append(l.replay, f)
+		l.replayBytes += size
+		if l.replayBytes > replayLimit {
+			fmt.Println("重放缓冲区已满，对端确认收到全部数据之前，连接断开后将无法恢复会话")
+			l.overflow = true
+			l.replay = nil
+			l.replayBytes = 0
+		}
+	}
+	overflow := l.overflow
+	l.sent++
+	l.mu.Unlock()
+
+	if err := l.writer.WriteFrame(f); err != nil && overflow {
+		return err
+	}
+	return nil
+}
+
+// 对端确认已收到n个可靠帧，释放重放缓冲区。由p2pRead调用，不等待wmu，以免阻塞在其他goroutine的写入上
+func (l *p2pLink) onAck(n uint64) {
+	l.trim(n)
+}
+
+// 丢弃对端已收到的可靠帧
+func (l *p2pLink) trim(n uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.overflow {
+		// 对端收到了已发送的全部可靠帧，空的缓冲区重新与对端一致，会话可以再次恢复
+		if n >= l.sent {
+			l.overflow = false
+			l.peerAcked = n
+		}
+		return
+	}
+	if n <= l.peerAcked {
+		return
+	}
+	drop := int(n - l.peerAcked)
+	if drop > len(l.replay) {
+		drop = len(l.replay)
+	}
+	for i, f := range l.replay[:drop] {
+		l.replayBytes -= frame.HeaderSize + len(f.Payload)
+		l.replay[i] = nil
+	}
+	l.replay = l.replay[drop:]
+	l.peerAcked += uint64(drop)
+}
+
+// 会话暂停时关闭的通道
+func (l *p2pLink) lostCh() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// 会话是否暂停，包括正在恢复
+func (l *p2pLink) isSuspended() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state == sessionSuspended || l.state == sessionResuming
+}
+
+// 本端主动关闭会话，之后不再恢复
+func (l *p2pLink) stopWith(reason CloseReason) {
+	l.stopOnce.Do(func() {
+		l.stopReason = reason
+		close(l.stop)
+	})
+}
+
+// 不通知对端，直接断开当前连接，会话随之暂停
+func (l *p2pLink) drop(cause CloseReason) {
+	l.mu.Lock()
+	l.lostCause = &cause
+	conn := l.conn
+	l.mu.Unlock()
+	conn.Close()
+}
+
+// 连接意外断开后暂停会话，等待在新连接上恢复。返回恢复后的新连接，会话结束时返回nil，cause为结束的原因
+func (s *Agent) suspend(l *p2pLink, remoteAddr string, cause *CloseReason) *checkedConn {
+	// 连接可能只是读取出错，关闭后阻塞在写入上的goroutine随之返回
+	l.currentConn().Close()
+
+	l.mu.Lock()
+	if l.lostCause != nil {
+		*cause = *l.lostCause
+		l.lostCause = nil
+	}
+	select {
+	case <-l.stop:
+		l.mu.Unlock()
+		*cause = l.stopReason
+		return nil
+	default:
+	}
+	if s.ctx.Err() != nil {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.streams != nil || l.overflow || atomic.LoadInt32(&l.draining) != 0 {
+		// 无法恢复会话，控制方直接重连
+		l.mu.Unlock()
+		if s.Controlling {
+			s.startRedial(l.peer)
+		}
+		return nil
+	}
+	l.state = sessionSuspended
+	close(l.lost)
+	l.mu.Unlock()
+
+	fmt.Println("p2p连接意外断开，等待恢复会话:", cause.Reason)
+	s.publish(Event{Type: EventPeerSuspended, Peer: l.peer, RemoteAddr: remoteAddr, Cause: *cause})
+	if s.Controlling {
+		s.startRedial(l.peer)
+	}
+
+	timer := time.NewTimer(resumeTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case c := <-l.resumed:
+			if c == nil {
+				cause.Reason = "恢复会话失败"
+				return nil
+			}
+			l.mu.Lock()
+			l.state = sessionActive
+			l.lost = make(chan struct{})
+			l.mu.Unlock()
+			l.touch()
+			fmt.Println("p2p会话已恢复:", c.pair)
+			s.publish(Event{Type: EventPeerResumed, Peer: l.peer, RemoteAddr: c.conn.RemoteAddr().String(), Mux: l.mux, Pair: c.pair})
+			return c
+		case <-timer.C:
+			l.mu.Lock()
+			if l.state == sessionSuspended {
+				l.state = sessionEnded
+				l.mu.Unlock()
+				cause.Reason = "等待恢复会话超时"
+				return nil
+			}
+			// 已在新连接上协商恢复，等待重发完成
+			l.mu.Unlock()
+		case <-l.stop:
+			*cause = l.stopReason
+			return nil
+		case <-s.closing():
+			return nil
+		}
+	}
+}
+
+// 开始恢复暂停中的会话。对端已收到的可靠帧数量peerReceived必须仍在重放缓冲区的范围内
+func (l *p2pLink) claim(peerReceived uint64) bool {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state != sessionSuspended || l.overflow {
+		return false
+	}
+	if peerReceived < l.peerAcked || peerReceived > l.sent {
+		return false
+	}
+	l.state = sessionResuming
+	return true
+}
+
+// 放弃恢复会话，继续等待
+func (l *p2pLink) unclaim() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state == sessionResuming {
+		l.state = sessionSuspended
+	}
+}
+
+// 在新连接上恢复会话：交给p2pRead继续读取，同时重发对端尚未收到的可靠帧。会话已结束时返回false。
+// 先开始读取，以免双方同时重发大量的帧时都阻塞在写入上；重发完成之前其他的帧等待wmu，不会插到重发的帧之前
+func (l *p2pLink) resume(c *checkedConn, peerReceived uint64) bool {
+	l.wmu.Lock()
+	l.trim(peerReceived)
+	l.mu.Lock()
+	if l.state != sessionResuming {
+		l.mu.Unlock()
+		l.wmu.Unlock()
+		return false
+	}
+	l.conn = c.conn
+	l.pair = c.pair
+	// 重发期间对端的确认会修改缓冲区
+	replay := append([]*frame.Frame(nil), l.replay...)
+	l.mu.Unlock()
+
+	l.writer = c.writer
+	l.resumed <- c
+	for _, f := range replay {
+		// 新连接也断开时，p2pRead会再次暂停会话
+		if err := l.writer.WriteFrame(f); err != nil {
+			break
+		}
+	}
+	l.wmu.Unlock()
+	return true
+}
+
+// 与对端peer之间暂停中的会话，没有时返回nil
+func (s *Agent) suspendedLink(peer string) *p2pLink {
+	l := s.linkTo(peer)
+	if l == nil || !l.isSuspended() {
+		return nil
+	}
+	return l
+}
+
+// 被控制方与对端peer之间的会话session，对端请求恢复时本端可能尚未发现旧连接已断开，此时断开旧连接并等待会话暂停。
+// 没有该会话或会话已结束时返回nil
+func (s *Agent) sessionToResume(peer string, session []byte) *p2pLink {
+	l := s.linkTo(peer)
+	if l == nil || !bytes.Equal(l.session, session) {
+		return nil
+	}
+	l.mu.Lock()
+	state, lost := l.state, l.lost
+	l.mu.Unlock()
+	if state != sessionActive {
+		return l
+	}
+	l.drop(CloseReason{Code: frame.CloseConnLost, Reason: "对端在新连接上请求恢复会话"})
+	timer := time.NewTimer(checkTimeout / 2)
+	defer timer.Stop()
+	select {
+	case <-lost:
+		return l
+	case <-l.done:
+	case <-timer.C:
+	}
+	return nil
+}
+
+// 在选出的连接上协商会话：恢复与对端之间暂停中的会话时返回该会话和对端已收到的可靠帧数量，
+// 开始新的会话时返回nil和新的会话id
+func (s *Agent) negotiateSession(ctx context.Context, c *checkedConn, peerUUID string) (*p2pLink, uint64, []byte, error) {
+	stop := interruptOnDone(ctx, c.conn)
+	defer stop()
+	c.conn.SetDeadline(time.Now().Add(checkTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if s.Controlling {
+		var l *p2pLink
+		var session []byte
+		var received uint64
+		if c.quic == nil {
+			l = s.suspendedLink(peerUUID)
+		}
+		if l != nil {
+			session, received = l.session, atomic.LoadUint64(&l.received)
+		} else {
+			session = make([]byte, frame.SessionIDSize)
+			if _, err := rand.Read(session); err != nil {
+				return nil, 0, nil, err
+			}
+		}
+		if err := c.writer.WriteFrame(frame.NewResume(session, received, l != nil)); err != nil {
+			return nil, 0, nil, err
+		}
+		f, err := c.reader.ReadFrame()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if f.Type != frame.TypeResume {
+			return nil, 0, nil, fmt.Errorf("预期收到%s帧，实际收到%s帧", frame.TypeResume, f.Type)
+		}
+		id, peerReceived, err := frame.ParseResume(f)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if !bytes.Equal(id, session) {
+			return nil, 0, nil, errors.New("对端回复的会话id不一致")
+		}
+		if l == nil || f.Flags&frame.FlagResume == 0 {
+			return nil, 0, session, nil
+		}
+		if !l.claim(peerReceived) {
+			return nil, 0, nil, errors.New("会话已无法恢复")
+		}
+		return l, peerReceived, session, nil
+	}
+
+	f, err := c.reader.ReadFrame()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if f.Type != frame.TypeResume {
+		return nil, 0, nil, fmt.Errorf("预期收到%s帧，实际收到%s帧", frame.TypeResume, f.Type)
+	}
+	session, peerReceived, err := frame.ParseResume(f)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	session = append([]byte(nil), session...)
+	if f.Flags&frame.FlagResume != 0 && c.quic == nil {
+		if l := s.sessionToResume(peerUUID, session); l != nil && l.claim(peerReceived) {
+			received := atomic.LoadUint64(&l.received)
+			if err := c.writer.WriteFrame(frame.NewResume(session, received, true)); err != nil {
+				l.unclaim()
+				return nil, 0, nil, err
+			}
+			return l, peerReceived, session, nil
+		}
+	}
+	if err := c.writer.WriteFrame(frame.NewResume(session, 0, false)); err != nil {
+		return nil, 0, nil, err
+	}
+	return nil, 0, session, nil
+}
+
+// 控制方在后台重连对端peer，之前的重连随之停止
+func (s *Agent) startRedial(peer string) {
+	s.mu.Lock()
+	if s.redialCancel != nil {
+		s.redialCancel()
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.redialCancel = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		s.redial(ctx, peer)
+	}()
+}
+
+// 停止进行中的重连
+func (s *Agent) stopRedial() {
+	s.mu.Lock()
+	cancel := s.redialCancel
+	s.redialCancel = nil
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// 反复请求对端的地址并建立连接，直到恢复会话或开始新的会话、对端拒绝授权，或ctx被取消
+func (s *Agent) redial(ctx context.Context, peer string) {
+	backoff := redialBackoffMin
+	for {
+		if !sleepUntil(ctx, time.Now().Add(backoff+jitter(backoff/4))) {
+			return
+		}
+		info, err := s.requestForAddr(ctx, peer, false)
+		if err == nil {
+			_, err = s.dial(ctx, info)
+			if err == nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		var protoErr *protocol.Error
+		if errors.Is(err, ErrUnauthorized) || (errors.As(err, &protoErr) && protoErr.Code == protocol.ErrCodeUnauthorized) {
+			fmt.Println("对端拒绝了连接，停止重连:", err.Error())
+			if l := s.suspendedLink(peer); l != nil {
+				l.close(frame.CloseUnauthorized, err.Error())
+			}
+			return
+		}
+		fmt.Println("重连对端失败，", backoff, "后重试:", err.Error())
+		backoff *= 2
+		if backoff > redialBackoffMax {
+			backoff = redialBackoffMax
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 在net.Pipe的一端上创建p2p连接，另一端读到的帧发送到返回的通道中
+func pipeLink(t *testing.T) (*p2pLink, <-chan *frame.Frame) {
+	t.Helper()
+	a, b := net.Pipe()
+	l := newP2PLink(context.Background(), &checkedConn{conn: a, reader: frame.NewReader(a), writer: frame.NewWriter(a)}, true, &sync.WaitGroup{})
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return l, readFrames(b)
+}
+
+// 持续读取conn上的帧，直到连接关闭
+func readFrames(conn net.Conn) <-chan *frame.Frame {
+	ch := make(chan *frame.Frame, 1024)
+	go func() {
+		defer close(ch)
+		r := frame.NewReader(conn)
+		for {
+			f, err := r.ReadFrame()
+			if err != nil {
+				return
+			}
+			ch <- f
+		}
+	}()
+	return ch
+}
+
+func dataFrame(i int) *frame.Frame {
+	return &frame.Frame{Type: frame.TypeData, Payload: []byte(fmt.Sprintf("frame-%d", i))}
+}
+
+// 依次写入n个可靠帧，并确认对端收到了它们
+func writeN(t *testing.T, l *p2pLink, frames <-chan *frame.Frame, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if err := l.writeFrame(dataFrame(i)); err != nil {
+			t.Fatalf("写入第%d帧失败: %v", i, err)
+		}
+		f := <-frames
+		if want := dataFrame(i).Payload; !bytes.Equal(f.Payload, want) {
+			t.Fatalf("对端收到%q，预期%q", f.Payload, want)
+		}
+	}
+}
+
+func TestReplayTrim(t *testing.T) {
+	tests := []struct {
+		name      string
+		acks      []uint64
+		wantAcked uint64
+		wantLeft  int
+	}{
+		{name: "未确认", acks: nil, wantAcked: 0, wantLeft: 10},
+		{name: "部分确认", acks: []uint64{4}, wantAcked: 4, wantLeft: 6},
+		{name: "依次确认", acks: []uint64{3, 7}, wantAcked: 7, wantLeft: 3},
+		{name: "重复和过期的确认", acks: []uint64{5, 5, 2}, wantAcked: 5, wantLeft: 5},
+		{name: "全部确认", acks: []uint64{10}, wantAcked: 10, wantLeft: 0},
+		{name: "超过已发送的数量", acks: []uint64{20}, wantAcked: 10, wantLeft: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, frames := pipeLink(t)
+			writeN(t, l, frames, 0, 10)
+			for _, n := range tt.acks {
+				l.onAck(n)
+			}
+			if l.peerAcked != tt.wantAcked || len(l.replay) != tt.wantLeft {
+				t.Fatalf("peerAcked=%d 剩余%d帧，预期%d和%d帧", l.peerAcked, len(l.replay), tt.wantAcked, tt.wantLeft)
+			}
+			if tt.wantLeft > 0 && !bytes.Equal(l.replay[0].Payload, dataFrame(int(tt.wantAcked)).Payload) {
+				t.Fatalf("缓冲区的第一帧为%q", l.replay[0].Payload)
+			}
+			want := 0
+			for _, f := range l.replay {
+				want += frame.HeaderSize + len(f.Payload)
+			}
+			if l.replayBytes != want {
+				t.Fatalf("replayBytes=%d，预期%d", l.replayBytes, want)
+			}
+		})
+	}
+}
+
+// 其他goroutine阻塞在写入上时，p2pRead仍能处理确认
+func TestAckWhileWriteBlocked(t *testing.T) {
+	l, frames := pipeLink(t)
+	writeN(t, l, frames, 0, 3)
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	acked := make(chan struct{})
+	go func() {
+		l.onAck(2)
+		close(acked)
+	}()
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("持有wmu时处理确认被阻塞")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peerAcked != 2 || len(l.replay) != 1 {
+		t.Fatalf("peerAcked=%d 缓冲区%d帧", l.peerAcked, len(l.replay))
+	}
+}
+
+func TestReplayKeepsPayload(t *testing.T) {
+	l, frames := pipeLink(t)
+	buf := []byte("original")
+	if err := l.writeFrame(&frame.Frame{Type: frame.TypeData, Payload: buf}); err != nil {
+		t.Fatal(err)
+	}
+	<-frames
+	copy(buf, "modified")
+	if got := string(l.replay[0].Payload); got != "original" {
+		t.Fatalf("调用方复用包体后缓冲区中的帧变为%q", got)
+	}
+}
+
+func TestReplayOverflowRecovers(t *testing.T) {
+	l, frames := pipeLink(t)
+	go func() {
+		for range frames {
+		}
+	}()
+	big := &frame.Frame{Type: frame.TypeData, Payload: make([]byte, 1024*1024)}
+	n := replayLimit/len(big.Payload) + 1
+	for i := 0; i < n; i++ {
+		if err := l.writeFrame(big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !l.overflow || len(l.replay) != 0 {
+		t.Fatalf("超过replayLimit后overflow=%v 缓冲区%d帧", l.overflow, len(l.replay))
+	}
+
+	// 对端只确认了一部分时仍无法恢复
+	l.onAck(uint64(n - 1))
+	if !l.overflow {
+		t.Fatal("对端尚未收到全部帧时overflow被清除")
+	}
+	if l.claim(uint64(n-1)) || l.state != sessionActive {
+		t.Fatal("overflow时不应能恢复会话")
+	}
+
+	// 对端收到全部帧后重新开始缓冲
+	l.onAck(uint64(n))
+	if l.overflow || l.peerAcked != uint64(n) {
+		t.Fatalf("对端确认全部帧后overflow=%v peerAcked=%d", l.overflow, l.peerAcked)
+	}
+	if err := l.writeFrame(dataFrame(0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.replay) != 1 || l.sent != uint64(n+1) {
+		t.Fatalf("缓冲区%d帧 sent=%d", len(l.replay), l.sent)
+	}
+}
+
+func TestReplayFullWhileSuspended(t *testing.T) {
+	l, frames := pipeLink(t)
+	writeN(t, l, frames, 0, 3)
+	l.mu.Lock()
+	l.state = sessionSuspended
+	l.replayBytes = replayLimit - frame.HeaderSize
+	l.mu.Unlock()
+	l.currentConn().Close()
+
+	if err := l.writeFrame(dataFrame(3)); !errors.Is(err, ErrReplayFull) {
+		t.Fatalf("缓冲区已满时返回%v，预期ErrReplayFull", err)
+	}
+	if l.sent != 3 || len(l.replay) != 3 || l.overflow {
+		t.Fatalf("被拒绝的帧不应计数: sent=%d 缓冲区%d帧 overflow=%v", l.sent, len(l.replay), l.overflow)
+	}
+
+	// 缓冲区未满时，连接已断开也不返回错误，该帧在恢复后重发
+	l.mu.Lock()
+	l.replayBytes = 0
+	l.mu.Unlock()
+	if err := l.writeFrame(dataFrame(3)); err != nil {
+		t.Fatalf("会话可以恢复时写入返回%v", err)
+	}
+	if l.sent != 4 || len(l.replay) != 4 {
+		t.Fatalf("sent=%d 缓冲区%d帧", l.sent, len(l.replay))
+	}
+}
+
+func TestResumeOverPipe(t *testing.T) {
+	l, frames := pipeLink(t)
+	writeN(t, l, frames, 0, 5)
+	l.onAck(2)
+
+	// 连接断开，会话暂停期间继续写入
+	l.mu.Lock()
+	l.state = sessionSuspended
+	l.mu.Unlock()
+	l.currentConn().Close()
+	for i := 5; i < 7; i++ {
+		if err := l.writeFrame(dataFrame(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 对端只收到了前3帧：已确认的之前的帧无法重发，超过已发送数量的也不行
+	if l.claim(1) || l.claim(8) {
+		t.Fatal("对端已收到的数量超出缓冲区的范围时不应能恢复")
+	}
+	if !l.claim(3) {
+		t.Fatal("无法恢复会话")
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	got := readFrames(b)
+	c := &checkedConn{conn: a, reader: frame.NewReader(a), writer: frame.NewWriter(a)}
+	if !l.resume(c, 3) {
+		t.Fatal("resume返回false")
+	}
+	if <-l.resumed != c {
+		t.Fatal("新连接没有交给p2pRead")
+	}
+	for i := 3; i < 7; i++ {
+		f := <-got
+		if want := dataFrame(i).Payload; !bytes.Equal(f.Payload, want) {
+			t.Fatalf("重发的帧为%q，预期%q", f.Payload, want)
+		}
+	}
+	if l.peerAcked != 3 || len(l.replay) != 4 {
+		t.Fatalf("恢复后peerAcked=%d 缓冲区%d帧", l.peerAcked, len(l.replay))
+	}
+
+	// 恢复后的写入使用新连接
+	l.mu.Lock()
+	l.state = sessionActive
+	l.mu.Unlock()
+	writeN(t, l, got, 7, 1)
+}
+
+func TestResumeEndedSession(t *testing.T) {
+	l, frames := pipeLink(t)
+	writeN(t, l, frames, 0, 2)
+	l.mu.Lock()
+	l.state = sessionEnded
+	l.mu.Unlock()
+	if l.claim(0) {
+		t.Fatal("会话结束后不应能恢复")
+	}
+	if err := l.writeFrame(dataFrame(2)); !errors.Is(err, ErrMuxClosed) {
+		t.Fatalf("会话结束后写入返回%v", err)
+	}
+}
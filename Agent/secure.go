@@ -0,0 +1,81 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+/*
+端到端加密：连通性检查选出连接后，双方在该连接上进行TLS 1.3握手，之后的帧都经过TLS加密和认证。
+
+1. 控制方作为TLS客户端，被控制方作为服务端，双方都出示由身份密钥签名的证书(见identity.go)。
+2. 证书不经过CA校验，而是检查其中的公钥派生的id是否为对端的uuid，中继服务器只转发地址和密文，无法冒充任一方。
+3. 使用QUIC时，QUIC握手本身即为TLS 1.3，直接在其中出示和校验同样的证书，不再叠加一层TLS。
+4. 连接迁移时，新连接同样先完成握手再迁移过去。
+*/
+
+// 在选出的连接上完成TLS握手，之后连接上的帧都经过加密
+func (s *Agent) secure(ctx context.Context, c *checkedConn, peerUUID string) error {
+	if c.quic != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	// 被控制方读取TypeNominate帧时，可能已将控制方的握手数据读入了缓冲区
+	raw := &bufferedConn{Conn: c.conn, r: c.reader.Buffered()}
+	conf := s.tlsConfig(peerUUID)
+	var tc *tls.Conn
+	if s.Controlling {
+		tc = tls.Client(raw, conf)
+	} else {
+		tc = tls.Server(raw, conf)
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS握手失败: %w", err)
+	}
+	c.conn = tc
+	c.reader = frame.NewReader(tc)
+	c.writer = frame.NewWriter(tc)
+	return nil
+}
+
+// p2p连接上的TLS配置，双方都出示并校验身份证书
+func (s *Agent) tlsConfig(peerUUID string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{s.identity.cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// 证书不经过CA校验，由VerifyPeerCertificate按对端的身份校验
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeerCert(peerUUID, rawCerts)
+		},
+	}
+}
+
+// 校验对端证书中的公钥派生的id是否为对端的uuid
+func verifyPeerCert(peerUUID string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("对端没有出示证书")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return errors.New("对端的证书不是ed25519公钥")
+	}
+	// 对端持有该公钥对应的私钥，已由TLS握手中的CertificateVerify保证
+	if id := protocol.PeerID(pub); id != peerUUID {
+		return fmt.Errorf("对端%s出示的身份公钥与其id不一致，可能受到了中间人攻击。公钥对应的id:%s", peerUUID, id)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+中继转发：所有直连路径都失败时，由中继服务器转发双方之间的数据，类似TURN。
+
+1. 交换地址信息时，中继服务器为双方分配同一个转发会话(PeerInfo.Relay)。
+2. 打洞时刻之后relayDelay，直连仍未成功，双方各自与中继服务器建立一条新的tcp连接(与控制连接一样使用TLS和令牌)，
+   完成hello和auth后发送relay请求。中继服务器等到双方都到达后回复relay响应，之后在两条连接之间原样转发字节流。
+3. 转发连接上的连通性检查、帧格式、心跳和流多路复用与tcp直连完全相同，对localAgent和rosAgent透明。
+*/
+
+// 打洞时刻之后，等待多久开始尝试中继转发。在此之前直连成功则不会使用中继服务器
+const relayDelay = 6 * time.Second
+
+// 等待中继服务器响应relay请求的最长时间，包括等待对端到达
+const relayTimeout = 20 * time.Second
+
+// 从start开始，通过中继服务器转发连接对端，只尝试一次
+func (s *Agent) checkRelay(ctx context.Context, start time.Time, peer *protocol.PeerInfo, results chan<- *checkedConn) {
+	if !sleepUntil(ctx, start) {
+		return
+	}
+	fmt.Println("直连尚未成功，尝试通过中继服务器转发")
+	conn, err := s.dialRelay(ctx, peer.Relay.Token)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Println("连接中继转发失败:", err.Error())
+		}
+		return
+	}
+	c, err := s.handshake(ctx, conn, peer.UUID)
+	if err != nil {
+		fmt.Println("中继转发的连通性检查失败:", err.Error())
+		conn.Close()
+		return
+	}
+	c.pair = s.relayPair(conn)
+	deliver(ctx, results, c)
+}
+
+// 与中继服务器建立一条转发连接，返回的连接上的字节流由中继服务器原样转发给对端
+func (s *Agent) dialRelay(ctx context.Context, token string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	conn, err := s.dialRelayConn(ctx, d, s.relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := interruptOnDone(ctx, conn)
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	enc, dec := protocol.NewEncoder(conn), protocol.NewDecoder(conn)
+	var hello protocol.HelloResponse
+	err = roundTrip(enc, dec, 1, protocol.MethodHello, &protocol.HelloRequest{Versions: []int{protocol.Version}}, &hello)
+	if err == nil && s.RelayToken != "" {
+		err = roundTrip(enc, dec, 2, protocol.MethodAuth, &protocol.AuthRequest{Proof: protocol.TokenProof(s.RelayToken, hello.Challenge)}, nil)
+	}
+	if err == nil {
+		err = roundTrip(enc, dec, 3, protocol.MethodRelay, &protocol.RelayRequest{Token: token, UUID: s.UUID}, nil)
+	}
+	stop()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	// relay响应之后的数据可能已被读入解码器的缓冲区
+	return &bufferedConn{Conn: conn, r: dec.Reader()}, nil
+}
+
+// 在尚未启动读取的连接上发送一个请求，并读取对应的响应
+func roundTrip(enc *protocol.Encoder, dec *protocol.Decoder, id uint64, method string, body interface{}, resp interface{}) error {
+	req, err := protocol.NewRequest(id, method, body)
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(req); err != nil {
+		return err
+	}
+	for {
+		var msg protocol.Message
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Kind != protocol.KindResponse || msg.ID != id {
+			continue
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if resp == nil {
+			return nil
+		}
+		return msg.DecodeBody(resp)
+	}
+}
+
+// 经过中继服务器转发的路径，双方的候选地址都是中继服务器
+func (s *Agent) relayPair(conn net.Conn) *CandidatePair {
+	network := "tcp4"
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		network = protocol.NetworkOf(addr.IP)
+	}
+	return &CandidatePair{
+		Local:  protocol.Candidate{Type: protocol.CandidateRelay, Network: network, Address: conn.LocalAddr().String()},
+		Remote: protocol.Candidate{Type: protocol.CandidateRelay, Network: network, Address: conn.RemoteAddr().String()},
+	}
+}
+
+// Relayed 该路径是否经过中继服务器转发
+func (p *CandidatePair) Relayed() bool {
+	return p.Local.Type == protocol.CandidateRelay
+}
+
+// Relayed 当前的p2p连接是否经过中继服务器转发，尚未建立连接时返回false
+func (s *Agent) Relayed() bool {
+	l := s.currentLink()
+	if l == nil {
+		return false
+	}
+	p := l.path()
+	return p != nil && p.Relayed()
+}
@@ -0,0 +1,410 @@
+package agent
+
+import (
+	protocol "P2PAgent/Protocol"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+/*
+UDP传输：Agent在LocalPort上同时监听一个UDP端口，用于tcp打洞失败时的udp打洞。
+
+UDP端口上的报文分为两类：以protocol.PacketMagic开头的控制报文（绑定请求、连通性检查），
+以及p2p连接上的kcp或QUIC报文。kcp在UDP之上提供可靠、有序的字节流，p2p连接的帧格式、心跳和流多路复用与tcp完全相同；
+QUIC见quic.go。
+*/
+
+// UDP报文的读取缓冲区大小，大于kcp的MTU
+const udpBufferSize = 1500
+
+// 每个对端地址上尚未被kcp读取的报文的最大数量，超过后丢弃，由kcp重传
+const udpQueueSize = 1024
+
+// 等待中继服务器响应绑定请求的时间
+const bindingTimeout = 500 * time.Millisecond
+
+// 绑定请求的重试次数
+const bindingRetries = 3
+
+// 定期发送绑定请求的间隔，用于保持NAT映射
+const bindingInterval = 20 * time.Second
+
+// kcp的收发窗口大小，单位为报文个数
+const kcpWindow = 1024
+
+// Agent的UDP端口，将收到的报文分发给绑定请求、连通性检查和kcp会话
+type udpSocket struct {
+	conn *net.UDPConn
+
+	// 中继服务器对绑定请求的响应
+	binding chan *udpBinding
+
+	// 同一时刻只进行一个绑定请求，使响应与请求对应
+	bindMu sync.Mutex
+
+	mu sync.Mutex
+
+	// 正在进行的连通性检查，键为对端的uuid。与多个对端的检查(包括后台的升级)可以同时进行
+	checkers map[string]*udpChecker
+
+	// 最近一次接受的各个对端的选中请求，键为对端的uuid。连通性检查结束后仍需确认控制方重发的选中报文
+	nominated map[string]*udpNomination
+
+	// 与对端之间的kcp会话或QUIC连接所使用的报文通道，键为对端地址
+	peers map[string]*udpPeerConn
+}
+
+// 中继服务器对绑定请求的响应
+type udpBinding struct {
+	// 本机UDP端口在公网上的映射地址
+	mapped *net.UDPAddr
+
+	// 中继服务器的备用地址，为空表示没有
+	other string
+
+	// 响应的来源地址
+	from *net.UDPAddr
+}
+
+var errBindingTimeout = errors.New("中继服务器未响应UDP绑定请求")
+
+// 被控制方接受的选中请求
+type udpNomination struct {
+	addr string
+	conv uint32
+
+	// 已编码好的确认报文
+	ack []byte
+}
+
+func newUDPSocket(port int) (*udpSocket, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return &udpSocket{
+		conn:      conn,
+		binding:   make(chan *udpBinding, 1),
+		checkers:  make(map[string]*udpChecker),
+		nominated: make(map[string]*udpNomination),
+		peers:     make(map[string]*udpPeerConn),
+	}, nil
+}
+
+// 读取UDP端口上的报文并分发，直到端口关闭
+func (u *udpSocket) readLoop() {
+	for {
+		buf := make([]byte, udpBufferSize)
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Println("读取UDP报文失败:", err.Error())
+			}
+			u.closePeers()
+			return
+		}
+		if t, body, ok := protocol.ParsePacket(buf[:n]); ok {
+			u.handlePacket(t, body, addr)
+			continue
+		}
+		u.mu.Lock()
+		pc := u.peers[addr.String()]
+		u.mu.Unlock()
+		if pc != nil {
+			pc.push(buf[:n])
+		}
+	}
+}
+
+// 处理UDP控制报文
+func (u *udpSocket) handlePacket(t protocol.PacketType, body []byte, addr *net.UDPAddr) {
+	if t == protocol.PacketBindingResponse {
+		var resp protocol.BindingResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return
+		}
+		mapped, err := net.ResolveUDPAddr("udp", resp.Address)
+		if err != nil {
+			return
+		}
+		select {
+		case u.binding <- &udpBinding{mapped: mapped, other: resp.OtherAddress, from: addr}:
+		default:
+		}
+		return
+	}
+
+	// 连通性检查的报文都带有发送方的uuid，据此分发给与该对端的检查
+	var pkt protocol.CheckPacket
+	if err := json.Unmarshal(body, &pkt); err != nil {
+		return
+	}
+	u.mu.Lock()
+	checker := u.checkers[pkt.UUID]
+	nominated := u.nominated[pkt.UUID]
+	u.mu.Unlock()
+	if checker != nil {
+		checker.post(t, body, addr)
+		return
+	}
+
+	// 连通性检查已结束，控制方没有收到确认而重发了选中报文
+	if t == protocol.PacketNominate && nominated != nil && nominated.addr == addr.String() && pkt.Conv == nominated.conv {
+		u.conn.WriteTo(nominated.ack, addr)
+	}
+}
+
+// 开始与对端的连通性检查。与同一对端的新的检查取代之前的检查
+func (u *udpSocket) setChecker(c *udpChecker) {
+	u.mu.Lock()
+	u.checkers[c.peer.UUID] = c
+	u.mu.Unlock()
+}
+
+// 连通性检查结束。后台的检查结束时，与同一对端的新的检查可能已经开始，此时不做处理
+func (u *udpSocket) clearChecker(c *udpChecker) {
+	u.mu.Lock()
+	if u.checkers[c.peer.UUID] == c {
+		delete(u.checkers, c.peer.UUID)
+	}
+	u.mu.Unlock()
+}
+
+// 发送一个控制报文
+func (u *udpSocket) sendPacket(t protocol.PacketType, body interface{}, addr *net.UDPAddr) error {
+	b, err := protocol.EncodePacket(t, body)
+	if err != nil {
+		return err
+	}
+	_, err = u.conn.WriteToUDP(b, addr)
+	return err
+}
+
+// 向中继服务器发送绑定请求，得到本机UDP端口在公网上的映射地址。
+// req携带注册时的绑定令牌时，中继服务器同时记录该地址
+func (u *udpSocket) bind(ctx context.Context, relay *net.UDPAddr, req *protocol.BindingRequest) (*udpBinding, error) {
+	u.bindMu.Lock()
+	defer u.bindMu.Unlock()
+	// 丢弃之前超时未取走的响应
+	select {
+	case <-u.binding:
+	default:
+	}
+	for i := 0; i < bindingRetries; i++ {
+		if err := u.sendPacket(protocol.PacketBindingRequest, req, relay); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(bindingTimeout)
+		select {
+		case b := <-u.binding:
+			timer.Stop()
+			return b, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errBindingTimeout
+}
+
+// 创建与remote之间的报文通道，已有的通道及其上的会话会被替换
+func (u *udpSocket) peerConn(remote *net.UDPAddr) *udpPeerConn {
+	pc := &udpPeerConn{
+		sock:   u,
+		remote: remote,
+		in:     make(chan []byte, udpQueueSize),
+		done:   make(chan struct{}),
+	}
+	u.mu.Lock()
+	old := u.peers[remote.String()]
+	u.peers[remote.String()] = pc
+	u.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return pc
+}
+
+// 在与remote之间建立kcp会话，已有的会话会被替换
+func (u *udpSocket) dialKCP(remote *net.UDPAddr, conv uint32) (net.Conn, error) {
+	pc := u.peerConn(remote)
+	sess, err := kcp.NewConn3(conv, remote, nil, 0, 0, pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetNoDelay(1, 10, 2, 1)
+	sess.SetWindowSize(kcpWindow, kcpWindow)
+	sess.SetACKNoDelay(true)
+	return &kcpConn{UDPSession: sess, pc: pc}, nil
+}
+
+func (u *udpSocket) closePeers() {
+	u.mu.Lock()
+	peers := make([]*udpPeerConn, 0, len(u.peers))
+	for _, pc := range u.peers {
+		peers = append(peers, pc)
+	}
+	u.mu.Unlock()
+	for _, pc := range peers {
+		pc.Close()
+	}
+}
+
+func (u *udpSocket) Close() error {
+	return u.conn.Close()
+}
+
+// 生成kcp会话编号。kcp报文以会话编号(小端序)开头，需避免与控制报文的魔数相同
+func newConv() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		if string(b[:]) != protocol.PacketMagic {
+			return binary.LittleEndian.Uint32(b[:])
+		}
+	}
+}
+
+// 与一个对端地址之间的报文通道，作为kcp会话或QUIC连接的底层连接
+type udpPeerConn struct {
+	sock   *udpSocket
+	remote *net.UDPAddr
+
+	// 从UDP端口分发过来的报文
+	in chan []byte
+
+	once sync.Once
+	done chan struct{}
+}
+
+// 放入一个收到的报文，队列已满时丢弃
+func (c *udpPeerConn) push(b []byte) {
+	select {
+	case c.in <- b:
+	default:
+	}
+}
+
+func (c *udpPeerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case b := <-c.in:
+		return copy(p, b), c.remote, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *udpPeerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.sock.conn.WriteTo(p, c.remote)
+}
+
+func (c *udpPeerConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.sock.mu.Lock()
+		if c.sock.peers[c.remote.String()] == c {
+			delete(c.sock.peers, c.remote.String())
+		}
+		c.sock.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *udpPeerConn) LocalAddr() net.Addr {
+	return c.sock.conn.LocalAddr()
+}
+
+// 不支持超时时间：kcp不使用底层连接的超时时间，QUIC关闭时先关闭报文通道以中断读取
+func (c *udpPeerConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpPeerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpPeerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// kcp会话，关闭时一并关闭底层的报文通道
+type kcpConn struct {
+	*kcp.UDPSession
+	pc *udpPeerConn
+}
+
+func (c *kcpConn) Close() error {
+	err := c.UDPSession.Close()
+	c.pc.Close()
+	return err
+}
+
+// 向中继服务器查询本机UDP端口的公网地址，记录为srflx候选地址，
+// 并定期重新查询以保持NAT映射，直到与中继服务器的连接断开
+func (s *Agent) bindUDP(ctx context.Context, r *relayConn, relayAddr string) {
+	relay, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		fmt.Println("中继服务器的UDP地址无效:", err.Error())
+		return
+	}
+	update := func(ctx context.Context) {
+		b, err := s.udp.bind(ctx, relay, &protocol.BindingRequest{UUID: s.UUID, Instance: s.Instance, Token: r.bindingToken})
+		if err != nil {
+			fmt.Println("获取UDP公网地址失败:", err.Error())
+			return
+		}
+		s.setUDPSrflx(b.mapped)
+	}
+	update(ctx)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(bindingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				update(s.ctx)
+			case <-r.done:
+				return
+			case <-s.closing():
+				return
+			}
+		}
+	}()
+}
+
+// 记录本机UDP端口的srflx候选地址，替换之前的记录
+func (s *Agent) setUDPSrflx(addr *net.UDPAddr) {
+	cand := protocol.Candidate{
+		Type:     protocol.CandidateSrflx,
+		Network:  protocol.UDPNetworkOf(addr.IP),
+		Address:  addr.String(),
+		Priority: protocol.CandidatePriority(protocol.CandidateSrflx, 65535),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cands := []protocol.Candidate{cand}
+	for _, c := range s.Candidates {
+		if c.Type == protocol.CandidateSrflx && c.IsUDP() {
+			if c.Address != cand.Address {
+				fmt.Println("UDP公网地址发生变化:", c.Address, "->", cand.Address)
+			}
+			continue
+		}
+		cands = append(cands, c)
+	}
+	protocol.SortCandidates(cands)
+	s.Candidates = cands
+}
@@ -0,0 +1,309 @@
+package agent
+
+import (
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+UDP候选路径的连通性检查，与tcp的过程相对应：
+
+1. 双方从打洞时刻起，按照与tcp相同的节奏向对端的每个UDP候选地址发送check报文，报文中带有自己的uuid。
+2. 收到uuid正确的check报文后回复check response。收到check response即说明该路径双向连通。
+3. 控制方选中第一条连通的路径，分配会话编号，重复发送nominate报文直到收到nominate ack。
+4. 被控制方收到nominate报文后，先建立kcp会话再回复nominate ack，之后双方即可通过kcp收发帧。
+   nominate报文指定使用QUIC时，被控制方开始监听QUIC后回复nominate ack，由控制方发起QUIC连接，见quic.go。
+*/
+
+// 控制方重发nominate报文的间隔
+const nominateInterval = 100 * time.Millisecond
+
+// 等待分发给连通性检查的控制报文的最大数量
+const udpCheckBacklog = 64
+
+// 一个收到的UDP控制报文
+type udpPacket struct {
+	t    protocol.PacketType
+	body []byte
+	addr *net.UDPAddr
+}
+
+// 一次DailP2P中与一个对端的UDP候选路径的连通性检查
+type udpChecker struct {
+	s       *Agent
+	ctx     context.Context
+	peer    *protocol.PeerInfo
+	pairs   []*CandidatePair
+	results chan<- *checkedConn
+	wg      *sync.WaitGroup
+
+	// 从UDP端口分发过来的控制报文
+	packets chan udpPacket
+
+	mu sync.Mutex
+
+	// 已连通的对端地址
+	valid map[string]bool
+
+	// 控制方：等待确认的选中请求，键为对端地址
+	acks map[string]chan uint32
+
+	// 被控制方：是否已被选中
+	nominated bool
+
+	// 控制方：选中时是否使用QUIC
+	quic bool
+}
+
+func (s *Agent) newUDPChecker(ctx context.Context, peer *protocol.PeerInfo, pairs []*CandidatePair, results chan<- *checkedConn, wg *sync.WaitGroup) *udpChecker {
+	return &udpChecker{
+		s:       s,
+		ctx:     ctx,
+		peer:    peer,
+		pairs:   pairs,
+		results: results,
+		wg:      wg,
+		packets: make(chan udpPacket, udpCheckBacklog),
+		valid:   make(map[string]bool),
+		acks:    make(map[string]chan uint32),
+	}
+}
+
+// 接收UDP端口分发过来的控制报文，队列已满时丢弃，由对端重发
+func (c *udpChecker) post(t protocol.PacketType, body []byte, addr *net.UDPAddr) {
+	select {
+	case c.packets <- udpPacket{t: t, body: body, addr: addr}:
+	default:
+	}
+}
+
+// 处理控制报文，直到ctx被取消
+func (c *udpChecker) run() {
+	for {
+		select {
+		case p := <-c.packets:
+			c.handle(p)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *udpChecker) handle(p udpPacket) {
+	var pkt protocol.CheckPacket
+	if err := json.Unmarshal(p.body, &pkt); err != nil || pkt.UUID != c.peer.UUID {
+		return
+	}
+	sock := c.s.udp
+	key := p.addr.String()
+	switch p.t {
+	case protocol.PacketCheck:
+		sock.sendPacket(protocol.PacketCheckResponse, &protocol.CheckPacket{UUID: c.s.UUID}, p.addr)
+	case protocol.PacketCheckResponse:
+		c.mu.Lock()
+		first := !c.valid[key]
+		c.valid[key] = true
+		c.mu.Unlock()
+		if first && c.s.Controlling {
+			c.deliver(&checkedConn{pair: c.pairOf(p.addr), nominate: func(cc *checkedConn) error {
+				return c.nominate(cc, p.addr)
+			}})
+		}
+	case protocol.PacketNominate:
+		if c.s.Controlling {
+			return
+		}
+		c.accept(p.addr, &pkt)
+	case protocol.PacketNominateAck:
+		c.mu.Lock()
+		ch := c.acks[key]
+		c.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- pkt.Conv:
+			default:
+			}
+		}
+	}
+}
+
+// 在单独的goroutine中将连接交给DailP2P，以免阻塞控制报文的处理
+func (c *udpChecker) deliver(cc *checkedConn) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		deliver(c.ctx, c.results, cc)
+	}()
+}
+
+// 被控制方接受控制方的选中请求：建立kcp会话或开始监听QUIC后回复确认
+func (c *udpChecker) accept(addr *net.UDPAddr, pkt *protocol.CheckPacket) {
+	sock := c.s.udp
+	conv := pkt.Conv
+	ack, err := protocol.EncodePacket(protocol.PacketNominateAck, &protocol.CheckPacket{UUID: c.s.UUID, Conv: conv})
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	if c.nominated {
+		c.mu.Unlock()
+		// 控制方没有收到确认，重发了选中请求
+		sock.mu.Lock()
+		n := sock.nominated[c.peer.UUID]
+		sock.mu.Unlock()
+		if n != nil && n.addr == addr.String() && n.conv == conv {
+			sock.conn.WriteTo(ack, addr)
+		}
+		return
+	}
+	c.nominated = true
+	c.mu.Unlock()
+
+	if pkt.Transport == protocol.TransportQUIC {
+		ep, ln, err := sock.listenQUIC(addr, c.s.tlsConfig(c.peer.UUID))
+		if err != nil {
+			fmt.Println("监听QUIC失败:", err.Error())
+			return
+		}
+		c.acked(addr, conv, ack)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			cc, err := acceptQUIC(c.ctx, ep, ln)
+			if err != nil {
+				fmt.Println("建立QUIC连接失败:", err.Error())
+				ep.close()
+				return
+			}
+			cc.pair = c.pairOf(addr)
+			deliver(c.ctx, c.results, cc)
+		}()
+		return
+	}
+
+	conn, err := sock.dialKCP(addr, conv)
+	if err != nil {
+		fmt.Println("建立kcp会话失败:", err.Error())
+		return
+	}
+	c.acked(addr, conv, ack)
+	c.deliver(&checkedConn{conn: conn, reader: frame.NewReader(conn), writer: frame.NewWriter(conn), pair: c.pairOf(addr)})
+}
+
+// 记录接受的选中请求并回复确认
+func (c *udpChecker) acked(addr *net.UDPAddr, conv uint32, ack []byte) {
+	sock := c.s.udp
+	sock.mu.Lock()
+	sock.nominated[c.peer.UUID] = &udpNomination{addr: addr.String(), conv: conv, ack: ack}
+	sock.mu.Unlock()
+	sock.conn.WriteTo(ack, addr)
+}
+
+// 控制方选中该路径：重复发送选中请求直到被控制方确认。
+// 使用kcp时先建立kcp会话再发送选中请求，使用QUIC时在被控制方确认后才发起QUIC连接
+func (c *udpChecker) nominate(cc *checkedConn, addr *net.UDPAddr) error {
+	sock := c.s.udp
+	conv := newConv()
+	ch := make(chan uint32, 1)
+	c.mu.Lock()
+	c.acks[addr.String()] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.acks, addr.String())
+		c.mu.Unlock()
+	}()
+
+	pkt := &protocol.CheckPacket{UUID: c.s.UUID, Conv: conv}
+	var conn net.Conn
+	if c.quic {
+		pkt.Transport = protocol.TransportQUIC
+	} else {
+		var err error
+		if conn, err = sock.dialKCP(addr, conv); err != nil {
+			return err
+		}
+	}
+	fail := func(err error) error {
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(nominateInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(checkTimeout)
+	defer timeout.Stop()
+	for {
+		if err := sock.sendPacket(protocol.PacketNominate, pkt, addr); err != nil {
+			return fail(err)
+		}
+		select {
+		case acked := <-ch:
+			if acked != conv {
+				continue
+			}
+			if conn == nil {
+				qc, err := sock.dialQUIC(c.ctx, addr, c.s.tlsConfig(c.peer.UUID))
+				if err != nil {
+					return err
+				}
+				cc.conn, cc.reader, cc.writer, cc.quic = qc.conn, qc.reader, qc.writer, qc.quic
+				return nil
+			}
+			cc.conn = conn
+			cc.reader = frame.NewReader(conn)
+			cc.writer = frame.NewWriter(conn)
+			return nil
+		case <-ticker.C:
+		case <-timeout.C:
+			return fail(fmt.Errorf("对端没有确认选中请求:%s", addr))
+		case <-c.ctx.Done():
+			return fail(c.ctx.Err())
+		}
+	}
+}
+
+// 从start开始，按照与tcp相同的节奏向对端的一个UDP候选地址发送check报文，
+// 直到ctx被取消。控制方在该路径连通后即停止发送
+func (c *udpChecker) checkPair(start time.Time, p *CandidatePair) {
+	addr, err := net.ResolveUDPAddr(p.Remote.Network, p.Remote.Address)
+	if err != nil {
+		fmt.Println("UDP候选地址无效:", p.Remote.Address, err.Error())
+		return
+	}
+	next := start
+	for {
+		if !sleepUntil(c.ctx, next.Add(jitter(retryJitter))) {
+			return
+		}
+		next = next.Add(retryInterval)
+
+		c.mu.Lock()
+		done := c.s.Controlling && c.valid[addr.String()]
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		if err := c.s.udp.sendPacket(protocol.PacketCheck, &protocol.CheckPacket{UUID: c.s.UUID}, addr); err != nil {
+			fmt.Println("发送UDP检查报文失败:", p, "error:", err.Error())
+		}
+	}
+}
+
+// 与对端地址对应的候选路径，对端地址不在候选地址列表中时作为prflx候选地址
+func (c *udpChecker) pairOf(addr *net.UDPAddr) *CandidatePair {
+	for _, p := range c.pairs {
+		if p.Remote.Address == addr.String() {
+			return p
+		}
+	}
+	return c.s.inboundPair(c.s.udp.conn.LocalAddr(), addr, c.peer.Candidates)
+}
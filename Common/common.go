@@ -1,3 +1,47 @@
 package common
 
+import "time"
+
 const Relay_addr = "47.112.96.50:3001"
+
+// 是否通过TLS连接中继服务器，需要与server的-tls-cert一同开启
+const Relay_tls = false
+
+// 校验中继服务器证书的CA证书文件，为空时使用系统的根证书
+const Relay_ca = ""
+
+// 中继服务器要求双向认证(-client-ca)时，本机出示的证书和私钥文件
+const Relay_cert = ""
+const Relay_key = ""
+
+// 部署令牌，与server的-token相同，为空表示不需要
+const Relay_token = ""
+
+// 浏览器未指定时默认打开的流标签
+const Default_stream = "rosbridge"
+
+// rosAgent对外提供的服务，key为流的标签，value为服务地址，支持ws://和tcp://两种协议。
+// 不同类别的话题可以使用指向同一服务的不同标签，例如"teleop"和"sensors"，各自占用一个流
+var Ros_services = map[string]string{
+	"rosbridge": "ws://127.0.0.1:9090",
+}
+
+// 多个操作者同时连接机器人时的控制策略，可以通过rosAgent的-control参数覆盖。
+// "exclusive": 最先连接的操作者独占控制权，其余的操作者为观察者，只能订阅话题；"shared": 所有操作者都可以控制
+const Control_policy = "exclusive"
+
+// exclusive策略下，拥有控制权的操作者断开后为其保留控制权的时间，可以通过rosAgent的-grace参数覆盖，为0时立即移交
+const Control_grace = 30 * time.Second
+
+// localAgent为每个机器人各运行一个Agent，第一个Agent使用该本地端口，之后的Agent依次使用之后未被占用的端口
+const Local_port = 3003
+
+// localAgent额外监听的本地tcp端口，key为端口，value为对应的流标签。每个tcp连接对应最近连接的机器人上的一个流
+var Local_forwards = map[int]string{}
+
+// 与Local_forwards相同，但按机器人的uuid配置，key为机器人的uuid，value中key为端口，value为对应的流标签。
+// 每个tcp连接对应该机器人上的一个流，尚未连接该机器人时关闭tcp连接。端口不能与Local_forwards中的重复
+var Robot_forwards = map[string]map[int]string{}
+
+// localAgent选中UDP路径时是否使用QUIC代替kcp。使用QUIC时每个流对应一个QUIC流，一个流上的丢包不会阻塞其他的流
+var Use_quic = false
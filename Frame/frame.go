@@ -0,0 +1,433 @@
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+该package负责p2p链路上报文的编码与解码
+
+包头格式（大端序，共8个字节）：
+| version(1) | type(1) | flags(2) | length(4) |
+version: 协议版本号
+type:    帧类型
+flags:   标志位，具体含义由帧类型决定
+length:  包体的长度，不包含包头
+*/
+
+// 当前的协议版本
+const Version uint8 = 1
+
+// 包头的长度
+const HeaderSize = 8
+
+// 默认的最大帧长度，超过该长度的帧会被拒绝
+const DefaultMaxSize = 16 * 1024 * 1024
+
+// 帧类型枚举
+type Type uint8
+
+const (
+	// 数据帧，包体为转发的业务数据
+	TypeData Type = 1
+
+	// 心跳请求，对端收到后需原样回复一个TypePong
+	TypePing Type = 2
+
+	// 心跳响应
+	TypePong Type = 3
+
+	// 关闭通知，包体为2个字节的关闭码+关闭原因，发送后即断开连接
+	TypeClose Type = 4
+
+	// 错误通知，包体为2个字节的错误码+错误描述，不会断开连接
+	TypeError Type = 5
+
+	// 以下为多路复用的流控制帧，包体的前4个字节均为流的编号
+
+	// 请求打开一个流，包体为流编号+流的标签
+	TypeStreamOpen Type = 6
+
+	// 同意打开流
+	TypeStreamAccept Type = 7
+
+	// 流上的数据，FlagMore表示消息还未结束
+	TypeStreamData Type = 8
+
+	// 流量控制，包体为流编号+4个字节的窗口增量
+	TypeStreamWindow Type = 9
+
+	// 关闭流，或拒绝打开流，包体为流编号+关闭原因
+	TypeStreamClose Type = 10
+
+	// 以下为建立连接时的连通性检查帧，只出现在连接被选中之前
+
+	// 连通性检查，连接建立后双方各发送一次，包体为发送方的uuid
+	TypeCheck Type = 11
+
+	// 控制方选中该连接作为p2p连接，包体为空
+	TypeNominate Type = 12
+
+	// 迁移通知，发送方在旧连接上发出的最后一个帧，之后的帧都在新连接上发送，包体为空
+	TypeMigrate Type = 13
+
+	// 授权请求，TLS握手后由控制方发送，包体为配对码，不配对时为空。
+	// 被控制方授权时回复包体为空的TypeAuth帧，拒绝时回复关闭码为CloseUnauthorized的TypeClose帧
+	TypeAuth Type = 14
+
+	// 会话恢复请求，授权后由控制方发送，包体为16个字节的会话id+8个字节的已收到的可靠帧数量。
+	// 被控制方以同样格式的TypeResume帧答复，带有FlagResume表示恢复该会话，否则开始新的会话
+	TypeResume Type = 15
+
+	// 可靠帧的确认，包体为8个字节的已收到的可靠帧数量，发送方据此释放重放缓冲区
+	TypeAck Type = 16
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeData:
+		return "data"
+	case TypePing:
+		return "ping"
+	case TypePong:
+		return "pong"
+	case TypeClose:
+		return "close"
+	case TypeError:
+		return "error"
+	case TypeStreamOpen:
+		return "stream open"
+	case TypeStreamAccept:
+		return "stream accept"
+	case TypeStreamData:
+		return "stream data"
+	case TypeStreamWindow:
+		return "stream window"
+	case TypeStreamClose:
+		return "stream close"
+	case TypeCheck:
+		return "check"
+	case TypeNominate:
+		return "nominate"
+	case TypeMigrate:
+		return "migrate"
+	case TypeAuth:
+		return "auth"
+	case TypeResume:
+		return "resume"
+	case TypeAck:
+		return "ack"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// 帧的标志位
+type Flags uint16
+
+const (
+	// 流数据帧：该帧之后还有属于同一条消息的数据
+	FlagMore Flags = 1 << 0
+
+	// 会话恢复帧：被控制方找到了对应的会话，双方恢复该会话
+	FlagResume Flags = 1 << 0
+)
+
+// 帧的解码错误
+var (
+	ErrUnsupportedVersion = errors.New("frame: 不支持的协议版本")
+	ErrFrameTooLarge      = errors.New("frame: 帧长度超过上限")
+)
+
+// VersionError 包头中的版本号不被支持
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("frame: 不支持的协议版本%d", e.Version)
+}
+
+func (e *VersionError) Is(target error) bool {
+	return target == ErrUnsupportedVersion
+}
+
+// SizeError 帧长度超过上限
+type SizeError struct {
+	Size int
+	Max  int
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("frame: 帧长度%d超过上限%d", e.Size, e.Max)
+}
+
+func (e *SizeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
+}
+
+// 关闭码枚举
+type CloseCode uint16
+
+const (
+	// 正常关闭
+	CloseNormal CloseCode = 1
+
+	// 本端程序退出
+	CloseGoingAway CloseCode = 2
+
+	// 收到了无法解析的帧
+	CloseProtocolError CloseCode = 3
+
+	// 本端与上游服务（如ros_server）的连接中断
+	CloseUpstreamLost CloseCode = 4
+
+	// 心跳超时
+	CloseTimeout CloseCode = 5
+
+	// 底层连接中断，不会出现在关闭帧中，仅用于本地上报
+	CloseConnLost CloseCode = 6
+
+	// 对端未被授权，或配对码错误
+	CloseUnauthorized CloseCode = 7
+)
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNormal:
+		return "normal"
+	case CloseGoingAway:
+		return "going away"
+	case CloseProtocolError:
+		return "protocol error"
+	case CloseUpstreamLost:
+		return "upstream lost"
+	case CloseTimeout:
+		return "timeout"
+	case CloseConnLost:
+		return "connection lost"
+	case CloseUnauthorized:
+		return "unauthorized"
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(c))
+}
+
+// 错误码枚举
+type ErrorCode uint16
+
+const (
+	// 收到了不支持的帧类型
+	ErrorUnknownType ErrorCode = 1
+
+	// 上游服务暂时不可用，数据未能送达
+	ErrorUpstreamUnavailable ErrorCode = 2
+)
+
+// 包体过短，无法解析出关闭码、错误码或流编号
+var ErrShortPayload = errors.New("frame: 包体长度不足")
+
+// Frame 一个完整的帧
+type Frame struct {
+	// 帧类型
+	Type Type
+
+	// 标志位
+	Flags Flags
+
+	// 包体
+	Payload []byte
+}
+
+// 将帧编码为包头+包体的字节序列
+func Encode(f *Frame, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if len(f.Payload) > maxSize {
+		return nil, &SizeError{Size: len(f.Payload), Max: maxSize}
+	}
+	buf := make([]byte, HeaderSize+len(f.Payload))
+	buf[0] = Version
+	buf[1] = uint8(f.Type)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(f.Flags))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(f.Payload)))
+	copy(buf[HeaderSize:], f.Payload)
+	return buf, nil
+}
+
+// Reader 从字节流中逐帧读取
+type Reader struct {
+	r *bufio.Reader
+
+	// 允许的最大帧长度
+	MaxSize int
+
+	header [HeaderSize]byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r), MaxSize: DefaultMaxSize}
+}
+
+// Buffered 读取器内部的缓冲读取器。连接不再传输帧、改作其他用途时(例如开始TLS握手)，
+// 需要从该读取器继续读取，以免丢失已经读入缓冲区的数据
+func (r *Reader) Buffered() io.Reader {
+	return r.r
+}
+
+// ReadFrame 读取下一个完整的帧
+// 流在帧边界处结束时返回io.EOF，在帧中间结束时返回io.ErrUnexpectedEOF
+func (r *Reader) ReadFrame() (*Frame, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return nil, err
+	}
+	if r.header[0] != Version {
+		return nil, &VersionError{Version: r.header[0]}
+	}
+	length := int(binary.BigEndian.Uint32(r.header[4:8]))
+	if length > r.MaxSize {
+		return nil, &SizeError{Size: length, Max: r.MaxSize}
+	}
+	f := &Frame{
+		Type:    Type(r.header[1]),
+		Flags:   Flags(binary.BigEndian.Uint16(r.header[2:4])),
+		Payload: make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// Writer 将帧写入字节流，可被多个goroutine并发使用
+type Writer struct {
+	w  io.Writer
+	mu sync.Mutex
+
+	// 允许的最大帧长度
+	MaxSize int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, MaxSize: DefaultMaxSize}
+}
+
+// WriteFrame 写入一个完整的帧，包头和包体在一次Write中写出，保证帧不会被其他写入打断
+func (w *Writer) WriteFrame(f *Frame) error {
+	buf, err := Encode(f, w.MaxSize)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.w.Write(buf)
+	return err
+}
+
+// NewClose 构造一个关闭帧
+func NewClose(code CloseCode, reason string) *Frame {
+	return &Frame{Type: TypeClose, Payload: codePayload(uint16(code), reason)}
+}
+
+// ParseClose 解析关闭帧的关闭码和关闭原因
+func ParseClose(f *Frame) (CloseCode, string, error) {
+	code, reason, err := parseCodePayload(f.Payload)
+	return CloseCode(code), reason, err
+}
+
+// NewError 构造一个错误帧
+func NewError(code ErrorCode, message string) *Frame {
+	return &Frame{Type: TypeError, Payload: codePayload(uint16(code), message)}
+}
+
+// ParseError 解析错误帧的错误码和错误描述
+func ParseError(f *Frame) (ErrorCode, string, error) {
+	code, message, err := parseCodePayload(f.Payload)
+	return ErrorCode(code), message, err
+}
+
+// 包体格式: | code(2) | text |
+func codePayload(code uint16, text string) []byte {
+	buf := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(buf[:2], code)
+	copy(buf[2:], text)
+	return buf
+}
+
+func parseCodePayload(payload []byte) (uint16, string, error) {
+	if len(payload) < 2 {
+		return 0, "", ErrShortPayload
+	}
+	return binary.BigEndian.Uint16(payload[:2]), string(payload[2:]), nil
+}
+
+// NewStream 构造一个流控制帧，包体为流编号+body
+func NewStream(t Type, id uint32, body []byte) *Frame {
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf[:4], id)
+	copy(buf[4:], body)
+	return &Frame{Type: t, Payload: buf}
+}
+
+// ParseStream 解析流控制帧的流编号和body
+func ParseStream(f *Frame) (uint32, []byte, error) {
+	if len(f.Payload) < 4 {
+		return 0, nil, ErrShortPayload
+	}
+	return binary.BigEndian.Uint32(f.Payload[:4]), f.Payload[4:], nil
+}
+
+// 会话id的长度
+const SessionIDSize = 16
+
+// NewResume 构造一个会话恢复帧
+func NewResume(session []byte, received uint64, resume bool) *Frame {
+	buf := make([]byte, SessionIDSize+8)
+	copy(buf, session)
+	binary.BigEndian.PutUint64(buf[SessionIDSize:], received)
+	f := &Frame{Type: TypeResume, Payload: buf}
+	if resume {
+		f.Flags |= FlagResume
+	}
+	return f
+}
+
+// ParseResume 解析会话恢复帧的会话id和已收到的可靠帧数量
+func ParseResume(f *Frame) ([]byte, uint64, error) {
+	if len(f.Payload) < SessionIDSize+8 {
+		return nil, 0, ErrShortPayload
+	}
+	return f.Payload[:SessionIDSize], binary.BigEndian.Uint64(f.Payload[SessionIDSize:]), nil
+}
+
+// NewAck 构造一个可靠帧的确认帧
+func NewAck(received uint64) *Frame {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, received)
+	return &Frame{Type: TypeAck, Payload: buf}
+}
+
+// ParseAck 解析确认帧中已收到的可靠帧数量
+func ParseAck(f *Frame) (uint64, error) {
+	if len(f.Payload) < 8 {
+		return 0, ErrShortPayload
+	}
+	return binary.BigEndian.Uint64(f.Payload), nil
+}
+
+// IsReliable 判断是否为可靠帧，即数据帧和流控制帧。可靠帧在会话内按发送顺序编号，连接中断后可以重发
+func (t Type) IsReliable() bool {
+	return t == TypeData || t.IsStream()
+}
+
+// IsStream 判断是否为多路复用的流控制帧
+func (t Type) IsStream() bool {
+	return t >= TypeStreamOpen && t <= TypeStreamClose
+}
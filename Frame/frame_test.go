@@ -0,0 +1,215 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{name: "空包体", frame: &Frame{Type: TypeData}},
+		{name: "数据帧", frame: &Frame{Type: TypeData, Payload: []byte("hello")}},
+		{name: "标志位", frame: &Frame{Type: TypeData, Flags: 1, Payload: bytes.Repeat([]byte{1}, 1000)}},
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, tt := range tests {
+		if err := w.WriteFrame(tt.frame); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+	r := NewReader(&buf)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := r.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Type != tt.frame.Type || f.Flags != tt.frame.Flags || !bytes.Equal(f.Payload, tt.frame.Payload) {
+				t.Fatalf("读到%+v，预期%+v", f, tt.frame)
+			}
+		})
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Fatalf("在帧边界处结束时返回%v，预期io.EOF", err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	valid, err := Encode(&Frame{Type: TypeData, Payload: []byte("payload")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion := append([]byte{}, valid...)
+	badVersion[0] = Version + 1
+	tooLarge, err := Encode(&Frame{Type: TypeData, Payload: make([]byte, 65)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr error
+	}{
+		{name: "空输入", input: nil, wantErr: io.EOF},
+		{name: "包头不完整", input: valid[:HeaderSize-3], wantErr: io.ErrUnexpectedEOF},
+		{name: "包体不完整", input: valid[:len(valid)-1], wantErr: io.ErrUnexpectedEOF},
+		{name: "只有包头", input: valid[:HeaderSize], wantErr: io.ErrUnexpectedEOF},
+		{name: "版本号错误", input: badVersion, wantErr: ErrUnsupportedVersion},
+		{name: "超过最大长度", input: tooLarge, wantErr: ErrFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(tt.input))
+			r.MaxSize = 64
+			_, err := r.ReadFrame()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("返回%v，预期%v", err, tt.wantErr)
+			}
+		})
+	}
+
+	var verErr *VersionError
+	if _, err := NewReader(bytes.NewReader(badVersion)).ReadFrame(); !errors.As(err, &verErr) || verErr.Version != Version+1 {
+		t.Fatalf("版本号错误时返回%v", err)
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	var sizeErr *SizeError
+	_, err := Encode(&Frame{Type: TypeData, Payload: make([]byte, 11)}, 10)
+	if !errors.As(err, &sizeErr) || sizeErr.Size != 11 || sizeErr.Max != 10 {
+		t.Fatalf("返回%v，预期SizeError", err)
+	}
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatal("SizeError应匹配ErrFrameTooLarge")
+	}
+}
+
+func TestCloseAndErrorFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+		parse func(*Frame) (uint16, string, error)
+		code  uint16
+		text  string
+	}{
+		{name: "关闭帧", frame: NewClose(CloseTimeout, "心跳超时"), parse: func(f *Frame) (uint16, string, error) {
+			c, s, err := ParseClose(f)
+			return uint16(c), s, err
+		}, code: uint16(CloseTimeout), text: "心跳超时"},
+		{name: "没有原因的关闭帧", frame: NewClose(CloseNormal, ""), parse: func(f *Frame) (uint16, string, error) {
+			c, s, err := ParseClose(f)
+			return uint16(c), s, err
+		}, code: uint16(CloseNormal)},
+		{name: "错误帧", frame: NewError(ErrorUnknownType, "unknown(99)"), parse: func(f *Frame) (uint16, string, error) {
+			c, s, err := ParseError(f)
+			return uint16(c), s, err
+		}, code: uint16(ErrorUnknownType), text: "unknown(99)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewWriter(&buf).WriteFrame(tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			f, err := NewReader(&buf).ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, text, err := tt.parse(f)
+			if err != nil || code != tt.code || text != tt.text {
+				t.Fatalf("解析出%d %q %v，预期%d %q", code, text, err, tt.code, tt.text)
+			}
+		})
+	}
+
+	short := &Frame{Payload: []byte{1}}
+	if _, _, err := ParseClose(short); err != ErrShortPayload {
+		t.Fatalf("ParseClose返回%v", err)
+	}
+	if _, _, err := ParseError(short); err != ErrShortPayload {
+		t.Fatalf("ParseError返回%v", err)
+	}
+}
+
+func TestStreamFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		t    Type
+		id   uint32
+		body []byte
+	}{
+		{name: "打开流", t: TypeStreamOpen, id: 7, body: []byte("rosbridge")},
+		{name: "同意打开", t: TypeStreamAccept, id: 8},
+		{name: "最大编号", t: TypeStreamData, id: 1<<32 - 1, body: []byte("data")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewStream(tt.t, tt.id, tt.body)
+			if !f.Type.IsStream() {
+				t.Fatalf("%s应为流控制帧", f.Type)
+			}
+			id, body, err := ParseStream(f)
+			if err != nil || id != tt.id || !bytes.Equal(body, tt.body) {
+				t.Fatalf("解析出%d %q %v", id, body, err)
+			}
+		})
+	}
+	if _, _, err := ParseStream(&Frame{Payload: []byte{0, 0, 1}}); err != ErrShortPayload {
+		t.Fatalf("包体不足4个字节时返回%v", err)
+	}
+}
+
+func TestResumeAndAckFrames(t *testing.T) {
+	session := bytes.Repeat([]byte{9}, SessionIDSize)
+	tests := []struct {
+		name     string
+		received uint64
+		resume   bool
+	}{
+		{name: "开始新的会话", received: 0, resume: false},
+		{name: "恢复会话", received: 42, resume: true},
+		{name: "较大的数量", received: 1 << 40, resume: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewResume(session, tt.received, tt.resume)
+			id, received, err := ParseResume(f)
+			if err != nil || !bytes.Equal(id, session) || received != tt.received {
+				t.Fatalf("解析出%x %d %v", id, received, err)
+			}
+			if (f.Flags&FlagResume != 0) != tt.resume {
+				t.Fatalf("FlagResume为%v，预期%v", f.Flags&FlagResume != 0, tt.resume)
+			}
+			n, err := ParseAck(NewAck(tt.received))
+			if err != nil || n != tt.received {
+				t.Fatalf("确认帧解析出%d %v", n, err)
+			}
+		})
+	}
+
+	short := &Frame{Payload: make([]byte, 7)}
+	if _, _, err := ParseResume(short); err != ErrShortPayload {
+		t.Fatalf("ParseResume返回%v", err)
+	}
+	if _, err := ParseAck(short); err != ErrShortPayload {
+		t.Fatalf("ParseAck返回%v", err)
+	}
+	for _, typ := range []Type{TypeData, TypeStreamData, TypeStreamClose} {
+		if !typ.IsReliable() {
+			t.Fatalf("%s应为可靠帧", typ)
+		}
+	}
+	for _, typ := range []Type{TypePing, TypeAck, TypeResume, TypeClose} {
+		if typ.IsReliable() {
+			t.Fatalf("%s不应为可靠帧", typ)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 等待已建立的控制连接数量变为n
+func waitControlConns(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		controlLock.Lock()
+		got := len(controlConns)
+		controlLock.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("控制连接的数量没有变为%d", n)
+}
+
+func TestNotifyAllControlConns(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(controlHandler))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var pages []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		pages = append(pages, c)
+	}
+	waitControlConns(t, 2)
+
+	if !notifyControl(map[string]string{"peer": "robot", "status": "success"}) {
+		t.Fatal("状态消息没有发送")
+	}
+	for i, c := range pages {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := c.ReadMessage()
+		if err != nil || !strings.Contains(string(msg), `"status":"success"`) {
+			t.Fatalf("页面%d收到%s %v", i, msg, err)
+		}
+	}
+
+	// 关闭的页面不再接收状态消息，其他页面不受影响
+	pages[0].Close()
+	waitControlConns(t, 1)
+	if !notifyControl(map[string]string{"peer": "robot", "status": "closed"}) {
+		t.Fatal("关闭一个页面后状态消息没有发送")
+	}
+	pages[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := pages[1].ReadMessage(); err != nil || !strings.Contains(string(msg), `"status":"closed"`) {
+		t.Fatalf("收到%s %v", msg, err)
+	}
+}
@@ -1,39 +1,47 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
+	"net"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	agent "P2PAgent/Agent"
 	common "P2PAgent/Common"
+	"P2PAgent/utils"
 
 	"github.com/gorilla/websocket"
 )
 
-/*
-**自定义的tcp报文包头格式：length:{num}
-**length后，是数据的总长度，后面填充空格，使得填充到18个字节
- */
+// 与浏览器建立的控制连接，每个浏览器页面各有一条，状态消息发送给所有的控制连接。由controlLock保护
+var controlConns = make(map[*websocket.Conn]bool)
 
-// 本地的代理对象
-var localAgent agent.Agent
+// 保证同一时刻只有一个goroutine向控制连接写入
+var controlLock sync.Mutex
 
-// 与浏览器建立的数据连接
-var dataConn *websocket.Conn
+// 浏览器发来的请求
+type connectRequest struct {
+	// 请求的操作，为空表示connect，见robot.go
+	Op string `json:"op,omitempty"`
 
-// 与浏览器建立的控制连接
-var controlConn *websocket.Conn
+	// ros_agent的uuid
+	UUID string `json:"uuid"`
 
-// 记录p2p连接是否成功
-var isSuccess bool
+	// 首次连接时机器人上显示的配对码，已配对时为空
+	PairingCode string `json:"pairingCode,omitempty"`
+}
 
-// 记录ros_agent的uuid的通道
-var rosUuid_chan chan string
+// 记录浏览器的连接请求的通道
+var rosUuid_chan chan connectRequest
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024 * 1024 * 1024,
@@ -51,7 +59,15 @@ func controlHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("websocket请求建立失败:" + error.Error())
 		return
 	}
-	controlConn = conn
+	controlLock.Lock()
+	controlConns[conn] = true
+	controlLock.Unlock()
+	defer func() {
+		controlLock.Lock()
+		delete(controlConns, conn)
+		controlLock.Unlock()
+		conn.Close()
+	}()
 	fmt.Println("websocket控制连接建立成功")
 	for {
 		// Read message from browser
@@ -59,13 +75,88 @@ func controlHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			return
 		}
-		readCnt := len(msg)
-		// Print the message to the console
-		fmt.Printf(">读取到%d个字节,浏览器发来内容:%s\n", readCnt, string(msg))
+		utils.LogRecv(len(msg), "浏览器的控制连接")
+
+		// 浏览器可以只发送uuid，也可以发送带有配对码或操作的json
+		req := connectRequest{UUID: string(msg)}
+		if len(msg) > 0 && msg[0] == '{' {
+			if err := json.Unmarshal(msg, &req); err != nil {
+				fmt.Println("无法解析浏览器的连接请求:", err.Error())
+				continue
+			}
+		}
+		rosUuid_chan <- req
+
+	}
+}
+
+// 浏览器的一个数据连接，对应p2p连接上的一个流
+type dataSession struct {
+	// 与浏览器的websocket连接
+	conn *websocket.Conn
+
+	// 机器人的uuid，由浏览器通过/data?peer=<uuid>指定，为空表示最近连接的机器人
+	peer string
+
+	// 流的标签，由浏览器通过/data?stream=<label>指定
+	label string
 
-		rosUuid_chan <- string(msg)
+	// 浏览器断开数据连接后被取消
+	ctx context.Context
 
+	mu     sync.Mutex
+	stream *agent.Stream
+}
+
+// 当前所有的数据连接
+var dataSessions = make(map[*dataSession]bool)
+var dataSessionsLock sync.Mutex
+
+// 打开数据连接对应的流，并将流上的数据转发给浏览器。p2p连接尚未建立时返回nil
+func (d *dataSession) attach() *agent.Stream {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stream != nil {
+		return d.stream
+	}
+	r := lookupRobot(d.peer)
+	if r == nil || r.agent.Mux() == nil {
+		return nil
+	}
+	st, err := r.agent.OpenStream(d.ctx, d.label)
+	if err != nil {
+		fmt.Println("打开流失败:", err.Error())
+		return nil
 	}
+	fmt.Println("打开流成功:", r.uuid, d.label, st.ID())
+	d.stream = st
+
+	go func() {
+		defer d.detach(st)
+		for {
+			msg, err := st.ReadMessage()
+			if err != nil {
+				fmt.Println("流已关闭:", d.label, st.ID())
+				return
+			}
+			err = d.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				fmt.Println("消息转发给浏览器失败:", err.Error())
+				return
+			}
+		}
+	}()
+	return st
+}
+
+// 关闭数据连接对应的流
+func (d *dataSession) detach(st *agent.Stream) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stream == st {
+		d.stream = nil
+	}
+	st.Close()
 }
 
 // 浏览器和agent之间的数据连接
@@ -75,9 +166,29 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("websocket请求建立失败:" + error.Error())
 		return
 	}
-	dataConn = conn
+	label := r.URL.Query().Get("stream")
+	if label == "" {
+		label = common.Default_stream
+	}
+	peer := r.URL.Query().Get("peer")
+	d := &dataSession{conn: conn, peer: peer, label: label, ctx: r.Context()}
+	dataSessionsLock.Lock()
+	dataSessions[d] = true
+	dataSessionsLock.Unlock()
+	defer func() {
+		dataSessionsLock.Lock()
+		delete(dataSessions, d)
+		dataSessionsLock.Unlock()
+		d.mu.Lock()
+		if d.stream != nil {
+			d.stream.Close()
+		}
+		d.mu.Unlock()
+		conn.Close()
+	}()
 
-	fmt.Println("websocket数据连接建立成功")
+	fmt.Println("websocket数据连接建立成功:", peer, label)
+	d.attach()
 	for {
 		// Read message from browser
 		_, msg, err := conn.ReadMessage()
@@ -85,143 +196,160 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		readCnt := len(msg)
-		// Print the message to the console
-		fmt.Printf(">读取到%d个字节,浏览器发来内容:%s\n", readCnt, string(msg))
-
-		// 如果建立好了p2p连接，就将浏览器传来的内容转发给对端节点
-		if localAgent.P2PConn != nil {
-			// 自定义的包头
-			data_head := fmt.Sprintf("length:%-11d", readCnt)
-
-			// 将包头和数据主体拼接
-			body := string(msg)
-			content := data_head + body
-			// 将消息转发给对端节点
-			writeCnt, err := localAgent.P2PConn.Write([]byte(content))
+		utils.LogRecv(readCnt, "浏览器的数据连接")
+
+		// 如果建立好了p2p连接，就将浏览器传来的内容通过对应的流转发给对端节点
+		if st := d.attach(); st != nil {
+			_, err := st.Write(msg)
 			if err != nil {
 				fmt.Println("消息转发给对端节点失败" + err.Error())
-				break
+				d.detach(st)
+				continue
 			}
-			fmt.Println("消息转发给对端节点,大小:", writeCnt)
+			fmt.Println("消息转发给对端节点,大小:", readCnt)
+		}
+	}
+}
+
+// 将p2p连接建立前就已存在的数据连接，关联到与机器人r的新的p2p连接上。未指定机器人的数据连接关联到r上，r即最近连接的机器人
+func attachDataSessions(r *robot) {
+	dataSessionsLock.Lock()
+	defer dataSessionsLock.Unlock()
+	for d := range dataSessions {
+		if d.peer == "" || d.peer == r.uuid {
+			go d.attach()
 		}
 	}
 }
 
-// 发消息给浏览器，告知p2p连接的状态
-func NotifyStatus(status string) {
-	var data = make(map[string]string)
-	data["status"] = status
-	body, _ := json.Marshal(data)
-	err := controlConn.WriteMessage(websocket.TextMessage, body)
+// 监听本地tcp端口，每个tcp连接对应与机器人peer之间的p2p连接上的一个流，peer为空时为最近连接的机器人
+func serveForward(ctx context.Context, peer string, port int, label string) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
-		fmt.Println("fail:" + err.Error())
+		fmt.Println("监听本地端口失败:", err.Error())
 		return
 	}
-	fmt.Println("成功通知浏览器，p2p连接状态:", status)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	if peer == "" {
+		fmt.Println("监听本地端口", port, "对应最近连接的机器人上的流:", label)
+	} else {
+		fmt.Println("监听本地端口", port, "对应机器人", peer, "上的流:", label)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("获取连接句柄失败", err.Error())
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			r := lookupRobot(peer)
+			if r == nil {
+				fmt.Println("尚未连接机器人", peer, "，关闭本地连接:", port)
+				return
+			}
+			st, err := r.agent.OpenStream(ctx, label)
+			if err != nil {
+				fmt.Println("打开流失败:", err.Error())
+				return
+			}
+			defer st.Close()
+			go func() {
+				io.Copy(conn, st)
+				conn.Close()
+			}()
+			io.Copy(st, conn)
+		}()
+	}
 }
 
 func init() {
-	// localPort := randPort(10000, 50000)
-	localPort := 3003
-	localAgent.InitAgent(int(localPort))
+	// 连接中继服务器时的TLS，各个机器人的Agent共用。本地端口见Local_port
+	if common.Relay_tls {
+		conf, err := agent.LoadRelayTLS(common.Relay_ca, common.Relay_cert, common.Relay_key)
+		if err != nil {
+			fmt.Println("加载TLS配置失败:", err.Error())
+			os.Exit(1)
+		}
+		relayTLS = conf
+	}
 
-	// 初始化存储对端uuid的通道
-	ch_uuid := make(chan string)
+	// 初始化存储连接请求的通道
+	ch_uuid := make(chan connectRequest)
 	rosUuid_chan = ch_uuid
 
 }
 
 func main() {
+	// 收到退出信号后，取消ctx，所有阻塞的操作随之返回
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	/*
 		与浏览器建立webSocket连接
 	*/
-	go func() {
-		// 与浏览器的控制连接
-		http.HandleFunc("/control", controlHandler)
+	// 与浏览器的控制连接
+	http.HandleFunc("/control", controlHandler)
 
-		// 与浏览器的数据连接
-		http.HandleFunc("/data", dataHandler)
+	// 与浏览器的数据连接
+	http.HandleFunc("/data", dataHandler)
 
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			http.ServeFile(w, r, "go.html")
-		})
-		http.ListenAndServe(":3000", nil)
-
-		fmt.Println("与浏览器成功建立websocket连接")
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "go.html")
+	})
+	server := &http.Server{Addr: ":3000"}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("http服务启动失败:", err.Error())
+		}
 	}()
-	defer localAgent.Close()
-	/*
-		与对端节点建立p2p连接
-	*/
+	defer server.Close()
 
-	// 连接服务器
-	var err error
-	for {
-		err = localAgent.ConnectToRelay(common.Relay_addr)
-		if err != nil {
-			time.Sleep(2 * time.Second)
-			continue
+	for port, label := range common.Local_forwards {
+		go serveForward(ctx, "", port, label)
+	}
+	for peer, forwards := range common.Robot_forwards {
+		for port, label := range forwards {
+			go serveForward(ctx, peer, port, label)
 		}
-		fmt.Println("connected to relayServer")
-		break
 	}
+	defer closeRobots()
 
 	for {
-
-		// 等待浏览器发来对端节点的uuid
-		peer_id := <-rosUuid_chan
-
-		// 请求目标uuid的节点的信息
-		err = localAgent.RequestForAddr(peer_id)
-		if err != nil {
-			fmt.Println("请求对端节点信息失败" + err.Error())
-		}
-
-		// 等待服务器回传对端节点的信息
-		remotePubAddr, remotePrivAddr, remoteIpv6Addr, errStr := localAgent.WaitNotify()
-
-		// 错误处理
-		if errStr != "" && errStr == "1" {
-			NotifyStatus("Invalid robotID")
-			continue
-		}
-		fmt.Println("对端的公网地址:", remotePubAddr, " 对端的局域网地址:", remotePrivAddr, " 对端的ipv6地址:", remoteIpv6Addr)
-
-		// 在尝试连接之前，先关掉可能的已有连接，防止端口占用
-		if localAgent.P2PConn != nil {
-			localAgent.P2PConn.Close()
-		}
-
-		// 分别尝试连接对端的局域网地址、ipv6地址、公网地址
-		isSuccess = localAgent.DailP2P(remotePrivAddr) || localAgent.DailP2P(remoteIpv6Addr) || localAgent.DailP2P(remotePubAddr)
-		// 通知浏览器，是否成功建立p2p连接
-		if !isSuccess {
-			fmt.Println("p2p连接失败")
-			NotifyStatus("fail")
-			continue
-		} else {
-			NotifyStatus("success")
+		// 等待浏览器发来的请求
+		var req connectRequest
+		select {
+		case req = <-rosUuid_chan:
+		case <-ctx.Done():
+			return
 		}
 
-		// 如果p2p连接成功,则尝试从agent的通道中读取数据，并发送给浏览器
-		if isSuccess {
-			fmt.Println("P2P直连成功")
-			go func() {
-				for {
-					content := <-localAgent.ChannelData
-					// 如果连接已经中断，通知浏览器并中断循环
-					if content == "EOF" {
-						NotifyStatus("disconnected")
-						break
-					}
-					err := dataConn.WriteMessage(websocket.TextMessage, []byte(content))
-					if err != nil {
-						fmt.Println("消息转发给浏览器失败:", err.Error())
-					} else {
-						fmt.Println("消息转发给浏览器成功")
-					}
-				}
-			}()
+		switch req.Op {
+		case opStatus:
+			reportStatus()
+		case opDisconnect:
+			go closeRobot(req.UUID)
+		case "", opConnect:
+			if req.UUID == "" {
+				continue
+			}
+			// 每个机器人各有一个Agent，连接请求由其依次处理，互不阻塞
+			r, err := openRobot(ctx, req.UUID)
+			if err != nil {
+				fmt.Println("初始化失败:", err.Error())
+				notifyControl(map[string]string{"peer": req.UUID, "status": "fail"})
+				continue
+			}
+			go r.request(req)
+		default:
+			fmt.Println("未知的请求:", req.Op)
 		}
 	}
 }
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	agent "P2PAgent/Agent"
+	common "P2PAgent/Common"
+	frame "P2PAgent/Frame"
+	protocol "P2PAgent/Protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+同时连接多个机器人：浏览器在控制连接上每请求一个机器人的uuid，localAgent就为其运行一个独立的Agent。
+
+1. 各个Agent使用同一个身份密钥，uuid相同，机器人上的授权(配对)对所有的Agent都有效。
+   Agent以机器人的uuid作为实例名注册到中继服务器，彼此不会替换。
+2. 每个Agent使用各自的本地端口，从Local_port开始，跳过其他Agent使用的、以及tcp或udp无法监听的端口。
+   p2p连接、会话恢复和重连都互不影响，某个机器人断开或重连时，其他机器人的连接保持不变。
+3. 浏览器的数据连接通过/data?peer=<uuid>&stream=<label>指定机器人，不指定peer时使用最近连接的机器人。
+   Local_forwards中的本地端口同样对应最近连接的机器人；Robot_forwards按机器人的uuid配置本地端口，每个端口固定对应一个机器人。
+4. 控制连接上的状态消息带有peer字段，指明是哪个机器人的状态。浏览器发送{"op":"status"}时，
+   localAgent回复每个机器人当前的状态；发送{"op":"disconnect","uuid":...}时断开与该机器人的连接并关闭对应的Agent。
+*/
+
+// 浏览器在控制连接上的请求
+const (
+	opConnect    = "connect"
+	opDisconnect = "disconnect"
+	opStatus     = "status"
+)
+
+// 一个机器人，以及与其连接的Agent
+type robot struct {
+	// 机器人(ros_agent)的uuid，同时作为Agent的实例名
+	uuid string
+
+	// 与该机器人连接的Agent
+	agent *agent.Agent
+
+	// 取消Agent的事件订阅
+	unsubscribe func()
+
+	// 浏览器对该机器人的连接请求，由run依次处理
+	requests chan connectRequest
+
+	// 断开与机器人的连接时被取消
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// run退出后被关闭
+	done chan struct{}
+
+	// 保护以下字段
+	mu sync.Mutex
+
+	// 机器人上报的NAT探测结果，随p2p连接状态一起告知浏览器
+	peerNAT *protocol.NATInfo
+
+	// 最近一次告知浏览器的状态，浏览器查询时再次发送
+	status map[string]string
+
+	// p2p连接建立的时间，为零表示当前未连接。未指定机器人的数据连接使用最近连接的机器人
+	since time.Time
+}
+
+// 所有的机器人，键为uuid
+var robots = make(map[string]*robot)
+var robotsLock sync.Mutex
+
+// 连接中继服务器时的TLS配置，各个Agent共用
+var relayTLS *tls.Config
+
+// 返回与uuid连接的机器人，不存在时创建新的Agent，并在后台连接中继服务器
+func openRobot(ctx context.Context, uuid string) (*robot, error) {
+	if r := lookupRobot(uuid); r != nil {
+		return r, nil
+	}
+
+	// InitAgent较慢，不持有robotsLock，期间其他的数据连接仍可查找机器人
+	a, err := startAgent(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &robot{
+		uuid:     uuid,
+		agent:    a,
+		requests: make(chan connectRequest),
+		done:     make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	robotsLock.Lock()
+	delete(reservedPorts, a.LocalPort)
+	if existing := robots[uuid]; existing != nil {
+		robotsLock.Unlock()
+		a.Close()
+		r.cancel()
+		return existing, nil
+	}
+	robots[uuid] = r
+	robotsLock.Unlock()
+
+	events, unsubscribe := a.Subscribe()
+	r.unsubscribe = unsubscribe
+	fmt.Println("为机器人", uuid, "启动Agent，本地端口:", a.LocalPort)
+
+	go r.handleEvents(events)
+	go r.run()
+	return r, nil
+}
+
+// 为机器人uuid创建Agent，使用从Local_port开始第一个未被占用的端口。
+// 成功时Agent的端口仍在reservedPorts中，由调用方在记录机器人之后释放
+func startAgent(uuid string) (*agent.Agent, error) {
+	robotsLock.Lock()
+	port, err := reservePort(common.Local_port)
+	robotsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &agent.Agent{
+		Instance:    uuid,
+		Controlling: true,
+		RelayTLS:    relayTLS,
+		RelayToken:  common.Relay_token,
+		QUIC:        common.Use_quic,
+	}
+	if err := a.InitAgent(port); err != nil {
+		a.Close()
+		robotsLock.Lock()
+		delete(reservedPorts, port)
+		robotsLock.Unlock()
+		return nil, err
+	}
+	return a, nil
+}
+
+// 最多尝试的本地端口数量
+const portAttempts = 100
+
+// 正在初始化的Agent预留的端口，由robotsLock保护
+var reservedPorts = make(map[int]bool)
+
+// 从from开始，选出一个未被其他Agent使用、且可以监听的端口并预留，调用方持有robotsLock
+func reservePort(from int) (int, error) {
+	used := make(map[int]bool, len(robots))
+	for _, r := range robots {
+		used[r.agent.LocalPort] = true
+	}
+	for port := from; port < common.Local_port+portAttempts; port++ {
+		if used[port] || reservedPorts[port] || !portAvailable(port) {
+			continue
+		}
+		reservedPorts[port] = true
+		return port, nil
+	}
+	return 0, fmt.Errorf("从%d开始的%d个本地端口都已被占用", common.Local_port, portAttempts)
+}
+
+// 端口的tcp和udp是否都可以被监听，用于跳过被其他程序占用的端口
+func portAvailable(port int) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	pc.Close()
+	return true
+}
+
+// 查找uuid对应的机器人，uuid为空时返回最近连接的机器人。不存在时返回nil
+func lookupRobot(uuid string) *robot {
+	robotsLock.Lock()
+	defer robotsLock.Unlock()
+	if uuid != "" {
+		return robots[uuid]
+	}
+	var latest *robot
+	var latestSince time.Time
+	for _, r := range robots {
+		r.mu.Lock()
+		since := r.since
+		r.mu.Unlock()
+		if !since.IsZero() && since.After(latestSince) {
+			latest, latestSince = r, since
+		}
+	}
+	return latest
+}
+
+// 断开与机器人的连接，关闭对应的Agent并释放其本地端口
+func closeRobot(uuid string) {
+	robotsLock.Lock()
+	r := robots[uuid]
+	delete(robots, uuid)
+	robotsLock.Unlock()
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+	r.agent.Close()
+	r.unsubscribe()
+	fmt.Println("已断开与机器人的连接:", uuid)
+	r.notifyStatus("closed")
+}
+
+// 断开与所有机器人的连接
+func closeRobots() {
+	robotsLock.Lock()
+	uuids := make([]string, 0, len(robots))
+	for uuid := range robots {
+		uuids = append(uuids, uuid)
+	}
+	robotsLock.Unlock()
+	for _, uuid := range uuids {
+		closeRobot(uuid)
+	}
+}
+
+// 将浏览器的连接请求交给run处理，机器人被断开时放弃
+func (r *robot) request(req connectRequest) {
+	select {
+	case r.requests <- req:
+	case <-r.ctx.Done():
+	}
+}
+
+// 连接中继服务器，然后依次处理浏览器的连接请求，直到与机器人断开
+func (r *robot) run() {
+	defer close(r.done)
+	ctx := r.ctx
+
+	// 连接服务器
+	for {
+		err := r.agent.ConnectToRelay(ctx, common.Relay_addr)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+			continue
+		}
+		fmt.Println("connected to relayServer:", r.uuid)
+		break
+	}
+
+	for {
+		// 等待浏览器发来的连接请求
+		var req connectRequest
+		select {
+		case req = <-r.requests:
+		case <-ctx.Done():
+			return
+		}
+
+		// 请求目标uuid的节点的信息，等待服务器回传对端节点的信息。带有配对码时请求与其配对
+		var peer *protocol.PeerInfo
+		var err error
+		if req.PairingCode != "" {
+			peer, err = r.agent.RequestForPairing(ctx, r.uuid, req.PairingCode)
+		} else {
+			peer, err = r.agent.RequestForAddr(ctx, r.uuid)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("请求对端节点信息失败" + err.Error())
+			// 错误处理
+			var protoErr *protocol.Error
+			if errors.As(err, &protoErr) && protoErr.Code == protocol.ErrCodeUnknownPeer {
+				r.notifyStatus("Invalid robotID")
+			} else if errors.As(err, &protoErr) && protoErr.Code == protocol.ErrCodePeerOffline {
+				// 机器人注册过，但当前不在线
+				r.notifyStatus("Robot offline")
+			} else if errors.As(err, &protoErr) && protoErr.Code == protocol.ErrCodeUnauthorized {
+				// 尚未与机器人配对，或机器人不在配对中
+				r.notifyStatus("unauthorized")
+			} else {
+				r.notifyStatus("fail")
+			}
+			continue
+		}
+		for _, cand := range peer.Candidates {
+			fmt.Println("对端的候选地址:", cand.Type, cand.Address)
+		}
+		fmt.Println("本机的NAT类型:", r.agent.NAT(), " 对端的NAT类型:", peer.NAT)
+		r.mu.Lock()
+		r.peerNAT = peer.NAT
+		r.mu.Unlock()
+
+		// 在尝试连接之前，先关掉可能的已有连接，防止端口占用
+		r.agent.CloseP2P(frame.CloseNormal, "重新连接")
+
+		// 同时尝试对端的所有候选地址，使用最先连通的一条路径
+		pair, err := r.agent.DailP2P(ctx, peer)
+		if ctx.Err() != nil {
+			return
+		}
+		// 通知浏览器，是否成功建立p2p连接。成功时由handleEvents通知，并将浏览器的数据连接关联到p2p连接上的流
+		if errors.Is(err, agent.ErrUnauthorized) {
+			fmt.Println("机器人拒绝了连接:", err.Error())
+			r.notifyStatus("unauthorized")
+			continue
+		} else if err != nil {
+			fmt.Println("p2p连接失败")
+			r.notifyStatus("fail")
+			continue
+		}
+		if pair.Relayed() {
+			fmt.Println("P2P直连失败，通过中继服务器转发:", pair)
+		} else {
+			fmt.Println("P2P直连成功:", pair)
+		}
+	}
+}
+
+// 处理Agent的事件，直到与机器人断开
+func (r *robot) handleEvents(events <-chan agent.Event) {
+	for {
+		var ev agent.Event
+		var ok bool
+		select {
+		case ev, ok = <-events:
+			if !ok {
+				return
+			}
+		case <-r.ctx.Done():
+			return
+		}
+		switch ev.Type {
+		case agent.EventPeerConnected:
+			// 通知浏览器p2p连接已建立，并将浏览器的数据连接关联到p2p连接上的流。自动重连后同样如此
+			r.mu.Lock()
+			r.since = time.Now()
+			r.mu.Unlock()
+			r.notifyConnected(ev.Pair.Relayed())
+			attachDataSessions(r)
+		case agent.EventPeerSuspended:
+			// 连接意外断开，Agent正在重连，流保持不变
+			fmt.Println("p2p连接中断，正在重连:", r.uuid, ev.Cause.Code, ev.Cause.Reason)
+			r.notifyStatus("reconnecting")
+		case agent.EventPeerResumed:
+			// 会话已恢复，断开期间的数据会被重发
+			fmt.Println("p2p会话已恢复:", r.uuid, ev.Pair)
+			r.notifyConnected(ev.Pair.Relayed())
+		case agent.EventPeerDisconnected:
+			// 如果连接已经中断，通知浏览器
+			fmt.Println("p2p连接断开:", r.uuid, ev.Cause.Code, ev.Cause.Reason)
+			r.mu.Lock()
+			r.since = time.Time{}
+			r.mu.Unlock()
+			r.notifyStatus("disconnected")
+		case agent.EventPathChanged:
+			// 流保持不变，只需记录新的路径
+			fmt.Println("p2p连接迁移到新的路径:", r.uuid, ev.Pair)
+		case agent.EventMessage:
+			// 数据都通过流进行传输，不再处理未经流发送的数据
+			fmt.Println("忽略未经流发送的数据,大小:", len(ev.Payload))
+		case agent.EventError:
+			fmt.Println("p2p连接出现错误:", r.uuid, ev.Err.Error())
+		}
+	}
+}
+
+// 发消息给浏览器，告知与该机器人的p2p连接的状态
+func (r *robot) notifyStatus(status string) {
+	r.notify(map[string]string{"status": status})
+}
+
+// 发消息给浏览器，告知与该机器人的p2p连接已建立，以及是否经过中继服务器转发
+func (r *robot) notifyConnected(relayed bool) {
+	r.notify(map[string]string{"status": "success", "relayed": strconv.FormatBool(relayed)})
+}
+
+// 附带机器人的uuid和双方的NAT类型(便于排查无法直连的原因)，发送给浏览器并记录下来
+func (r *robot) notify(data map[string]string) {
+	data["peer"] = r.uuid
+	data["nat"] = r.agent.NAT().String()
+	r.mu.Lock()
+	if r.peerNAT != nil {
+		data["peerNat"] = r.peerNAT.String()
+	}
+	r.status = data
+	r.mu.Unlock()
+	if notifyControl(data) {
+		fmt.Println("成功通知浏览器，机器人", r.uuid, "的p2p连接状态:", data["status"])
+	}
+}
+
+// 将每个机器人最近的状态再次发送给浏览器，尚未有状态的机器人为connecting
+func reportStatus() {
+	robotsLock.Lock()
+	list := make([]*robot, 0, len(robots))
+	for _, r := range robots {
+		list = append(list, r)
+	}
+	robotsLock.Unlock()
+	for _, r := range list {
+		r.mu.Lock()
+		data := r.status
+		r.mu.Unlock()
+		if data == nil {
+			data = map[string]string{"peer": r.uuid, "status": "connecting"}
+		}
+		notifyControl(data)
+	}
+}
+
+// 向浏览器的所有控制连接发送一条json消息，返回是否至少发送成功了一条
+func notifyControl(data map[string]string) bool {
+	body, _ := json.Marshal(data)
+	controlLock.Lock()
+	defer controlLock.Unlock()
+	sent := false
+	for conn := range controlConns {
+		if err := conn.WriteMessage(websocket.TextMessage, body); err != nil {
+			fmt.Println("fail:" + err.Error())
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
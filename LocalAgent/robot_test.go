@@ -0,0 +1,40 @@
+package main
+
+import (
+	common "P2PAgent/Common"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestReservePort(t *testing.T) {
+	// 被其他程序占用的端口被跳过
+	if ln, err := net.Listen("tcp", fmt.Sprintf(":%d", common.Local_port)); err == nil {
+		defer ln.Close()
+	}
+	robotsLock.Lock()
+	defer robotsLock.Unlock()
+	defer func() {
+		for port := range reservedPorts {
+			delete(reservedPorts, port)
+		}
+	}()
+
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		port, err := reservePort(common.Local_port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port == common.Local_port {
+			t.Fatal("选中了已被占用的端口")
+		}
+		if seen[port] {
+			t.Fatalf("端口%d被重复预留", port)
+		}
+		if !portAvailable(port) {
+			t.Fatalf("端口%d无法监听", port)
+		}
+		seen[port] = true
+	}
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+/*
+候选地址：一个节点可能通过多个地址被连接到，类似ICE，每个地址作为一个候选，并带有优先级。
+host:  本机网卡上的地址，由Agent枚举得到
+srflx: 中继服务器观察到的公网地址(server reflexive)，由中继服务器添加
+prflx: 对端连接进来时使用的、不在候选地址列表中的地址(peer reflexive)，由Agent在连通性检查时发现
+relay: 中继服务器上的数据转发地址，双方都连接到中继服务器，由其转发字节流。只在直连失败时使用
+*/
+
+// 候选地址的类型
+type CandidateType string
+
+const (
+	CandidateHost  CandidateType = "host"
+	CandidateSrflx CandidateType = "srflx"
+	CandidatePrflx CandidateType = "prflx"
+	CandidateRelay CandidateType = "relay"
+)
+
+// 各类型候选地址的类型偏好，越大越优先
+func (t CandidateType) Preference() uint32 {
+	switch t {
+	case CandidateHost:
+		return 126
+	case CandidatePrflx:
+		return 110
+	case CandidateSrflx:
+		return 100
+	}
+	return 0
+}
+
+// Candidate 一个候选地址
+type Candidate struct {
+	Type CandidateType `json:"type"`
+
+	// 网络类型，tcp4、tcp6、udp4或udp6
+	Network string `json:"network"`
+
+	// ip:port
+	Address string `json:"address"`
+
+	// 优先级，越大越优先
+	Priority uint32 `json:"priority"`
+}
+
+// CandidatePriority 计算候选地址的优先级，localPref用于区分同类型的不同地址
+func CandidatePriority(t CandidateType, localPref uint16) uint32 {
+	return t.Preference()<<24 | uint32(localPref)<<8 | 255
+}
+
+// NetworkOf 根据ip判断网络类型
+func NetworkOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// UDPNetworkOf 根据ip判断UDP的网络类型
+func UDPNetworkOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// IsUDP 是否为UDP候选地址
+func (c *Candidate) IsUDP() bool {
+	return strings.HasPrefix(c.Network, "udp")
+}
+
+// SortCandidates 按照优先级从高到低排序
+func SortCandidates(cands []Candidate) {
+	sort.SliceStable(cands, func(i, j int) bool {
+		return cands[i].Priority > cands[j].Priority
+	})
+}
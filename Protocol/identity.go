@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+/*
+节点的身份：每个Agent持有一个ed25519密钥对，节点的id(uuid)由公钥派生，见PeerID。
+因此id本身即可校验公钥：任何人都无法在不持有私钥的情况下使用某个节点的id。
+
+1. 注册时，中继服务器在hello响应中下发一个随机挑战，Agent在register请求中携带公钥和对挑战的签名。
+   中继服务器校验签名后，以公钥派生的id作为该节点的uuid。
+2. p2p连接上的TLS握手中，双方检查对端证书中的公钥派生的id是否为预期的对端uuid，
+   中继服务器即使篡改了交换的地址，也无法冒充任一方。
+*/
+
+// hello响应中随机挑战的长度
+const ChallengeSize = 32
+
+// 参与id派生的公钥摘要的字节数，编码后为32个字符
+const peerIDBytes = 20
+
+// 注册签名的前缀，避免签名被用于其他用途
+const registerContext = "P2PAgent register:"
+
+var peerIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// PeerID 由公钥派生节点的id：公钥sha256摘要的前20个字节，以小写的base32编码
+func PeerID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return strings.ToLower(peerIDEncoding.EncodeToString(sum[:peerIDBytes]))
+}
+
+// RegisterSigningData register请求中被签名的数据
+func RegisterSigningData(challenge []byte) []byte {
+	return append([]byte(registerContext), challenge...)
+}
+
+// VerifyRegister 校验register请求中对挑战的签名，成功时返回公钥派生的id
+func VerifyRegister(pub []byte, challenge []byte, sig []byte) (string, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return "", errors.New("公钥长度错误")
+	}
+	if len(challenge) != ChallengeSize {
+		return "", errors.New("尚未下发挑战")
+	}
+	if !ed25519.Verify(pub, RegisterSigningData(challenge), sig) {
+		return "", errors.New("签名校验失败")
+	}
+	return PeerID(pub), nil
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestPeerID(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := PeerID(pub)
+	if len(id) != 32 || id != strings.ToLower(id) {
+		t.Fatalf("id格式不正确: %q", id)
+	}
+	if PeerID(pub) != id {
+		t.Fatal("同一公钥派生的id不一致")
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if PeerID(other) == id {
+		t.Fatal("不同公钥派生出相同的id")
+	}
+}
+
+func TestVerifyRegister(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := make([]byte, ChallengeSize)
+	rand.Read(challenge)
+	otherChallenge := make([]byte, ChallengeSize)
+	rand.Read(otherChallenge)
+	sig := ed25519.Sign(key, RegisterSigningData(challenge))
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name      string
+		pub       []byte
+		challenge []byte
+		sig       []byte
+		wantOK    bool
+	}{
+		{name: "正确的签名", pub: pub, challenge: challenge, sig: sig, wantOK: true},
+		{name: "公钥长度错误", pub: pub[:16], challenge: challenge, sig: sig},
+		{name: "未下发挑战", pub: pub, challenge: nil, sig: sig},
+		{name: "其他挑战的签名", pub: pub, challenge: otherChallenge, sig: sig},
+		{name: "其他密钥的签名", pub: pub, challenge: challenge, sig: ed25519.Sign(otherKey, RegisterSigningData(challenge))},
+		{name: "没有前缀的签名", pub: pub, challenge: challenge, sig: ed25519.Sign(key, challenge)},
+		{name: "空签名", pub: pub, challenge: challenge, sig: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := VerifyRegister(tt.pub, tt.challenge, tt.sig)
+			if (err == nil) != tt.wantOK {
+				t.Fatalf("返回%v，预期成功=%v", err, tt.wantOK)
+			}
+			if tt.wantOK && id != PeerID(pub) {
+				t.Fatalf("返回的id为%s，预期%s", id, PeerID(pub))
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+控制协议的消息格式
+
+连接建立后，Agent首先发送hello请求，与中继服务器确认双方使用相同的协议版本(Version)，之后才能发送其他请求。
+中继服务器配置了部署令牌时，还需先发送auth请求证明持有令牌，见token.go。
+register请求需要对hello响应中的随机挑战签名，见identity.go。
+节点可以在register和setAccess中声明访问策略，此后中继服务器只向策略允许的节点交换该节点的地址。
+每个请求都带有一个由发送方分配的id，对应的响应带有相同的id，用于将响应与请求对应起来。
+通知没有id，也不需要响应，例如中继服务器推送给被连接方的peerInfo。
+中继服务器也会向Agent发送ping请求，用于测量往返时延；Agent同样定期发送ping作为心跳，长时间收不到任何消息的一方断开连接。
+
+直连失败时，双方各自与中继服务器建立一条新的连接，完成hello后发送relay请求。
+中继服务器等到双方都到达后回复relay响应，之后该连接不再传输消息，中继服务器在两条连接之间原样转发字节流。
+*/
+
+// 当前的协议版本。版本2起，地址以候选地址列表的形式交换；版本3起，注册时需要证明持有身份密钥
+const Version = 3
+
+// 消息的种类
+type Kind string
+
+const (
+	KindRequest      Kind = "request"
+	KindResponse     Kind = "response"
+	KindNotification Kind = "notification"
+)
+
+// 请求和通知的方法名
+const (
+	// 确认协议版本
+	MethodHello = "hello"
+
+	// 证明持有部署令牌。中继服务器配置了令牌时，hello之后必须先完成auth
+	MethodAuth = "auth"
+
+	// 注册本机的uuid和地址
+	MethodRegister = "register"
+
+	// 请求目标节点的地址，并将本机的地址通知给目标节点
+	MethodExchangeInfo = "exchangeInfo"
+
+	// 由中继服务器发给Agent，用于测量往返时延；也由Agent发给中继服务器作为心跳。收到后回复空的响应即可
+	MethodPing = "ping"
+
+	// 在新的连接上请求中继服务器转发与对端之间的数据，响应之后连接即成为转发通道
+	MethodRelay = "relay"
+
+	// 上报本机NAT的探测结果，中继服务器在交换信息时告知对端
+	MethodReportNAT = "reportNAT"
+
+	// 更新本机的访问策略，例如配对成功或开始、结束配对时
+	MethodSetAccess = "setAccess"
+
+	// 通知：有节点请求与本机建立连接
+	NotifyPeerInfo = "peerInfo"
+)
+
+// 错误码枚举
+type ErrorCode int
+
+const (
+	// 请求格式错误
+	ErrCodeBadRequest ErrorCode = 1
+
+	// 目标uuid不存在
+	ErrCodeUnknownPeer ErrorCode = 2
+
+	// 没有双方都支持的协议版本
+	ErrCodeUnsupportedVersion ErrorCode = 3
+
+	// 不支持的方法
+	ErrCodeUnknownMethod ErrorCode = 4
+
+	// 尚未完成hello或register
+	ErrCodeNotRegistered ErrorCode = 5
+
+	// 转发会话不存在、已过期，或等待对端超时
+	ErrCodeRelayFailed ErrorCode = 6
+
+	// 身份或令牌校验失败，或未被目标节点授权
+	ErrCodeUnauthorized ErrorCode = 7
+
+	// 目标uuid注册过，但当前不在线
+	ErrCodePeerOffline ErrorCode = 8
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrCodeBadRequest:
+		return "bad request"
+	case ErrCodeUnknownPeer:
+		return "unknown peer"
+	case ErrCodeUnsupportedVersion:
+		return "unsupported version"
+	case ErrCodeUnknownMethod:
+		return "unknown method"
+	case ErrCodeNotRegistered:
+		return "not registered"
+	case ErrCodeRelayFailed:
+		return "relay failed"
+	case ErrCodeUnauthorized:
+		return "unauthorized"
+	case ErrCodePeerOffline:
+		return "peer offline"
+	}
+	return fmt.Sprintf("unknown(%d)", int(c))
+}
+
+// Error 响应中携带的错误
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("protocol: %s: %s", e.Code, e.Message)
+}
+
+// Message 控制协议上传输的一条消息
+type Message struct {
+	Kind   Kind            `json:"kind"`
+	ID     uint64          `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// DecodeBody 将消息体解析到v中
+func (m *Message) DecodeBody(v interface{}) error {
+	if len(m.Body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Body, v)
+}
+
+// NewRequest 构造一个请求
+func NewRequest(id uint64, method string, body interface{}) (*Message, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Kind: KindRequest, ID: id, Method: method, Body: raw}, nil
+}
+
+// NewResponse 构造请求req的成功响应
+func NewResponse(req *Message, body interface{}) (*Message, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Kind: KindResponse, ID: req.ID, Method: req.Method, Body: raw}, nil
+}
+
+// NewErrorResponse 构造请求req的错误响应
+func NewErrorResponse(req *Message, code ErrorCode, message string) *Message {
+	return &Message{Kind: KindResponse, ID: req.ID, Method: req.Method, Error: &Error{Code: code, Message: message}}
+}
+
+// NewNotification 构造一个通知
+func NewNotification(method string, body interface{}) (*Message, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Kind: KindNotification, Method: method, Body: raw}, nil
+}
+
+// HelloRequest 确认协议版本的请求
+type HelloRequest struct {
+	// 请求方支持的协议版本。各版本之间的消息不兼容，中继服务器只接受包含Version的请求
+	Versions []int `json:"versions"`
+}
+
+// HelloResponse 确认协议版本的响应
+type HelloResponse struct {
+	// 中继服务器使用的协议版本，即Version
+	Version int `json:"version"`
+
+	// 随机挑战，register请求中需要对其签名，auth请求中需要以令牌对其计算HMAC
+	Challenge []byte `json:"challenge"`
+}
+
+// AuthRequest 证明持有部署令牌
+type AuthRequest struct {
+	// TokenProof(令牌, 挑战)
+	Proof []byte `json:"proof"`
+}
+
+// RegisterRequest 注册本机的身份和地址，本机的uuid由公钥派生
+type RegisterRequest struct {
+	// 本机的ed25519身份公钥
+	PublicKey []byte `json:"publicKey"`
+
+	// 用身份私钥对RegisterSigningData(挑战)的签名
+	Signature []byte `json:"signature"`
+
+	// 本机的host候选地址
+	Candidates []Candidate `json:"candidates,omitempty"`
+
+	// 本机的访问策略，为nil表示任何节点都可以请求本机的地址
+	Access *AccessPolicy `json:"access,omitempty"`
+
+	// 同一身份同时运行多个Agent时用于区分各个实例，为空表示主实例。
+	// 不同实例的注册互不替换；设置了实例名的Agent只能请求其他节点的地址，不能作为目标节点
+	Instance string `json:"instance,omitempty"`
+}
+
+// AccessPolicy 节点的访问策略，中继服务器据此决定是否向请求方交换该节点的地址。也是setAccess请求的内容
+type AccessPolicy struct {
+	// 被授权的节点的uuid
+	Authorized []string `json:"authorized"`
+
+	// 是否正在配对。配对期间，携带Pairing的exchangeInfo请求也会被放行，由节点自己校验配对码
+	Pairing bool `json:"pairing,omitempty"`
+}
+
+// Allows 是否允许uuid为id的节点请求本机的地址，pairing为请求方是否请求配对
+func (p *AccessPolicy) Allows(id string, pairing bool) bool {
+	if p == nil {
+		return true
+	}
+	if pairing && p.Pairing {
+		return true
+	}
+	for _, a := range p.Authorized {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterResponse 注册的结果
+type RegisterResponse struct {
+	// 本机的uuid，即公钥派生的id
+	UUID string `json:"uuid"`
+
+	// 中继服务器观察到的本机公网地址
+	PubAddr string `json:"pubAddr"`
+
+	// 中继服务器为本机添加的srflx候选地址
+	Srflx *Candidate `json:"srflx,omitempty"`
+
+	// 本次注册的绑定令牌，绑定请求携带它时中继服务器才记录本机UDP端口的地址
+	BindingToken []byte `json:"bindingToken,omitempty"`
+}
+
+// ExchangeInfoRequest 请求目标节点的地址
+type ExchangeInfoRequest struct {
+	TargetUUID string `json:"targetUUID"`
+
+	// 请求与目标节点配对，配对码只在p2p连接上发送，不经过中继服务器
+	Pairing bool `json:"pairing,omitempty"`
+}
+
+// PeerInfo 一个节点的地址信息。既是exchangeInfo的响应，也是peerInfo通知的内容
+type PeerInfo struct {
+	UUID string `json:"uuid"`
+
+	// 节点的全部候选地址，包括host和srflx，按优先级从高到低排列
+	Candidates []Candidate `json:"candidates"`
+
+	// 收到该消息后，等待多少毫秒再开始连接对端。
+	// 中继服务器按照与双方的往返时延计算该值，使双方在同一时刻开始打洞
+	PunchDelay int64 `json:"punchDelay,omitempty"`
+
+	// 中继服务器为这次连接分配的转发会话，直连失败时使用
+	Relay *RelayInfo `json:"relay,omitempty"`
+
+	// 节点上报的NAT探测结果，为nil表示尚未上报
+	NAT *NATInfo `json:"nat,omitempty"`
+
+	// 该节点请求与本机配对。只出现在peerInfo通知中
+	Pairing bool `json:"pairing,omitempty"`
+}
+
+// RelayInfo 中继服务器分配的转发会话，双方的PeerInfo中携带相同的会话
+type RelayInfo struct {
+	// 会话的令牌，双方凭此在relay请求中找到彼此
+	Token string `json:"token"`
+}
+
+// RelayRequest 请求中继服务器转发数据
+type RelayRequest struct {
+	// 转发会话的令牌
+	Token string `json:"token"`
+
+	// 请求方的uuid，必须是会话的双方之一
+	UUID string `json:"uuid"`
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	req, err := NewRequest(7, MethodExchangeInfo, &ExchangeInfoRequest{TargetUUID: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(NewErrorResponse(req, ErrCodeUnknownPeer, "peer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(strings.Repeat("x", MaxMessageSize)); err != ErrMessageTooLarge {
+		t.Fatalf("超过最大长度的消息返回%v", err)
+	}
+
+	dec := NewDecoder(&buf)
+	var got Message
+	if err := dec.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	var body ExchangeInfoRequest
+	if err := got.DecodeBody(&body); err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != KindRequest || got.ID != 7 || got.Method != MethodExchangeInfo || body.TargetUUID != "peer" {
+		t.Fatalf("解析出的请求不正确: %+v %+v", got, body)
+	}
+	var resp Message
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Kind != KindResponse || resp.ID != 7 || resp.Error == nil || resp.Error.Code != ErrCodeUnknownPeer {
+		t.Fatalf("解析出的响应不正确: %+v", resp)
+	}
+}
+
+func TestAccessPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *AccessPolicy
+		id      string
+		pairing bool
+		want    bool
+	}{
+		{name: "未设置策略", policy: nil, id: "a", want: true},
+		{name: "已授权", policy: &AccessPolicy{Authorized: []string{"a", "b"}}, id: "b", want: true},
+		{name: "未授权", policy: &AccessPolicy{Authorized: []string{"a"}}, id: "c", want: false},
+		{name: "空列表", policy: &AccessPolicy{}, id: "a", want: false},
+		{name: "配对期间请求配对", policy: &AccessPolicy{Pairing: true}, id: "c", pairing: true, want: true},
+		{name: "配对期间不请求配对", policy: &AccessPolicy{Pairing: true}, id: "c", want: false},
+		{name: "未在配对时请求配对", policy: &AccessPolicy{Authorized: []string{"a"}}, id: "c", pairing: true, want: false},
+		{name: "已授权的节点请求配对", policy: &AccessPolicy{Authorized: []string{"a"}}, id: "a", pairing: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Allows(tt.id, tt.pairing); got != tt.want {
+				t.Fatalf("返回%v，预期%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import "fmt"
+
+/*
+NAT类型：Agent通过UDP绑定请求探测本机所在NAT的行为，类似RFC 5780，术语与RFC 4787相同。
+
+mapping:   NAT为本机端口分配的公网映射地址是否随目标地址变化。
+           向中继服务器的主地址和备用地址各发送一次绑定请求，两次的映射地址相同即为endpoint-independent，
+           不同即为对称型NAT，此时对端无法通过本机的srflx候选地址连接进来。
+filtering: NAT是否放行从未发送过报文的地址发来的报文。
+           请求中继服务器从备用地址回复绑定请求，能收到即说明放行。
+port preservation: 映射地址的端口是否与本机端口相同。
+
+只有一个备用地址，无法区分所有情况，按照备用地址与主地址的差别取最接近的结果：
+  备用地址只有端口不同：映射不同为address-and-port-dependent；能收到回复为address-dependent(也可能是endpoint-independent)，
+                        收不到为address-and-port-dependent。
+  备用地址的ip不同：    映射不同为address-dependent(也可能是address-and-port-dependent)；能收到回复为endpoint-independent，
+                        收不到为address-dependent(也可能是address-and-port-dependent)。
+中继服务器未配置备用地址时，mapping和filtering均为unknown。
+*/
+
+// NAT的映射或过滤行为
+type NATBehavior string
+
+const (
+	// 无法判断，例如中继服务器没有备用地址，或探测失败
+	NATUnknown NATBehavior = "unknown"
+
+	// 没有NAT，本机端口直接位于公网上。只用于mapping
+	NATNone NATBehavior = "none"
+
+	// 与目标地址无关
+	NATEndpointIndependent NATBehavior = "endpoint-independent"
+
+	// 与目标的ip有关，与端口无关
+	NATAddressDependent NATBehavior = "address-dependent"
+
+	// 与目标的ip和端口都有关
+	NATAddressAndPortDependent NATBehavior = "address-and-port-dependent"
+)
+
+// NATInfo 探测得到的本机NAT的行为
+type NATInfo struct {
+	Mapping   NATBehavior `json:"mapping"`
+	Filtering NATBehavior `json:"filtering"`
+
+	// UDP映射地址的端口是否与本机UDP端口相同
+	PortPreserved bool `json:"portPreserved"`
+
+	// 中继服务器观察到的tcp公网地址的端口是否与本机端口相同
+	TCPPortPreserved bool `json:"tcpPortPreserved"`
+
+	// 对称型NAT的端口预测，为nil表示不是对称型NAT或无法预测
+	Prediction *PortPrediction `json:"prediction,omitempty"`
+}
+
+// PortPrediction 对称型NAT为下一个新的目标地址分配的映射端口的预测。
+// NAT按固定的步长依次分配端口时，下一个端口在Base+Delta附近，中间被其他连接占用的端口越多，偏移越大，
+// 因此对端依次尝试Base+Delta、Base+2*Delta ... Base+Range*Delta
+type PortPrediction struct {
+	// 映射地址的ip
+	IP string `json:"ip"`
+
+	// 探测时最后一次分配的端口
+	Base int `json:"base"`
+
+	// 相邻两次分配的端口之差，可以为负数
+	Delta int `json:"delta"`
+
+	// 预测的端口个数
+	Range int `json:"range"`
+}
+
+// Ports 预测的全部端口，超出有效范围的端口被忽略
+func (p *PortPrediction) Ports() []int {
+	var ports []int
+	for i := 1; i <= p.Range; i++ {
+		port := p.Base + i*p.Delta
+		if port > 0 && port <= 65535 {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// Symmetric 是否为对称型NAT，即映射地址随目标地址变化。此时tcp打洞基本不可能成功
+func (n *NATInfo) Symmetric() bool {
+	return n != nil && (n.Mapping == NATAddressDependent || n.Mapping == NATAddressAndPortDependent)
+}
+
+func (n *NATInfo) String() string {
+	if n == nil {
+		return string(NATUnknown)
+	}
+	s := fmt.Sprintf("mapping=%s filtering=%s portPreserved=%t tcpPortPreserved=%t", n.Mapping, n.Filtering, n.PortPreserved, n.TCPPortPreserved)
+	if p := n.Prediction; p != nil {
+		s += fmt.Sprintf(" prediction=%s:%d%+d*[1,%d]", p.IP, p.Base, p.Delta, p.Range)
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+UDP控制报文
+
+Agent的UDP端口同时承载三种报文：发往中继服务器的绑定请求、与对端之间的连通性检查、p2p连接上的kcp或QUIC报文。
+控制报文以4个字节的魔数开头，以便与kcp、QUIC报文区分：
+| magic(4) | type(1) | body(json) |
+*/
+
+// 控制报文的魔数
+const PacketMagic = "P2PU"
+
+// 控制报文的最大长度
+const MaxPacketSize = 1400
+
+// UDP控制报文的类型
+type PacketType uint8
+
+const (
+	// Agent -> 中继服务器：查询本机UDP端口在公网上的映射地址，同时保持NAT映射
+	PacketBindingRequest PacketType = 1
+
+	// 中继服务器 -> Agent：中继服务器观察到的地址
+	PacketBindingResponse PacketType = 2
+
+	// Agent -> Agent：连通性检查
+	PacketCheck PacketType = 3
+
+	// Agent -> Agent：连通性检查的响应
+	PacketCheckResponse PacketType = 4
+
+	// 控制方 -> 被控制方：选中该路径作为p2p连接
+	PacketNominate PacketType = 5
+
+	// 被控制方 -> 控制方：确认选中
+	PacketNominateAck PacketType = 6
+)
+
+func (t PacketType) String() string {
+	switch t {
+	case PacketBindingRequest:
+		return "binding request"
+	case PacketBindingResponse:
+		return "binding response"
+	case PacketCheck:
+		return "check"
+	case PacketCheckResponse:
+		return "check response"
+	case PacketNominate:
+		return "nominate"
+	case PacketNominateAck:
+		return "nominate ack"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// 注册时下发的绑定令牌的长度
+const BindingTokenSize = 16
+
+// BindingRequest 绑定请求
+type BindingRequest struct {
+	// 发送方的uuid，中继服务器据此将UDP地址记录到对应的节点上
+	UUID string `json:"uuid"`
+
+	// 发送方的实例名，见RegisterRequest.Instance
+	Instance string `json:"instance,omitempty"`
+
+	// 注册时中继服务器下发的绑定令牌，与uuid对应的节点当前的令牌一致时才记录UDP地址，
+	// 否则只回复观察到的地址。UDP报文的来源无法验证，没有令牌时任何人都能替别人登记地址
+	Token []byte `json:"token,omitempty"`
+
+	// 要求中继服务器从备用地址回复，用于探测NAT的过滤行为。没有备用地址时从原地址回复
+	Change bool `json:"change,omitempty"`
+}
+
+// BindingResponse 绑定请求的响应
+type BindingResponse struct {
+	// 中继服务器观察到的ip:port
+	Address string `json:"address"`
+
+	// 中继服务器的备用UDP地址，用于探测NAT的行为，为空表示没有。ip未指定时与主地址的ip相同
+	OtherAddress string `json:"otherAddress,omitempty"`
+}
+
+// CheckPacket 连通性检查、选中以及它们的响应
+type CheckPacket struct {
+	// 发送方的uuid
+	UUID string `json:"uuid"`
+
+	// 选中时由控制方分配的会话编号
+	Conv uint32 `json:"conv,omitempty"`
+
+	// 选中时由控制方指定的传输协议，为空表示kcp
+	Transport string `json:"transport,omitempty"`
+}
+
+// 选中报文中表示使用QUIC的传输协议名
+const TransportQUIC = "quic"
+
+// EncodePacket 编码一个UDP控制报文
+func EncodePacket(t PacketType, body interface{}) ([]byte, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(PacketMagic)+1+len(raw))
+	b = append(b, PacketMagic...)
+	b = append(b, byte(t))
+	b = append(b, raw...)
+	if len(b) > MaxPacketSize {
+		return nil, ErrMessageTooLarge
+	}
+	return b, nil
+}
+
+// ParsePacket 解析UDP控制报文，不是控制报文时ok为false
+func ParsePacket(b []byte) (t PacketType, body []byte, ok bool) {
+	if len(b) < len(PacketMagic)+1 || string(b[:len(PacketMagic)]) != PacketMagic {
+		return 0, nil, false
+	}
+	return PacketType(b[len(PacketMagic)]), b[len(PacketMagic)+1:], true
+}
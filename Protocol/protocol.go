@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+该package定义了Agent与中继服务器之间的控制协议，由server和Agent共同使用
+
+每条消息为一个json对象，编码后以'\n'结尾，即换行分隔的json(ndjson)。
+json编码不会在对象内部产生换行，所以可以按行切分出完整的消息，
+不受tcp分片、粘包以及消息长度的影响
+*/
+
+// 单条消息的最大长度，超过后连接将无法继续使用
+const MaxMessageSize = 1024 * 1024
+
+var ErrMessageTooLarge = errors.New("protocol: 消息长度超过上限")
+
+// Encoder 将消息编码为一行json写入连接，可被多个goroutine并发使用
+type Encoder struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode 写入一条消息，整条消息在一次Write中写出，保证不会被其他写入打断
+func (e *Encoder) Encode(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) >= MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	body = append(body, '\n')
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(body)
+	return err
+}
+
+// Decoder 从连接中逐条读取消息
+type Decoder struct {
+	r *bufio.Reader
+
+	// 允许的最大消息长度
+	MaxSize int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), MaxSize: MaxMessageSize}
+}
+
+// Reader 解码器内部的缓冲读取器。连接不再传输消息、改作其他用途时，
+// 需要从该读取器继续读取，以免丢失已经读入缓冲区的数据
+func (d *Decoder) Reader() io.Reader {
+	return d.r
+}
+
+// Decode 读取下一条完整的消息，并解析到v中。空行会被忽略
+func (d *Decoder) Decode(v interface{}) error {
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		return json.Unmarshal(line, v)
+	}
+}
+
+// 读取一行，不包含结尾的换行符
+func (d *Decoder) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		part, err := d.r.ReadSlice('\n')
+		if len(line)+len(part) > d.MaxSize {
+			return nil, ErrMessageTooLarge
+		}
+		line = append(line, part...)
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	type msg struct {
+		N int `json:"n"`
+	}
+	tests := []struct {
+		name    string
+		input   string
+		maxSize int
+		want    []int
+		wantErr error
+	}{
+		{name: "空输入", input: "", want: nil, wantErr: io.EOF},
+		{name: "单条消息", input: "{\"n\":1}\n", want: []int{1}, wantErr: io.EOF},
+		{name: "多条消息", input: "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n", want: []int{1, 2, 3}, wantErr: io.EOF},
+		{name: "忽略空行", input: "\n\r\n{\"n\":1}\n\n{\"n\":2}\n", want: []int{1, 2}, wantErr: io.EOF},
+		{name: "CRLF结尾", input: "{\"n\":1}\r\n", want: []int{1}, wantErr: io.EOF},
+		{name: "最后一行不完整", input: "{\"n\":1}\n{\"n\":2}", want: []int{1}, wantErr: io.ErrUnexpectedEOF},
+		{name: "超过最大长度", input: "{\"n\":1}\n{\"n\":" + strings.Repeat("1", 64) + "}\n", maxSize: 32, want: []int{1}, wantErr: ErrMessageTooLarge},
+		{name: "超过缓冲区大小", input: "{\"n\":1" + strings.Repeat(" ", 8192) + "}\n", want: []int{1}, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			if tt.maxSize > 0 {
+				d.MaxSize = tt.maxSize
+			}
+			var got []int
+			var err error
+			for {
+				var m msg
+				if err = d.Decode(&m); err != nil {
+					break
+				}
+				got = append(got, m.N)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("返回%v，预期%v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("解析出%v，预期%v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("解析出%v，预期%v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoderSyntaxError(t *testing.T) {
+	d := NewDecoder(strings.NewReader("{\"n\":\n"))
+	var m Message
+	if err := d.Decode(&m); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("格式错误的消息返回%v", err)
+	}
+}
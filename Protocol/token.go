@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+/*
+部署令牌：与frp的token相同，中继服务器和所有Agent配置同一个令牌，中继服务器拒绝不持有令牌的客户端。
+
+令牌本身不在网络上传输。完成hello后，客户端发送auth请求，携带以令牌为密钥对hello响应中随机挑战的HMAC，
+中继服务器用自己的令牌计算后比对。即使控制连接未使用TLS，令牌也不会泄露，旧的auth请求也无法被重放。
+*/
+
+// 令牌证明的前缀，避免与注册签名等其他用途混淆
+const tokenContext = "P2PAgent token:"
+
+// TokenProof 以令牌为密钥，对挑战计算的HMAC-SHA256
+func TokenProof(token string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(tokenContext))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// VerifyTokenProof 校验客户端的令牌证明
+func VerifyTokenProof(token string, challenge []byte, proof []byte) bool {
+	if len(challenge) != ChallengeSize {
+		return false
+	}
+	return hmac.Equal(TokenProof(token, challenge), proof)
+}
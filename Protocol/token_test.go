@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestVerifyTokenProof(t *testing.T) {
+	challenge := make([]byte, ChallengeSize)
+	rand.Read(challenge)
+	otherChallenge := make([]byte, ChallengeSize)
+	rand.Read(otherChallenge)
+	proof := TokenProof("secret", challenge)
+
+	tests := []struct {
+		name      string
+		token     string
+		challenge []byte
+		proof     []byte
+		want      bool
+	}{
+		{name: "正确的证明", token: "secret", challenge: challenge, proof: proof, want: true},
+		{name: "令牌不同", token: "other", challenge: challenge, proof: proof},
+		{name: "重放其他挑战的证明", token: "secret", challenge: otherChallenge, proof: proof},
+		{name: "挑战长度错误", token: "secret", challenge: challenge[:8], proof: TokenProof("secret", challenge[:8])},
+		{name: "空证明", token: "secret", challenge: challenge, proof: nil},
+		{name: "截断的证明", token: "secret", challenge: challenge, proof: proof[:16]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyTokenProof(tt.token, tt.challenge, tt.proof); got != tt.want {
+				t.Fatalf("返回%v，预期%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	agent "P2PAgent/Agent"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+多个操作者同时连接机器人：每个操作者(localAgent)与rosAgent之间各有一条p2p连接，
+操作者打开的每个流各自建立与ros_server的连接，互不影响。
+
+控制策略：
+1. shared: 所有操作者都可以控制机器人。
+2. exclusive: 同一时刻只有一个操作者拥有控制权，最先连接的操作者获得控制权，其余的操作者为观察者。
+   观察者在rosbridge上只能订阅话题，发布话题、调用服务等请求被丢弃，并收到一条rosbridge的status消息；
+   观察者也不能打开tcp服务的流。
+3. 拥有控制权的操作者断开后(会话结束，暂停等待恢复时不算)，控制权为其保留一段时间(-grace)。
+   期间同一uuid重新连接时仍拥有控制权，否则到期后控制权交给最早连接的观察者。保留时间为0时立即移交。
+*/
+
+// 控制策略
+const (
+	policyShared    = "shared"
+	policyExclusive = "exclusive"
+)
+
+// 观察者可以在rosbridge上使用的操作
+var observerOps = map[string]bool{
+	"subscribe":   true,
+	"unsubscribe": true,
+	"set_level":   true,
+}
+
+// 一个已连接的操作者
+type operator struct {
+	// 操作者的uuid
+	uuid string
+
+	// 与操作者之间的p2p连接上的流多路复用器
+	mux *agent.Mux
+
+	// 建立连接的时间，控制权按该顺序移交
+	since time.Time
+}
+
+// 已连接的操作者，以及控制权的归属
+type operatorTable struct {
+	policy string
+
+	mu        sync.Mutex
+	operators map[string]*operator
+
+	// 拥有控制权的操作者的uuid，为空表示没有。其断开后的保留期内仍为该uuid
+	controller string
+
+	// 为断开的操作者保留控制权的时间，以及保留期的定时器，为nil表示不在保留期内
+	grace      time.Duration
+	graceTimer *time.Timer
+}
+
+func newOperatorTable(policy string, grace time.Duration) (*operatorTable, error) {
+	if policy != policyShared && policy != policyExclusive {
+		return nil, fmt.Errorf("未知的控制策略: %s", policy)
+	}
+	if grace < 0 {
+		return nil, fmt.Errorf("控制权的保留时间不能为负数: %v", grace)
+	}
+	return &operatorTable{policy: policy, operators: make(map[string]*operator), grace: grace}, nil
+}
+
+// 操作者建立了p2p连接。exclusive策略下，没有操作者拥有控制权时由其获得控制权；
+// 拥有控制权的操作者在保留期内重新连接时，保留其控制权
+func (t *operatorTable) add(uuid string, mux *agent.Mux) *operator {
+	op := &operator{uuid: uuid, mux: mux, since: time.Now()}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.operators[uuid] = op
+	if t.policy == policyExclusive && t.controller == "" {
+		t.controller = uuid
+	}
+	if t.controller == uuid && t.graceTimer != nil {
+		t.graceTimer.Stop()
+		t.graceTimer = nil
+	}
+	fmt.Println("操作者已连接:", uuid, "角色:", t.role(uuid), " 当前操作者数量:", len(t.operators))
+	return op
+}
+
+// 操作者的会话结束。其拥有控制权时，为其保留控制权，保留期结束后交给最早连接的操作者
+func (t *operatorTable) remove(uuid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.operators[uuid]; !ok {
+		return
+	}
+	delete(t.operators, uuid)
+	fmt.Println("操作者已断开:", uuid, " 当前操作者数量:", len(t.operators))
+	if t.controller != uuid {
+		return
+	}
+	if t.grace == 0 {
+		t.handOver()
+		return
+	}
+	fmt.Println("为", uuid, "保留控制权", t.grace)
+	var timer *time.Timer
+	timer = time.AfterFunc(t.grace, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.graceExpired(timer)
+	})
+	t.graceTimer = timer
+}
+
+// timer对应的保留期结束，移交控制权。期间已重新连接，或已开始新的保留期时不做处理，调用方持有mu
+func (t *operatorTable) graceExpired(timer *time.Timer) {
+	if timer == nil || t.graceTimer != timer {
+		return
+	}
+	t.graceTimer = nil
+	t.handOver()
+}
+
+// 将控制权交给最早连接的操作者，没有操作者时清空，调用方持有mu
+func (t *operatorTable) handOver() {
+	t.controller = ""
+	rest := make([]*operator, 0, len(t.operators))
+	for _, op := range t.operators {
+		rest = append(rest, op)
+	}
+	if len(rest) == 0 {
+		return
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].since.Before(rest[j].since) })
+	t.controller = rest[0].uuid
+	fmt.Println("控制权移交给:", t.controller)
+}
+
+// 操作者当前是否可以控制机器人
+func (t *operatorTable) canControl(uuid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.policy == policyShared || t.controller == uuid
+}
+
+// 操作者的角色，调用方持有mu
+func (t *operatorTable) role(uuid string) string {
+	if t.policy == policyShared || t.controller == uuid {
+		return "controller"
+	}
+	return "observer"
+}
+
+// rosbridge消息中用于判断权限的字段
+type rosbridgeOp struct {
+	Op string `json:"op"`
+	ID string `json:"id,omitempty"`
+}
+
+// 检查操作者发给rosbridge的消息是否被允许。不允许时返回回复给操作者的status消息
+func (t *operatorTable) filter(uuid string, msg []byte) (bool, []byte) {
+	if t.canControl(uuid) {
+		return true, nil
+	}
+	var req rosbridgeOp
+	if err := json.Unmarshal(msg, &req); err == nil && observerOps[req.Op] {
+		return true, nil
+	}
+	status, _ := json.Marshal(map[string]string{
+		"op":    "status",
+		"level": "error",
+		"id":    req.ID,
+		"msg":   fmt.Sprintf("观察者没有控制权，已拒绝%s请求", req.Op),
+	})
+	return false, status
+}
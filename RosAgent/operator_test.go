@@ -0,0 +1,165 @@
+package main
+
+import (
+	common "P2PAgent/Common"
+	"testing"
+	"time"
+)
+
+// 立即结束当前的保留期，不等待定时器
+func expireGrace(tb *operatorTable) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.graceTimer != nil {
+		tb.graceTimer.Stop()
+	}
+	tb.graceExpired(tb.graceTimer)
+}
+
+func TestOperatorControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// 保留时间为0，否则保留期只在调用expireGrace时结束
+		immediate bool
+		steps     func(tb *operatorTable)
+		want      map[string]bool
+	}{
+		{
+			name:   "共享",
+			policy: policyShared,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+			},
+			want: map[string]bool{"a": true, "b": true},
+		},
+		{
+			name:   "最先连接的操作者独占",
+			policy: policyExclusive,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+			},
+			want: map[string]bool{"a": true, "b": false},
+		},
+		{
+			name:   "保留期内其他操作者仍为观察者",
+			policy: policyExclusive,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+				tb.remove("a")
+			},
+			want: map[string]bool{"a": true, "b": false},
+		},
+		{
+			name:   "保留期内重新连接",
+			policy: policyExclusive,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+				tb.remove("a")
+				tb.add("a", nil)
+				expireGrace(tb)
+			},
+			want: map[string]bool{"a": true, "b": false},
+		},
+		{
+			name:   "保留期结束后移交",
+			policy: policyExclusive,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+				tb.add("c", nil).since = time.Now().Add(time.Hour)
+				tb.remove("a")
+				expireGrace(tb)
+			},
+			want: map[string]bool{"a": false, "b": true, "c": false},
+		},
+		{
+			name:   "保留期结束后没有操作者",
+			policy: policyExclusive,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.remove("a")
+				expireGrace(tb)
+				tb.add("b", nil)
+			},
+			want: map[string]bool{"a": false, "b": true},
+		},
+		{
+			name:   "观察者断开不影响控制权",
+			policy: policyExclusive,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+				tb.remove("b")
+				expireGrace(tb)
+			},
+			want: map[string]bool{"a": true, "b": false},
+		},
+		{
+			name:      "保留时间为0时立即移交",
+			policy:    policyExclusive,
+			immediate: true,
+			steps: func(tb *operatorTable) {
+				tb.add("a", nil)
+				tb.add("b", nil)
+				tb.remove("a")
+			},
+			want: map[string]bool{"a": false, "b": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grace := time.Hour
+			if tt.immediate {
+				grace = 0
+			}
+			tb, err := newOperatorTable(tt.policy, grace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { expireGrace(tb) })
+			tt.steps(tb)
+			for uuid, want := range tt.want {
+				if got := tb.canControl(uuid); got != want {
+					t.Fatalf("%s的控制权为%v，预期%v", uuid, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOperatorFilter(t *testing.T) {
+	tb, err := newOperatorTable(policyExclusive, common.Control_grace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.add("a", nil)
+	tb.add("b", nil)
+	tests := []struct {
+		uuid string
+		msg  string
+		want bool
+	}{
+		{uuid: "a", msg: `{"op":"publish","topic":"/cmd_vel"}`, want: true},
+		{uuid: "b", msg: `{"op":"subscribe","topic":"/odom"}`, want: true},
+		{uuid: "b", msg: `{"op":"publish","topic":"/cmd_vel"}`, want: false},
+		{uuid: "b", msg: `{"op":"call_service","service":"/reset"}`, want: false},
+		{uuid: "b", msg: `not json`, want: false},
+	}
+	for _, tt := range tests {
+		ok, status := tb.filter(tt.uuid, []byte(tt.msg))
+		if ok != tt.want || (ok == (status != nil)) {
+			t.Fatalf("%s发送%s: 返回%v %s，预期%v", tt.uuid, tt.msg, ok, status, tt.want)
+		}
+	}
+	if _, err := newOperatorTable("unknown", common.Control_grace); err == nil {
+		t.Fatal("未知的控制策略应返回错误")
+	}
+	if _, err := newOperatorTable(policyExclusive, -time.Second); err == nil {
+		t.Fatal("负数的保留时间应返回错误")
+	}
+}
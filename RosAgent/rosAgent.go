@@ -3,7 +3,16 @@ package main
 import (
 	agent "P2PAgent/Agent"
 	common "P2PAgent/Common"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,12 +21,31 @@ import (
 // ros的代理对象
 var rosAgent agent.Agent
 
-// 与ros_server建立的连接对象
-var roshandler *RosHandler
+// 配对码的有效期
+const pairingTTL = 10 * time.Minute
 
+// 启动时进行配对，以授权新的操作者。尚无被授权的操作者时总是进行配对
+var pairFlag = flag.Bool("pair", false, "生成一次性配对码，授权新的操作者")
+
+// 多个操作者同时连接时的控制策略
+var controlFlag = flag.String("control", common.Control_policy, "多个操作者同时连接时的控制策略: exclusive或shared")
+
+// 拥有控制权的操作者断开后，为其保留控制权的时间
+var graceFlag = flag.Duration("grace", common.Control_grace, "拥有控制权的操作者断开后为其保留控制权的时间，为0时立即移交")
+
+// 已连接的操作者
+var operators *operatorTable
+
+// 一个流与ros_server之间的连接对象，每个流独占一个与ros_server的websocket连接
 type RosHandler struct {
 	// 与ros_server的连接
 	RosConn *websocket.Conn
+
+	// 对应的p2p流
+	Stream *agent.Stream
+
+	// 打开该流的操作者的uuid
+	Operator string
 }
 
 // 从ros_server读取数据
@@ -25,29 +53,39 @@ func (s *RosHandler) rosRead() {
 	for {
 		_, msg, err := s.RosConn.ReadMessage()
 		if err != nil {
-			// 如果和ros_server的连接中断了，则同时断开p2p连接
-			if err.Error() == "EOF" {
-				rosAgent.P2PConn.Close()
-			}
+			// 如果和ros_server的连接中断了，则同时关闭对应的流
+			fmt.Println("ros_server连接中断:", err.Error())
+			s.Stream.Close()
 			return
 		}
-		cnt := len(msg)
-		fmt.Printf(">读取到%d个字节,ros_server发来内容:%s\n", cnt, string(msg))
-
-		// 自定义的包头
-		data_head := fmt.Sprintf("length:%-11d", cnt)
-
-		// 将包头和数据主体拼接
-		body := string(msg)
-		content := data_head + body
 		// 将读取到的内容，回传给p2p节点
-		if rosAgent.P2PConn != nil {
-			writeCnt, err := rosAgent.P2PConn.Write([]byte(content))
-			if err != nil {
-				fmt.Println("消息转发给对端节点失败" + err.Error())
-				continue
-			}
-			fmt.Println("消息转发给对端节点成功,大小:", writeCnt)
+		_, err = s.Stream.Write(msg)
+		if err != nil {
+			fmt.Println("消息转发给对端节点失败" + err.Error())
+			s.RosConn.Close()
+			return
+		}
+	}
+}
+
+// 从p2p流读取数据，发送给ros_server
+func (s *RosHandler) streamRead() {
+	for {
+		msg, err := s.Stream.ReadMessage()
+		if err != nil {
+			// 如果流关闭了，则同时断开与ros_server的连接
+			s.Close()
+			return
+		}
+		// 观察者只能订阅话题，其余的请求不转发给ros_server
+		if ok, status := operators.filter(s.Operator, msg); !ok {
+			fmt.Println("拒绝观察者的请求:", s.Operator)
+			s.Stream.Write(status)
+			continue
+		}
+		err = s.RosConn.WriteMessage(websocket.TextMessage, msg)
+		if err != nil {
+			fmt.Println("发送数据给ros_server失败:", err.Error())
 		}
 	}
 }
@@ -57,77 +95,203 @@ func (s *RosHandler) Close() {
 	s.RosConn.Close()
 }
 
+// 处理操作者打开的流，按照流的标签连接到对应的服务
+func handleStream(op *operator, st *agent.Stream) {
+	addr, ok := common.Ros_services[st.Label()]
+	if !ok {
+		fmt.Println("未知的服务:", st.Label())
+		st.Reject("未知的服务:" + st.Label())
+		return
+	}
+
+	// websocket服务，如rosbridge
+	if strings.HasPrefix(addr, "ws://") {
+		dialer := websocket.Dialer{}
+		rosConn, _, err := dialer.Dial(addr, nil)
+		if err != nil {
+			fmt.Println("连接ros_server失败:" + err.Error())
+			st.Reject("连接ros_server失败:" + err.Error())
+			return
+		}
+		fmt.Println("连接ros_server成功:", st.Label(), st.ID())
+		if err := st.Accept(); err != nil {
+			rosConn.Close()
+			return
+		}
+		handler := &RosHandler{RosConn: rosConn, Stream: st, Operator: op.uuid}
+		go handler.rosRead()
+		handler.streamRead()
+		return
+	}
+
+	// tcp服务，无法区分其中的请求，只允许拥有控制权的操作者使用
+	if !operators.canControl(op.uuid) {
+		fmt.Println("观察者不能使用该服务:", op.uuid, st.Label())
+		st.Reject("观察者不能使用该服务:" + st.Label())
+		return
+	}
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		fmt.Println("连接服务失败:" + err.Error())
+		st.Reject("连接服务失败:" + err.Error())
+		return
+	}
+	defer conn.Close()
+	if err := st.Accept(); err != nil {
+		return
+	}
+	defer st.Close()
+	go func() {
+		io.Copy(conn, st)
+		conn.Close()
+	}()
+	io.Copy(st, conn)
+}
+
+// 接受操作者在其p2p连接上打开的所有流
+func serveStreams(ctx context.Context, op *operator) {
+	for {
+		st, err := op.mux.Accept(ctx)
+		if err != nil {
+			return
+		}
+		go handleStream(op, st)
+	}
+}
+
+// 处理rosAgent的事件，直到取消订阅
+func handleEvents(ctx context.Context, events <-chan agent.Event) {
+	for ev := range events {
+		switch ev.Type {
+		case agent.EventPeerConnected:
+			// 按照操作者打开的流，分别与对应的服务建立连接。每个操作者有各自的p2p连接
+			go serveStreams(ctx, operators.add(ev.Peer, ev.Mux))
+		case agent.EventPeerSuspended:
+			// 流和与服务之间的连接保持不变，等待操作者重新连接后继续转发
+			fmt.Println("p2p连接中断，等待操作者重新连接:", ev.Peer, ev.Cause.Code, ev.Cause.Reason)
+		case agent.EventPeerResumed:
+			fmt.Println("p2p会话已恢复:", ev.Peer, ev.Pair)
+		case agent.EventPeerDisconnected:
+			fmt.Println("p2p连接断开:", ev.Peer, ev.Cause.Code, ev.Cause.Reason)
+			operators.remove(ev.Peer)
+		case agent.EventPathChanged:
+			// 流保持不变，只需记录新的路径
+			fmt.Println("p2p连接迁移到新的路径:", ev.Pair)
+		case agent.EventMessage:
+			// 数据都通过流进行传输，不再处理未经流发送的数据
+			fmt.Println("忽略未经流发送的数据,大小:", len(ev.Payload))
+		case agent.EventError:
+			fmt.Println("p2p连接出现错误:", ev.Err.Error())
+		}
+	}
+}
+
 func init() {
 	localPort := 3002
-	rosAgent.InitAgent(localPort)
+	if err := rosAgent.InitAgent(localPort); err != nil {
+		fmt.Println("初始化失败:", err.Error())
+		os.Exit(1)
+	}
+
+	// 连接中继服务器时的TLS和部署令牌
+	if common.Relay_tls {
+		conf, err := agent.LoadRelayTLS(common.Relay_ca, common.Relay_cert, common.Relay_key)
+		if err != nil {
+			fmt.Println("加载TLS配置失败:", err.Error())
+			os.Exit(1)
+		}
+		rosAgent.RelayTLS = conf
+	}
+	rosAgent.RelayToken = common.Relay_token
+
+	// 只接受被授权的操作者
+	access, err := agent.LoadAccessList("")
+	if err != nil {
+		fmt.Println("读取被授权的操作者失败:", err.Error())
+		os.Exit(1)
+	}
+	rosAgent.Access = access
 }
 
 func main() {
+	// 收到退出信号后，取消ctx，所有阻塞的操作随之返回
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	flag.Parse()
+
 	var err error
-	/*
-		与9090端口的rosbridge建立websocket连接
-	*/
-	for {
-		dialer := websocket.Dialer{}
-		rosConn, _, err := dialer.Dial("ws://127.0.0.1:9090", nil)
+	operators, err = newOperatorTable(*controlFlag, *graceFlag)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("控制策略:", *controlFlag)
+
+	// 生成配对码，由操作者在前端的连接页面中与机器人的id一同输入
+	if *pairFlag || len(rosAgent.Access.Peers()) == 0 {
+		code, err := rosAgent.StartPairing(pairingTTL)
 		if err != nil {
-			fmt.Println("连接ros_server失败:" + err.Error())
-			time.Sleep(2 * time.Second)
-			continue
+			fmt.Println("生成配对码失败:", err.Error())
+		} else {
+			fmt.Println("配对码:", code, " 有效期:", pairingTTL, " 机器人的id:", rosAgent.UUID)
 		}
-		fmt.Println("连接ros_server成功")
-		roshandler = &RosHandler{RosConn: rosConn}
-		go roshandler.rosRead()
-		break
 	}
 
-	defer roshandler.Close()
 	defer rosAgent.Close()
+	// 取消订阅后事件通道被关闭，handleEvents随之退出
+	events, unsubscribe := rosAgent.Subscribe()
+	defer unsubscribe()
+	go handleEvents(ctx, events)
 	/*
 		与对端节点建立p2p连接
 	*/
 	// 连接中继服务器
 	for {
-		err = rosAgent.ConnectToRelay(common.Relay_addr)
+		err = rosAgent.ConnectToRelay(ctx, common.Relay_addr)
 		if err != nil {
-			time.Sleep(1 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(1 * time.Second):
+			}
 			continue
 		}
 		break
 	}
 
-	// 等待服务器回传对端节点的信息
+	// 等待服务器回传对端节点的信息。每个操作者各自建立一条p2p连接，已有的连接不受影响。
+	// 连接请求在这里依次处理，但后台的升级等连通性检查仍可能同时进行，Agent按对端的uuid分发检查的报文和连接
 	for {
-		remotePubAddr, remotePrivAddr, remoteIpv6Addr, errStr := rosAgent.WaitNotify()
-		if errStr != "" {
+		peer, err := rosAgent.WaitNotify(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println(err.Error())
+			time.Sleep(1 * time.Second)
 			continue
 		}
-		fmt.Println("对端的公网地址:", remotePubAddr, " 对端的局域网地址:", remotePrivAddr, " 对端的ipv6地址:", remoteIpv6Addr)
+		for _, cand := range peer.Candidates {
+			fmt.Println("对端的候选地址:", cand.Type, cand.Address)
+		}
+		fmt.Println("本机的NAT类型:", rosAgent.NAT(), " 对端的NAT类型:", peer.NAT)
 
-		// 分别尝试连接对端的局域网地址、ipv6地址、公网地址
-		isSuccess := rosAgent.DailP2P(remotePrivAddr) || rosAgent.DailP2P(remoteIpv6Addr) || rosAgent.DailP2P(remotePubAddr)
-		// 若失败，则断开与ros_server的连接；浏览器会直接通过frp连接ros_server
-		if !isSuccess {
+		// 同时尝试对端的所有候选地址，使用最先连通的一条路径
+		pair, err := rosAgent.DailP2P(ctx, peer)
+		if ctx.Err() != nil {
+			return
+		}
+		// 若失败，浏览器会直接通过frp连接ros_server
+		if errors.Is(err, agent.ErrUnauthorized) {
+			fmt.Println("拒绝未授权的操作者:", err.Error())
+			continue
+		} else if err != nil {
 			fmt.Println("p2p直连失败")
 			continue
+		} else if pair.Relayed() {
+			fmt.Println("p2p直连失败，通过中继服务器转发:", pair)
 		} else {
-			fmt.Println("p2p直连成功")
-			// 若成功，则从rosAgent的channelData中读取数据，发送给ros_server
-			go func() {
-				for {
-					content := <-rosAgent.ChannelData
-					// 如果连接已经中断，中断循环
-					if content == "EOF" {
-						break
-					}
-					err := roshandler.RosConn.WriteMessage(websocket.TextMessage, []byte(content))
-					if err != nil {
-						fmt.Println("发送数据给ros_server失败:", err.Error())
-					} else {
-						fmt.Println("发送数据给ros_server成功")
-					}
-				}
-			}()
+			fmt.Println("p2p直连成功:", pair)
 		}
 	}
 }
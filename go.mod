@@ -1,10 +1,30 @@
 module P2PAgent
 
-go 1.17
+go 1.22
 
 require (
-	github.com/go-basic/uuid v1.0.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
-	github.com/libp2p/go-reuseport v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150 // indirect
+	github.com/go-basic/uuid v1.0.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/libp2p/go-reuseport v0.2.0
+	github.com/quic-go/quic-go v0.48.2
+	github.com/xtaci/kcp-go/v5 v5.6.5
+	golang.org/x/sys v0.23.0
+)
+
+require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.5 // indirect
+	github.com/klauspost/reedsolomon v1.11.8 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/templexxx/cpu v0.1.0 // indirect
+	github.com/templexxx/xorsimd v0.4.2 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
@@ -0,0 +1,176 @@
+package main
+
+import (
+	protocol "P2PAgent/Protocol"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+客户端句柄池：记录已注册的客户端及其在线状态，被各个客户端的HandleReq并发访问。
+
+1. register时加入句柄池。同一uuid重新注册时(例如Agent断线重连)，新的连接替换旧的连接，旧的连接被关闭。
+2. 连接断开时从句柄池中移除，但保留其最后在线时间offlineRetention，期间请求该uuid返回ErrCodePeerOffline，
+   之后返回ErrCodeUnknownPeer。
+3. 每收到客户端的一条消息(包括ping的响应)即更新其最后在线时间。中继服务器每隔pingInterval发送一次ping，
+   超过livenessTimeout没有收到任何消息的客户端被视为已断开，关闭其连接，例如对端断电后残留的半开连接。
+4. 同一身份的多个Agent实例(例如localAgent为每个机器人各运行一个Agent)以uuid/实例名为键分别记录，互不替换。
+   exchangeInfo只查找主实例，设置了实例名的客户端不能作为目标节点。
+*/
+
+// 超过该时间没有收到客户端的任何消息，即关闭其连接
+const livenessTimeout = 3 * pingInterval
+
+// 客户端离线后，保留其记录的时间
+const offlineRetention = 24 * time.Hour
+
+// 句柄池中的一条记录
+type poolEntry struct {
+	// 在线的客户端，为nil表示已离线
+	client *Client
+
+	// 离线前最后一次收到消息的时间，在线时以client.LastSeen()为准
+	lastSeen time.Time
+
+	// 离线前的访问策略，离线时据此决定是否向请求方透露其在线状态
+	access *protocol.AccessPolicy
+}
+
+// Presence 一个uuid的在线状态
+type Presence struct {
+	// 在线的客户端，为nil表示已离线
+	Client *Client
+
+	// 最后一次收到该客户端消息的时间
+	LastSeen time.Time
+
+	// 客户端的访问策略
+	Access *protocol.AccessPolicy
+}
+
+// 客户端在句柄池中的键，主实例为uuid，其他实例为uuid/实例名
+func clientKey(uuid, instance string) string {
+	if instance == "" {
+		return uuid
+	}
+	return uuid + "/" + instance
+}
+
+// 调用方为客户端自己的HandleReq，或持有c.mu
+func (c *Client) key() string {
+	return clientKey(c.UID, c.Instance)
+}
+
+// 在其他goroutine中读取客户端的键
+func (c *Client) lockedKey() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.key()
+}
+
+// ClientPool 已注册的客户端，键见clientKey
+type ClientPool struct {
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+}
+
+func NewClientPool() *ClientPool {
+	return &ClientPool{entries: make(map[string]*poolEntry)}
+}
+
+// Register 将c加入句柄池，返回被替换的同一uuid、同一实例的旧客户端，没有时返回nil
+func (p *ClientPool) Register(c *Client) *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[c.key()]
+	if e == nil {
+		p.entries[c.key()] = &poolEntry{client: c}
+		return nil
+	}
+	old := e.client
+	e.client = c
+	if old == c {
+		return nil
+	}
+	return old
+}
+
+// Unregister 连接断开时将c标记为离线，返回是否标记了。c已被新的连接替换时不做任何事
+func (p *ClientPool) Unregister(c *Client) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[c.key()]
+	if e == nil || e.client != c {
+		return false
+	}
+	e.client = nil
+	e.lastSeen = c.LastSeen()
+	c.mu.Lock()
+	e.access = c.access
+	c.mu.Unlock()
+	return true
+}
+
+// Lookup 查找键为key的客户端的在线状态，从未注册过或离线记录已过期时返回nil。key为uuid时即其主实例
+func (p *ClientPool) Lookup(key string) *Presence {
+	p.mu.Lock()
+	e := p.entries[key]
+	if e == nil {
+		p.mu.Unlock()
+		return nil
+	}
+	c, lastSeen, access := e.client, e.lastSeen, e.access
+	p.mu.Unlock()
+	if c == nil {
+		return &Presence{LastSeen: lastSeen, Access: access}
+	}
+	c.mu.Lock()
+	access = c.access
+	c.mu.Unlock()
+	return &Presence{Client: c, LastSeen: c.LastSeen(), Access: access}
+}
+
+// Online 在线的客户端数量
+func (p *ClientPool) Online() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, e := range p.entries {
+		if e.client != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// 关闭超时的客户端的连接，清除过期的离线记录
+func (p *ClientPool) reap(now time.Time) {
+	var dead []*Client
+	p.mu.Lock()
+	for key, e := range p.entries {
+		if e.client != nil {
+			if now.Sub(e.client.LastSeen()) > livenessTimeout {
+				dead = append(dead, e.client)
+			}
+		} else if now.Sub(e.lastSeen) > offlineRetention {
+			delete(p.entries, key)
+		}
+	}
+	p.mu.Unlock()
+
+	// 连接关闭后，客户端的HandleReq随之退出并调用Unregister
+	for _, c := range dead {
+		fmt.Println("客户端心跳超时，断开连接:", c.lockedKey(), c.Address)
+		c.Conn.Close()
+	}
+}
+
+// 每隔pingInterval检查一次客户端的存活
+func (p *ClientPool) reapLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.reap(now)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	protocol "P2PAgent/Protocol"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 一个连接在net.Pipe上的客户端，返回其对端
+func pipeClient(t *testing.T, uid, instance string) (*Client, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	c := &Client{UID: uid, Instance: instance, Conn: a, Address: "pipe", done: make(chan struct{})}
+	c.touch()
+	return c, b
+}
+
+func TestClientPoolRegister(t *testing.T) {
+	p := NewClientPool()
+	first, _ := pipeClient(t, "robot", "")
+	second, _ := pipeClient(t, "robot", "")
+	inst, _ := pipeClient(t, "robot", "op")
+
+	if old := p.Register(first); old != nil {
+		t.Fatal("首次注册不应替换任何客户端")
+	}
+	if old := p.Register(first); old != nil {
+		t.Fatal("同一连接重复注册不应返回自己")
+	}
+	if old := p.Register(inst); old != nil {
+		t.Fatal("不同实例不应互相替换")
+	}
+	if old := p.Register(second); old != first {
+		t.Fatal("同一uuid重新注册时应返回旧的客户端")
+	}
+	if n := p.Online(); n != 2 {
+		t.Fatalf("在线客户端数为%d，预期2", n)
+	}
+
+	// 被替换的旧连接断开时不影响新的连接
+	if p.Unregister(first) {
+		t.Fatal("被替换的客户端不应被标记为离线")
+	}
+	if pr := p.Lookup("robot"); pr == nil || pr.Client != second {
+		t.Fatal("查找到的不是新的客户端")
+	}
+	if pr := p.Lookup(clientKey("robot", "op")); pr == nil || pr.Client != inst {
+		t.Fatal("查找不到实例")
+	}
+
+	// 离线后保留记录和访问策略
+	second.access = &protocol.AccessPolicy{Authorized: []string{"op"}}
+	if !p.Unregister(second) {
+		t.Fatal("在线的客户端应被标记为离线")
+	}
+	pr := p.Lookup("robot")
+	if pr == nil || pr.Client != nil || pr.Access == nil || !pr.Access.Allows("op", false) {
+		t.Fatalf("离线记录不正确: %+v", pr)
+	}
+	if p.Lookup("nobody") != nil {
+		t.Fatal("从未注册的uuid应返回nil")
+	}
+}
+
+func TestClientPoolReap(t *testing.T) {
+	p := NewClientPool()
+	alive, _ := pipeClient(t, "alive", "")
+	dead, deadPeer := pipeClient(t, "dead", "")
+	offline, _ := pipeClient(t, "offline", "")
+	for _, c := range []*Client{alive, dead, offline} {
+		p.Register(c)
+	}
+	p.Unregister(offline)
+
+	now := time.Now()
+	atomic.StoreInt64(&dead.lastSeen, now.Add(-livenessTimeout-time.Second).UnixNano())
+	p.mu.Lock()
+	p.entries["offline"].lastSeen = now.Add(-offlineRetention - time.Second)
+	p.mu.Unlock()
+
+	p.reap(now)
+
+	// 心跳超时的客户端的连接被关闭，由HandleReq随后调用Unregister
+	deadPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := deadPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("心跳超时的客户端的连接应被关闭，读取返回%v", err)
+	}
+	if pr := p.Lookup("alive"); pr == nil || pr.Client != alive {
+		t.Fatal("在线的客户端不应被清除")
+	}
+	if p.Lookup("offline") != nil {
+		t.Fatal("过期的离线记录应被清除")
+	}
+}
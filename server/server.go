@@ -1,37 +1,270 @@
 package main
 
 import (
+	protocol "P2PAgent/Protocol"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-basic/uuid"
 	"github.com/libp2p/go-reuseport"
 )
 
+// 注册前未完成register(或开始转发)的连接被关闭，以免未认证的空闲连接无限堆积
+const registerTimeout = 30 * time.Second
+
 type Client struct {
-	// uuid
+	// uuid。UID、Instance和Candidates只由客户端自己的HandleReq在持有mu时修改，其他goroutine读取时需要持有mu
 	UID string
 
+	// 实例名，同一uuid的多个Agent同时在线时用于区分，为空表示主实例
+	Instance string
+
 	// 连接句柄
 	Conn net.Conn
 
+	// 连接上的消息编解码器
+	Enc *protocol.Encoder
+	Dec *protocol.Decoder
+
+	// 确认过的协议版本，为0表示尚未完成hello
+	Version int
+
+	// hello响应中下发的随机挑战，register时校验客户端对其的签名
+	challenge []byte
+
+	// 是否已通过auth证明持有部署令牌
+	authenticated bool
+
 	// 公网地址
 	Address string
 
-	// 局域网地址
-	PrivAddr string
+	// 客户端上报的host候选地址
+	Candidates []protocol.Candidate
+
+	// 客户端UDP端口的公网地址，由携带bindingToken的绑定请求得到，为nil表示客户端未发送过绑定请求
+	udpAddr *net.UDPAddr
+
+	// register时下发的绑定令牌，每次注册重新生成
+	bindingToken []byte
+
+	// 客户端上报的NAT探测结果，为nil表示尚未上报
+	nat *protocol.NATInfo
+
+	// 客户端的访问策略，为nil表示不限制请求方
+	access *protocol.AccessPolicy
+
+	// 保护UID、Instance、Candidates、udpAddr、bindingToken、nat、access和以下测量往返时延的字段。可以在持有ClientPool.mu时获取
+	mu sync.Mutex
+
+	// 与客户端之间的往返时延(平滑后)，为0表示尚未测得
+	rtt time.Duration
+
+	// 已发出、尚未收到响应的ping请求的发送时间
+	pings  map[uint64]time.Time
+	nextID uint64
+
+	// 最后一次收到客户端消息的时间，UnixNano
+	lastSeen int64
+
+	// 连接断开后关闭
+	done chan struct{}
+}
+
+// 收到客户端的消息，更新最后在线时间
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+
+// LastSeen 最后一次收到客户端消息的时间
+func (c *Client) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastSeen))
+}
+
+// 测量往返时延的间隔
+const pingInterval = 15 * time.Second
+
+// RTT 与客户端之间的往返时延，为0表示尚未测得
+func (c *Client) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// 向客户端发送ping请求
+func (c *Client) ping() {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	if c.pings == nil {
+		c.pings = make(map[uint64]time.Time)
+	}
+	c.pings[id] = time.Now()
+	c.mu.Unlock()
+
+	req, err := protocol.NewRequest(id, protocol.MethodPing, struct{}{})
+	if err != nil {
+		return
+	}
+	if err := c.Enc.Encode(req); err != nil {
+		fmt.Println("发送ping失败:", err.Error())
+	}
+}
+
+// 收到ping的响应，更新往返时延。与tcp的SRTT相同，新的样本占1/8的权重
+func (c *Client) onPong(resp *protocol.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent, ok := c.pings[resp.ID]
+	if !ok {
+		return
+	}
+	delete(c.pings, resp.ID)
+	sample := time.Since(sent)
+	if c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = (7*c.rtt + sample) / 8
+	}
+}
+
+// 定期测量与客户端之间的往返时延，直到连接断开
+func (s *Handler) pingLoop(c *Client) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		c.ping()
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 打洞时刻距离现在的最短时间，留给双方准备
+const punchLead = 200 * time.Millisecond
+
+// 计算双方收到地址信息后各自需要等待的时间，使双方在同一时刻开始打洞。
+// 消息到达各方需要单程时延(约为往返时延的一半)，单程时延短的一方等待更久
+func punchDelays(rttA, rttB time.Duration) (delayA, delayB time.Duration) {
+	oneWayA, oneWayB := rttA/2, rttB/2
+	lead := oneWayA
+	if oneWayB > lead {
+		lead = oneWayB
+	}
+	lead += punchLead
+	return lead - oneWayA, lead - oneWayB
+}
+
+// 由客户端的公网地址得到的srflx候选地址
+func (c *Client) Srflx() *protocol.Candidate {
+	addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &protocol.Candidate{
+		Type:     protocol.CandidateSrflx,
+		Network:  protocol.NetworkOf(addr.IP),
+		Address:  c.Address,
+		Priority: protocol.CandidatePriority(protocol.CandidateSrflx, 65535),
+	}
+}
+
+// 绑定请求携带的令牌与register时下发的一致时，记录客户端UDP端口的公网地址，返回是否记录
+func (c *Client) bindUDP(addr *net.UDPAddr, token []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.bindingToken) == 0 || subtle.ConstantTimeCompare(c.bindingToken, token) != 1 {
+		return false
+	}
+	c.udpAddr = addr
+	return true
+}
+
+// 由客户端UDP端口的公网地址得到的srflx候选地址
+func (c *Client) UDPSrflx() *protocol.Candidate {
+	c.mu.Lock()
+	addr := c.udpAddr
+	c.mu.Unlock()
+	if addr == nil {
+		return nil
+	}
+	return &protocol.Candidate{
+		Type:     protocol.CandidateSrflx,
+		Network:  protocol.UDPNetworkOf(addr.IP),
+		Address:  addr.String(),
+		Priority: protocol.CandidatePriority(protocol.CandidateSrflx, 65535),
+	}
+}
+
+// 节点的地址信息，包含全部host候选地址和srflx候选地址
+func (c *Client) PeerInfo() *protocol.PeerInfo {
+	c.mu.Lock()
+	uid, nat := c.UID, c.nat
+	cands := append([]protocol.Candidate{}, c.Candidates...)
+	c.mu.Unlock()
+	if srflx := c.Srflx(); srflx != nil {
+		cands = append(cands, *srflx)
+	}
+	if srflx := c.UDPSrflx(); srflx != nil {
+		cands = append(cands, *srflx)
+	}
+	protocol.SortCandidates(cands)
+	return &protocol.PeerInfo{UUID: uid, Candidates: cands, NAT: nat}
+}
+
+// 回复请求req
+func (c *Client) reply(req *protocol.Message, body interface{}) {
+	resp, err := protocol.NewResponse(req, body)
+	if err != nil {
+		fmt.Println("构造响应失败:", err.Error())
+		return
+	}
+	if err := c.Enc.Encode(resp); err != nil {
+		fmt.Println("回复客户端失败:", err.Error())
+	}
+}
 
-	// ipv6地址
-	Ipv6Addr string
+// 回复请求req一个错误
+func (c *Client) replyError(req *protocol.Message, code protocol.ErrorCode, message string) {
+	if err := c.Enc.Encode(protocol.NewErrorResponse(req, code, message)); err != nil {
+		fmt.Println("回复客户端失败:", err.Error())
+	}
 }
 
 type Handler struct {
 	// 服务端句柄
 	Listener net.Listener
+
+	// 响应绑定请求的UDP端口
+	UDPConn net.PacketConn
+
+	// 备用的UDP端口，用于客户端探测NAT的行为，为nil表示没有
+	AltUDPConn net.PacketConn
+
+	// 部署令牌，为空表示不需要。配置后客户端必须先通过auth证明持有令牌
+	Token string
+
 	// 客户端句柄池
-	ClientPool map[string]*Client
+	ClientPool *ClientPool
+
+	// 已分配、尚未开始转发的转发会话，键为令牌
+	relayMu sync.Mutex
+	relays  map[string]*relaySession
 }
 
 func (s *Handler) Handle() {
@@ -43,7 +276,10 @@ func (s *Handler) Handle() {
 		}
 		c := &Client{
 			Conn:    conn,
+			Enc:     protocol.NewEncoder(conn),
+			Dec:     protocol.NewDecoder(conn),
 			Address: conn.RemoteAddr().String(),
+			done:    make(chan struct{}),
 		}
 		fmt.Println("一个客户端连接进去了,他的公网IP是", conn.RemoteAddr().String())
 
@@ -52,123 +288,520 @@ func (s *Handler) Handle() {
 	}
 }
 
-// 等待接收客户端传来的uuid,ipv6Addr和privAddr
-func (s *Handler) recvUUIDAndPrivAddr(c *Client, data map[string]string) {
+// 响应客户端的UDP绑定请求，回传客户端UDP端口的公网地址，携带正确绑定令牌时一并记录。
+// conn为主端口或备用端口，只记录主端口上观察到的地址
+func (s *Handler) HandleUDP(conn net.PacketConn) {
+	primary := conn == s.UDPConn
+	buf := make([]byte, protocol.MaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Println("读取UDP报文失败", err.Error())
+			return
+		}
+		t, body, ok := protocol.ParsePacket(buf[:n])
+		if !ok || t != protocol.PacketBindingRequest {
+			continue
+		}
+		var req protocol.BindingRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if p := s.ClientPool.Lookup(clientKey(req.UUID, req.Instance)); p != nil && p.Client != nil && primary {
+			p.Client.bindUDP(udpAddr, req.Token)
+		}
+		resp := &protocol.BindingResponse{Address: udpAddr.String()}
+		if s.AltUDPConn != nil {
+			resp.OtherAddress = s.AltUDPConn.LocalAddr().String()
+		}
+		b, err := protocol.EncodePacket(protocol.PacketBindingResponse, resp)
+		if err != nil {
+			continue
+		}
+		// 探测过滤行为时从另一个端口回复
+		from := conn
+		if req.Change && s.AltUDPConn != nil {
+			from = s.UDPConn
+			if primary {
+				from = s.AltUDPConn
+			}
+		}
+		from.WriteTo(b, addr)
+	}
+}
 
-	if data["privAddr"] != "" {
-		c.PrivAddr = data["privAddr"]
+// 确认客户端支持当前的协议版本。各版本之间不兼容，不支持时返回ErrCodeUnsupportedVersion
+func (s *Handler) hello(c *Client, req *protocol.Message) {
+	var body protocol.HelloRequest
+	if err := req.DecodeBody(&body); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return
 	}
-	if data["ipv6Addr"] != "" {
-		c.Ipv6Addr = data["ipv6Addr"]
+	if !slices.Contains(body.Versions, protocol.Version) {
+		c.replyError(req, protocol.ErrCodeUnsupportedVersion, fmt.Sprintf("服务器只支持版本%d", protocol.Version))
+		return
 	}
-	if data["uuid"] != "" {
-		c.UID = data["uuid"]
-		s.ClientPool[c.UID] = c
-	} else {
-		uuid := uuid.New()
-		c.UID = uuid
-		s.ClientPool[uuid] = c
+	challenge := make([]byte, protocol.ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return
+	}
+	c.Version = protocol.Version
+	c.challenge = challenge
+	c.reply(req, &protocol.HelloResponse{Version: protocol.Version, Challenge: challenge})
+}
+
+// 校验客户端对挑战的签名，以其公钥派生的id作为uuid，记录host候选地址，回传uuid和公网地址
+func (s *Handler) register(c *Client, req *protocol.Message) {
+	var body protocol.RegisterRequest
+	if err := req.DecodeBody(&body); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return
+	}
+	if c.challenge == nil {
+		c.replyError(req, protocol.ErrCodeNotRegistered, "请先完成hello")
+		return
+	}
+	id, err := protocol.VerifyRegister(body.PublicKey, c.challenge, body.Signature)
+	if err != nil {
+		fmt.Println("客户端身份校验失败:", c.Address, err.Error())
+		c.replyError(req, protocol.ErrCodeUnauthorized, err.Error())
+		return
+	}
+	if c.UID != "" && (c.UID != id || c.Instance != body.Instance) {
+		c.replyError(req, protocol.ErrCodeBadRequest, "同一连接上不能注册不同的身份")
+		return
+	}
+
+	var cands []protocol.Candidate
+	for _, cand := range body.Candidates {
+		// 只接受host候选地址，srflx由服务器自己添加
+		if cand.Type == protocol.CandidateHost && cand.Address != "" {
+			cands = append(cands, cand)
+		}
+	}
+	bindingToken := make([]byte, protocol.BindingTokenSize)
+	if _, err := rand.Read(bindingToken); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return
+	}
+	first := c.UID == ""
+	c.mu.Lock()
+	c.UID = id
+	c.Instance = body.Instance
+	c.Candidates = cands
+	c.access = body.Access
+	c.bindingToken = bindingToken
+	c.mu.Unlock()
+	// 同一uuid重新注册时，关闭旧的连接，例如Agent断线重连后残留的半开连接
+	if old := s.ClientPool.Register(c); old != nil {
+		fmt.Println("客户端重新注册，关闭旧的连接:", c.key(), old.Address)
+		old.Conn.Close()
 	}
 
 	// 将uuid和pubAddr回传给客户端
-	WriteBackUidAndPubAddr(c.Conn, c.UID)
+	c.reply(req, &protocol.RegisterResponse{UUID: c.UID, PubAddr: c.Address, Srflx: c.Srflx(), BindingToken: bindingToken})
+	fmt.Println("回传uuid和公网地址给客户端:", c.Address)
+
+	// 只测量已注册的客户端的往返时延，转发数据的连接上不能插入ping
+	if first {
+		c.Conn.SetReadDeadline(time.Time{})
+		go s.pingLoop(c)
+	}
+}
+
+// 记录客户端上报的NAT探测结果，交换信息时一并告知对端
+func (s *Handler) reportNAT(c *Client, req *protocol.Message) {
+	var body protocol.NATInfo
+	if err := req.DecodeBody(&body); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return
+	}
+	if c.UID == "" {
+		c.replyError(req, protocol.ErrCodeNotRegistered, "请先注册")
+		return
+	}
+	c.mu.Lock()
+	c.nat = &body
+	c.mu.Unlock()
+	fmt.Println("客户端", c.UID, "的NAT类型:", body.String())
+	c.reply(req, struct{}{})
+}
+
+// 更新客户端的访问策略
+func (s *Handler) setAccess(c *Client, req *protocol.Message) {
+	var body protocol.AccessPolicy
+	if err := req.DecodeBody(&body); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return
+	}
+	if c.UID == "" {
+		c.replyError(req, protocol.ErrCodeNotRegistered, "请先注册")
+		return
+	}
+	c.mu.Lock()
+	c.access = &body
+	c.mu.Unlock()
+	fmt.Println("客户端", c.UID, "的访问策略: 授权", len(body.Authorized), "个节点, 配对中:", body.Pairing)
+	c.reply(req, struct{}{})
 }
 
 // 交换连接双方的信息
-func (s *Handler) exchangeInfo(c *Client, data map[string]string) {
-	if data["targetUUID"] != "" {
-		// 读取目标uuid
-		uuid := data["targetUUID"]
-
-		// 回传给localAgent的数据
-		var dataForLocalAgent = make(map[string]string)
-
-		// 回传给rosAGent的数据
-		var dataForRosAgent = make(map[string]string)
-
-		// 如果目标uuid不存在，则返回错误码给localAgent
-		if s.ClientPool[uuid] == nil {
-			dataForLocalAgent["error"] = "1" //todo:后续如果有其他的错误码，要写成枚举的形式
-			body, _ := json.Marshal(dataForLocalAgent)
-			_, err := c.Conn.Write(body)
-			if err != nil {
-				fmt.Println("回传地址给localAgent失败:", err.Error())
-			}
-			return
-		}
+func (s *Handler) exchangeInfo(c *Client, req *protocol.Message) {
+	var body protocol.ExchangeInfoRequest
+	if err := req.DecodeBody(&body); err != nil || body.TargetUUID == "" {
+		c.replyError(req, protocol.ErrCodeBadRequest, "缺少targetUUID")
+		return
+	}
+	if c.UID == "" {
+		c.replyError(req, protocol.ErrCodeNotRegistered, "请先注册")
+		return
+	}
 
-		// 写回给localAgent
-		dataForLocalAgent["address"] = s.ClientPool[uuid].Address   // rosAgent的公网地址
-		dataForLocalAgent["privAddr"] = s.ClientPool[uuid].PrivAddr // rosAgent的局域网地址
-		dataForLocalAgent["ipv6Addr"] = s.ClientPool[uuid].Ipv6Addr // rosAgent的ipv6地址
-		body, _ := json.Marshal(dataForLocalAgent)
-		_, err := c.Conn.Write(body)
-		if err != nil {
-			fmt.Println("回传地址给localAgent失败:", err.Error())
+	// 如果目标uuid不存在，则返回错误码给localAgent。只查找主实例，其他实例不能作为目标节点
+	var presence *Presence
+	if !strings.Contains(body.TargetUUID, "/") {
+		presence = s.ClientPool.Lookup(body.TargetUUID)
+	}
+	if presence == nil {
+		c.replyError(req, protocol.ErrCodeUnknownPeer, body.TargetUUID)
+		return
+	}
+	// 目标节点声明了访问策略时，不向未授权的请求方透露其地址和在线状态
+	if !presence.Access.Allows(c.UID, body.Pairing) {
+		fmt.Println("拒绝未授权的请求:", c.UID, "->", body.TargetUUID)
+		c.replyError(req, protocol.ErrCodeUnauthorized, "未被目标节点授权")
+		return
+	}
+	target := presence.Client
+	if target == nil {
+		c.replyError(req, protocol.ErrCodePeerOffline, "最后在线时间:"+presence.LastSeen.Format(time.RFC3339))
+		return
+	}
+
+	// 按照与双方的往返时延，安排双方同时开始打洞
+	delayC, delayTarget := punchDelays(c.RTT(), target.RTT())
+	targetInfo := target.PeerInfo()
+	targetInfo.PunchDelay = delayC.Milliseconds()
+	info := c.PeerInfo()
+	info.PunchDelay = delayTarget.Milliseconds()
+	info.Pairing = body.Pairing
+
+	// 分配转发会话，直连失败时双方凭此通过中继服务器转发数据
+	relay := s.newRelaySession(c.UID, targetInfo.UUID)
+	targetInfo.Relay = relay
+	info.Relay = relay
+
+	// 写回给localAgent：rosAgent的全部候选地址
+	c.reply(req, targetInfo)
+
+	// 通知rosAgent：localAgent的全部候选地址
+	notify, err := protocol.NewNotification(protocol.NotifyPeerInfo, info)
+	if err != nil {
+		fmt.Println("构造通知失败:", err.Error())
+		return
+	}
+	if err := target.Enc.Encode(notify); err != nil {
+		fmt.Println("回传地址给rosAgent失败:", err.Error())
+	}
+}
+
+// 转发会话的有效期，超过后仍未开始转发的会话被丢弃
+const relaySessionTTL = time.Minute
+
+// 先到达的一方等待对端到达的最长时间
+const relayWaitTimeout = 15 * time.Second
+
+// 一次连接的转发会话，由exchangeInfo分配
+type relaySession struct {
+	// 会话双方的uuid
+	peers [2]string
+
+	created time.Time
+
+	// 先到达的一方，为nil表示双方都还未到达
+	waiting *relayEnd
+}
+
+// 转发会话中先到达的一方
+type relayEnd struct {
+	c    *Client
+	uuid string
+	req  *protocol.Message
+
+	// 对端到达后，收到对端的连接
+	peer chan *Client
+}
+
+// 为双方分配一个转发会话，同时丢弃已过期的会话
+func (s *Handler) newRelaySession(a, b string) *protocol.RelayInfo {
+	token := uuid.New()
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+	for t, sess := range s.relays {
+		if time.Since(sess.created) > relaySessionTTL {
+			delete(s.relays, t)
 		}
+	}
+	s.relays[token] = &relaySession{peers: [2]string{a, b}, created: time.Now()}
+	return &protocol.RelayInfo{Token: token}
+}
 
-		// 写回给rosAgent
-		dataForRosAgent["address"] = c.Conn.RemoteAddr().String() // localAgent的公网地址
-		dataForRosAgent["privAddr"] = c.PrivAddr                  // localAgent的局域网地址
-		dataForRosAgent["ipv6Addr"] = c.Ipv6Addr
-		body, _ = json.Marshal(dataForRosAgent)
-		_, err = s.ClientPool[uuid].Conn.Write(body)
-		if err != nil {
-			fmt.Println("回传地址给rosAgent失败:", err.Error())
+// 等待会话的另一方到达后，回复双方relay响应，然后转发双方之间的字节流，直到任意一方断开
+func (s *Handler) relay(c *Client, req *protocol.Message) {
+	var body protocol.RelayRequest
+	if err := req.DecodeBody(&body); err != nil || body.Token == "" {
+		c.replyError(req, protocol.ErrCodeBadRequest, "缺少token")
+		return
+	}
+	if c.UID != "" {
+		c.replyError(req, protocol.ErrCodeBadRequest, "控制连接不能用于转发数据")
+		return
+	}
+
+	s.relayMu.Lock()
+	sess := s.relays[body.Token]
+	if sess == nil || (body.UUID != sess.peers[0] && body.UUID != sess.peers[1]) {
+		s.relayMu.Unlock()
+		c.replyError(req, protocol.ErrCodeRelayFailed, "转发会话不存在或已过期")
+		return
+	}
+	// 转发连接不注册，找到会话后即不再受registerTimeout限制
+	c.Conn.SetReadDeadline(time.Time{})
+	first := sess.waiting
+	if first == nil {
+		// 先到达，等待对端
+		end := &relayEnd{c: c, uuid: body.UUID, req: req, peer: make(chan *Client, 1)}
+		sess.waiting = end
+		s.relayMu.Unlock()
+
+		timer := time.NewTimer(relayWaitTimeout)
+		defer timer.Stop()
+		var peer *Client
+		select {
+		case peer = <-end.peer:
+		case <-timer.C:
+			s.relayMu.Lock()
+			if sess.waiting == end {
+				sess.waiting = nil
+				s.relayMu.Unlock()
+				c.replyError(req, protocol.ErrCodeRelayFailed, "等待对端超时")
+				return
+			}
+			// 对端恰好在超时的同时到达
+			s.relayMu.Unlock()
+			peer = <-end.peer
 		}
+		pipe(c, peer)
+		return
+	}
+	if first.uuid == body.UUID {
+		s.relayMu.Unlock()
+		c.replyError(req, protocol.ErrCodeRelayFailed, "重复的转发请求")
+		return
+	}
+	sess.waiting = nil
+	delete(s.relays, body.Token)
+	s.relayMu.Unlock()
+
+	// 双方都收到响应后才开始转发，响应之后的字节都属于对端
+	first.c.reply(first.req, struct{}{})
+	c.reply(req, struct{}{})
+	first.peer <- c
+	fmt.Println("开始转发数据:", first.uuid, "<->", body.UUID)
+	pipe(c, first.c)
+}
+
+// 将from发来的字节流原样写入to，任意一方断开后关闭双方的连接
+func pipe(from, to *Client) {
+	n, err := io.Copy(to.Conn, from.Dec.Reader())
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Println("转发数据中断:", err.Error())
+	}
+	fmt.Printf("转发结束，%s -> %s 共%d字节\n", from.Address, to.Address, n)
+	from.Conn.Close()
+	to.Conn.Close()
+}
+
+// TLS握手的超时时间
+const handshakeTimeout = 10 * time.Second
+
+// 校验客户端的令牌证明，失败时连接随之被关闭
+func (s *Handler) auth(c *Client, req *protocol.Message) bool {
+	var body protocol.AuthRequest
+	if err := req.DecodeBody(&body); err != nil {
+		c.replyError(req, protocol.ErrCodeBadRequest, err.Error())
+		return false
 	}
+	if s.Token != "" && !protocol.VerifyTokenProof(s.Token, c.challenge, body.Proof) {
+		fmt.Println("客户端的令牌校验失败:", c.Address)
+		c.replyError(req, protocol.ErrCodeUnauthorized, "令牌错误")
+		return false
+	}
+	c.authenticated = true
+	c.reply(req, struct{}{})
+	return true
 }
 
 // 处理来自Agent的请求
 func (s *Handler) HandleReq(c *Client) {
+	c.touch()
+	defer func() {
+		c.Conn.Close()
+		if c.UID != "" && s.ClientPool.Unregister(c) {
+			fmt.Println("客户端下线:", c.key(), "在线客户端数:", s.ClientPool.Online())
+		}
+		close(c.done)
+	}()
+	// 使用TLS时先完成握手，双向认证时客户端的证书在握手中校验
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			fmt.Println("TLS握手失败:", c.Address, err.Error())
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(registerTimeout))
 	for {
 		// 解析出数据
-		conn := c.Conn
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
-		if err != nil {
+		var msg protocol.Message
+		if err := c.Dec.Decode(&msg); err != nil {
 			fmt.Println("读取失败" + err.Error())
 			return
 		}
-		data := make(map[string]string)
-		if err = json.Unmarshal(buffer[:n], &data); err != nil {
-			fmt.Println("获取数据失败" + err.Error())
+		c.touch()
+		if msg.Kind == protocol.KindResponse && msg.Method == protocol.MethodPing {
+			c.onPong(&msg)
+			continue
+		}
+		if msg.Kind != protocol.KindRequest {
+			// 除ping的响应外，客户端不会发来请求以外的消息，忽略
+			continue
+		}
+
+		// 必须先完成hello
+		if c.Version == 0 && msg.Method != protocol.MethodHello {
+			c.replyError(&msg, protocol.ErrCodeUnsupportedVersion, "请先发送hello确认协议版本")
+			continue
+		}
+
+		// 配置了令牌时，必须先通过auth证明持有令牌，否则断开连接
+		if s.Token != "" && !c.authenticated && msg.Method != protocol.MethodHello && msg.Method != protocol.MethodAuth {
+			fmt.Println("拒绝未认证的客户端:", c.Address, msg.Method)
+			c.replyError(&msg, protocol.ErrCodeUnauthorized, "请先通过auth认证")
 			return
 		}
 
 		// 根据请求的方法名，进行请求的分发
-
-		// 接收客户端传来的uuid和局域网地址
-		if data["method"] == "recvUUIDAndPrivAddr" {
-			s.recvUUIDAndPrivAddr(c, data)
-		} else if data["method"] == "exchangeInfo" {
+		switch msg.Method {
+		case protocol.MethodHello:
+			s.hello(c, &msg)
+		case protocol.MethodPing:
+			// Agent的心跳，回复空的响应即可
+			c.reply(&msg, struct{}{})
+		case protocol.MethodAuth:
+			// 校验部署令牌，失败时断开连接
+			if !s.auth(c, &msg) {
+				return
+			}
+		case protocol.MethodRegister:
+			// 接收客户端传来的uuid和局域网地址
+			s.register(c, &msg)
+		case protocol.MethodReportNAT:
+			// 记录客户端的NAT探测结果
+			s.reportNAT(c, &msg)
+		case protocol.MethodSetAccess:
+			// 更新客户端的访问策略
+			s.setAccess(c, &msg)
+		case protocol.MethodExchangeInfo:
 			// 收到localAgent的连接请求，交换双方的信息
-			s.exchangeInfo(c, data)
+			s.exchangeInfo(c, &msg)
+		case protocol.MethodRelay:
+			// 转发双方之间的数据，转发结束后连接即被关闭
+			s.relay(c, &msg)
+			return
+		default:
+			c.replyError(&msg, protocol.ErrCodeUnknownMethod, msg.Method)
 		}
 	}
 }
 
-// 将分配的uuid以及客户端的公网地址回传给客户端
-func WriteBackUidAndPubAddr(conn net.Conn, uuid string) {
-	var data = make(map[string]string)
-	data["uuid"] = uuid
-	data["pubAddr"] = conn.RemoteAddr().String()
-	body, _ := json.Marshal(data)
-	_, err := conn.Write(body)
+// 加载控制连接的TLS配置。clientCA不为空时要求客户端出示由其签发的证书，即双向认证
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		fmt.Println("回传信息时出现了错误", err.Error())
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("无法解析客户端CA证书:" + clientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	fmt.Println("回传uuid和公网地址给客户端:", conn.RemoteAddr().String())
+	return conf, nil
 }
 
 func main() {
+	// 与frps.ini相同，令牌和证书都是可选的，建议公网部署时全部开启
+	token := flag.String("token", "", "部署令牌，客户端须配置相同的令牌(Common.Relay_token)")
+	certFile := flag.String("tls-cert", "", "控制连接的TLS证书，为空时不使用TLS")
+	keyFile := flag.String("tls-key", "", "控制连接的TLS私钥")
+	clientCA := flag.String("client-ca", "", "签发客户端证书的CA，不为空时要求客户端出示证书(双向认证)")
+	flag.Parse()
+
 	address := ":3001"
+	// 备用UDP端口，用于客户端探测NAT的行为，为空表示不启用。
+	// 也可以是服务器另一个公网ip上的地址，例如"1.2.3.4:3001"，此时能够区分更多的NAT行为
+	altAddress := ":3004"
+	var listener net.Listener
 	listener, err := reuseport.Listen("tcp", address)
 	if err != nil {
 		panic("服务端监听失败" + err.Error())
 	}
+	if *certFile != "" {
+		conf, err := loadTLSConfig(*certFile, *keyFile, *clientCA)
+		if err != nil {
+			panic("加载TLS证书失败" + err.Error())
+		}
+		listener = tls.NewListener(listener, conf)
+		fmt.Println("控制连接使用TLS, 双向认证:", *clientCA != "")
+	} else {
+		fmt.Println("警告: 控制连接未使用TLS，客户端的地址将以明文传输")
+	}
+	if *token == "" {
+		fmt.Println("警告: 未配置部署令牌，任何客户端都可以连接")
+	}
+	udpConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		panic("服务端监听UDP失败" + err.Error())
+	}
 	fmt.Println("服务器开始监听...")
-	h := &Handler{Listener: listener, ClientPool: make(map[string]*Client)}
+	h := &Handler{Listener: listener, UDPConn: udpConn, Token: *token, ClientPool: NewClientPool(), relays: make(map[string]*relaySession)}
+	if altAddress != "" {
+		altConn, err := net.ListenPacket("udp", altAddress)
+		if err != nil {
+			fmt.Println("监听备用UDP端口失败，客户端将无法探测NAT类型:", err.Error())
+		} else {
+			h.AltUDPConn = altConn
+			go h.HandleUDP(altConn)
+		}
+	}
+	// 响应UDP绑定请求
+	go h.HandleUDP(udpConn)
+	// 断开心跳超时的客户端
+	go h.ClientPool.reapLoop()
 	// 监听内网节点连接
 	h.Handle()
 	time.Sleep(time.Hour) // 防止主线程退出
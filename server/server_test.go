@@ -0,0 +1,261 @@
+package main
+
+import (
+	protocol "P2PAgent/Protocol"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的Agent一端：发送请求，等待对应的响应，忽略通知和中继服务器的ping
+type testAgent struct {
+	t      *testing.T
+	conn   net.Conn
+	enc    *protocol.Encoder
+	resp   chan *protocol.Message
+	nextID uint64
+	key    ed25519.PrivateKey
+	uuid   string
+
+	// 最近一次注册得到的绑定令牌
+	bindingToken []byte
+}
+
+// 在net.Pipe上连接h，由h.HandleReq处理
+func dialHandler(t *testing.T, h *Handler) *testAgent {
+	t.Helper()
+	a, b := net.Pipe()
+	c := &Client{Conn: b, Enc: protocol.NewEncoder(b), Dec: protocol.NewDecoder(b), Address: "pipe", done: make(chan struct{})}
+	go h.HandleReq(c)
+	t.Cleanup(func() { a.Close() })
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := &testAgent{t: t, conn: a, enc: protocol.NewEncoder(a), resp: make(chan *protocol.Message, 16), key: key, uuid: protocol.PeerID(pub)}
+	dec := protocol.NewDecoder(a)
+	go func() {
+		for {
+			var msg protocol.Message
+			if err := dec.Decode(&msg); err != nil {
+				close(ta.resp)
+				return
+			}
+			if msg.Kind == protocol.KindResponse {
+				ta.resp <- &msg
+			}
+		}
+	}()
+	return ta
+}
+
+func (a *testAgent) call(method string, body interface{}, out interface{}) error {
+	a.nextID++
+	req, err := protocol.NewRequest(a.nextID, method, body)
+	if err != nil {
+		return err
+	}
+	if err := a.enc.Encode(req); err != nil {
+		return err
+	}
+	select {
+	case msg, ok := <-a.resp:
+		if !ok {
+			return errors.New("连接已断开")
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		return msg.DecodeBody(out)
+	case <-time.After(5 * time.Second):
+		return errors.New("等待响应超时")
+	}
+}
+
+// 完成hello和register
+func (a *testAgent) register(instance string) error {
+	var hello protocol.HelloResponse
+	if err := a.call(protocol.MethodHello, &protocol.HelloRequest{Versions: []int{protocol.Version}}, &hello); err != nil {
+		return err
+	}
+	req := &protocol.RegisterRequest{
+		PublicKey: a.key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(a.key, protocol.RegisterSigningData(hello.Challenge)),
+		Candidates: []protocol.Candidate{
+			{Type: protocol.CandidateHost, Network: "tcp4", Address: "192.0.2.1:3003"},
+		},
+		Instance: instance,
+	}
+	var resp protocol.RegisterResponse
+	if err := a.call(protocol.MethodRegister, req, &resp); err != nil {
+		return err
+	}
+	if resp.UUID != a.uuid {
+		return fmt.Errorf("注册的uuid为%s，预期%s", resp.UUID, a.uuid)
+	}
+	a.bindingToken = resp.BindingToken
+	return nil
+}
+
+func (a *testAgent) mustRegister(instance string) {
+	a.t.Helper()
+	if err := a.register(instance); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func newTestHandler() *Handler {
+	return &Handler{ClientPool: NewClientPool(), relays: make(map[string]*relaySession)}
+}
+
+// 一个客户端反复重新注册的同时，另一个客户端反复请求其地址。以-race运行时检查两者之间的数据竞争
+func TestReregisterWhileExchanging(t *testing.T) {
+	h := newTestHandler()
+	robot := dialHandler(t, h)
+	robot.mustRegister("")
+	op := dialHandler(t, h)
+	op.mustRegister("")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := robot.register(""); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			var info protocol.PeerInfo
+			if err := op.call(protocol.MethodExchangeInfo, &protocol.ExchangeInfoRequest{TargetUUID: robot.uuid}, &info); err != nil {
+				t.Error(err)
+				return
+			}
+			if info.UUID != robot.uuid || len(info.Candidates) == 0 {
+				t.Errorf("交换的地址信息不正确: %+v", info)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestInstanceNotTargetable(t *testing.T) {
+	h := newTestHandler()
+	robot := dialHandler(t, h)
+	robot.mustRegister("")
+	op := dialHandler(t, h)
+	op.mustRegister("robot-a")
+
+	var info protocol.PeerInfo
+	if err := op.call(protocol.MethodExchangeInfo, &protocol.ExchangeInfoRequest{TargetUUID: robot.uuid}, &info); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{op.uuid, clientKey(op.uuid, "robot-a")} {
+		err := robot.call(protocol.MethodExchangeInfo, &protocol.ExchangeInfoRequest{TargetUUID: target}, &info)
+		var protoErr *protocol.Error
+		if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrCodeUnknownPeer {
+			t.Fatalf("请求实例%s返回%v，预期ErrCodeUnknownPeer", target, err)
+		}
+	}
+}
+
+// 只有携带注册时下发的令牌的绑定请求才会改变记录的UDP地址，其他请求只得到回复
+func TestBindingRequiresToken(t *testing.T) {
+	h := newTestHandler()
+	robot := dialHandler(t, h)
+	robot.mustRegister("")
+	if len(robot.bindingToken) != protocol.BindingTokenSize {
+		t.Fatalf("绑定令牌长度为%d", len(robot.bindingToken))
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.UDPConn = conn
+	go h.HandleUDP(conn)
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	bind := func(token []byte) {
+		t.Helper()
+		b, err := protocol.EncodePacket(protocol.PacketBindingRequest, &protocol.BindingRequest{UUID: robot.uuid, Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.WriteTo(b, conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, protocol.MaxPacketSize)
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ, _, ok := protocol.ParsePacket(buf[:n]); !ok || typ != protocol.PacketBindingResponse {
+			t.Fatal("没有收到绑定响应")
+		}
+	}
+
+	c := h.ClientPool.Lookup(robot.uuid).Client
+	wrong := make([]byte, protocol.BindingTokenSize)
+	for _, token := range [][]byte{nil, wrong, robot.bindingToken[:protocol.BindingTokenSize-1]} {
+		bind(token)
+		if c.UDPSrflx() != nil {
+			t.Fatalf("令牌%x不正确时记录了UDP地址", token)
+		}
+	}
+	bind(robot.bindingToken)
+	if cand := c.UDPSrflx(); cand == nil || cand.Address != client.LocalAddr().String() {
+		t.Fatalf("携带正确令牌时记录的地址为%v", cand)
+	}
+
+	// 重新注册后旧的令牌失效
+	old := robot.bindingToken
+	robot.mustRegister("")
+	if !c.bindUDP(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, robot.bindingToken) || c.bindUDP(nil, old) {
+		t.Fatal("重新注册后应只接受新的令牌")
+	}
+}
+
+// 不支持当前协议版本的客户端无法完成hello，也不能发送其他请求
+func TestHelloVersionMismatch(t *testing.T) {
+	h := newTestHandler()
+	for _, versions := range [][]int{nil, {protocol.Version - 1}, {protocol.Version + 1}} {
+		a := dialHandler(t, h)
+		var hello protocol.HelloResponse
+		err := a.call(protocol.MethodHello, &protocol.HelloRequest{Versions: versions}, &hello)
+		var protoErr *protocol.Error
+		if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrCodeUnsupportedVersion {
+			t.Fatalf("版本%v返回%v，预期ErrCodeUnsupportedVersion", versions, err)
+		}
+		err = a.call(protocol.MethodRegister, &protocol.RegisterRequest{}, nil)
+		if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrCodeUnsupportedVersion {
+			t.Fatalf("hello失败后register返回%v", err)
+		}
+	}
+
+	a := dialHandler(t, h)
+	var hello protocol.HelloResponse
+	if err := a.call(protocol.MethodHello, &protocol.HelloRequest{Versions: []int{protocol.Version - 1, protocol.Version}}, &hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != protocol.Version || len(hello.Challenge) != protocol.ChallengeSize {
+		t.Fatalf("hello响应为%+v", hello)
+	}
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"bufio"
 	"fmt"
 	"net"
 	"os"
@@ -24,15 +23,6 @@ const (
 	ILLEGAL IPType = "Neither"
 )
 
-// 解析tcp切片的包头，获取到整个数据的长度
-func ResolveDataHead(data_head string) int {
-	len, err := strconv.Atoi(strings.TrimSpace(data_head[7:18]))
-	if err != nil {
-		panic("解析包头失败" + err.Error())
-	}
-	return len
-}
-
 // 判断是否为合法的ipv4地址
 func Judgev4(ips string) bool {
 	if len(ips) > 3 {
@@ -99,20 +89,6 @@ func IsIpv4OrIpv6(ip string) IPType {
 	return ILLEGAL
 }
 
-// 将uuid存储到本地
-func SaveUUID(uuid string) {
-	filePath := GetAppPath() + "/uuid.txt"
-	file, err := os.OpenFile(filePath, os.O_WRONLY, 0666)
-	if err != nil {
-		panic("文件打开失败")
-	}
-	defer file.Close()
-
-	write := bufio.NewWriter(file)
-	write.WriteString(uuid)
-	write.Flush()
-}
-
 // 获取本机的ipv6地址
 func GetIPV6Addr() (ip string, err error) {
 	conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:53") //2001:4860:4860::8888是Google提供的免费DNS服务器的IPV6地址
@@ -138,6 +114,66 @@ func GetPrivAddr() (ip string, err error) {
 	return
 }
 
+// 本机网卡上的一个可用地址
+type HostAddr struct {
+	IP net.IP
+
+	// 所在网卡的名称
+	Interface string
+
+	// 是否为虚拟网卡，如docker网桥、vpn隧道
+	Virtual bool
+}
+
+// 虚拟网卡名称的常见前缀
+var virtualInterfacePrefixes = []string{"docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "tun", "tap", "wg", "utun", "zt", "tailscale", "ppp"}
+
+// 判断网卡是否为虚拟网卡
+func IsVirtualInterface(name string) bool {
+	lower := strings.ToLower(name)
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 枚举本机所有可用的地址，跳过未启用的网卡、回环地址和链路本地地址
+func GetHostAddrs() ([]HostAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []HostAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP
+			if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+				continue
+			}
+			addrs = append(addrs, HostAddr{IP: ip, Interface: iface.Name, Virtual: IsVirtualInterface(iface.Name)})
+		}
+	}
+	return addrs, nil
+}
+
+// 记录收到的消息的大小和来源。消息可能包含配对码或业务数据，内容不写入日志
+func LogRecv(n int, from string) {
+	fmt.Printf(">读取到%d个字节,来自%s\n", n, from)
+}
+
 // 获取当前所在目录的路径
 // 在go中"./"指的并不是文件所在的目录，而是工程目录。所以需要避免使用相对路径，而是使用绝对路径
 func GetAppPath() string {